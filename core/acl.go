@@ -0,0 +1,153 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Operation is something an ACLRule lets a client do.
+type Operation string
+
+const (
+	// OpReserve lets the client reserve space for paths.
+	OpReserve Operation = "reserve"
+	// OpRelease lets the client release reservations for paths.
+	OpRelease Operation = "release"
+	// OpReport lets the client see reservations for paths.
+	OpReport Operation = "report"
+)
+
+var validOperations = map[Operation]bool{
+	OpReserve: true,
+	OpRelease: true,
+	OpReport:  true,
+}
+
+// ACLRule lets Client perform Operations on Prefix and the paths under
+// it. Client is the client's authenticated identity (see
+// VolumeService.SetACL), or AnyClient ("*") for a rule that applies to
+// every client, including those that haven't authenticated. For
+// example, this rule lets the ingest client reserve and release space
+// under /data/ingest, but not /data/ingest2:
+//
+//	{"client": "ingest", "prefix": "/data/ingest", "operations": ["reserve", "release"]}
+type ACLRule struct {
+	Client     string      `json:"client"`
+	Prefix     string      `json:"prefix"`
+	Operations []Operation `json:"operations"`
+}
+
+// aclTable is the service's ACL rules, with clean prefixes.
+type aclTable []ACLRule
+
+// newACLTable validates rules and returns them as an aclTable.
+func newACLTable(rules []ACLRule) (aclTable, error) {
+	table := make(aclTable, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Client == "" {
+			return nil, fmt.Errorf("every ACL rule must have a client")
+		}
+		if !filepath.IsAbs(rule.Prefix) {
+			return nil, fmt.Errorf("ACL rule for '%s' has prefix '%s', which should be an absolute path",
+				rule.Client, rule.Prefix)
+		}
+		if len(rule.Operations) == 0 {
+			return nil, fmt.Errorf("ACL rule for '%s' on %s has no operations", rule.Client, rule.Prefix)
+		}
+		for _, op := range rule.Operations {
+			if !validOperations[op] {
+				return nil, fmt.Errorf("ACL rule for '%s' on %s has operation '%s', "+
+					"which should be reserve, release or report", rule.Client, rule.Prefix, op)
+			}
+		}
+		rule.Prefix = filepath.Clean(rule.Prefix)
+		table = append(table, rule)
+	}
+	return table, nil
+}
+
+// allows reports whether the table lets client perform op on path. An
+// empty table allows everything.
+func (table aclTable) allows(client string, op Operation, path string) bool {
+	if len(table) == 0 {
+		return true
+	}
+	path = filepath.Clean(path)
+	for _, rule := range table {
+		if rule.Client != client && rule.Client != AnyClient {
+			continue
+		}
+		if !pathIsUnder(path, rule.Prefix) {
+			continue
+		}
+		for _, ruleOp := range rule.Operations {
+			if ruleOp == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetACL replaces the service's ACL rules. Once the service has rules,
+// a client may reserve, release, or see reservations for a path only
+// if a rule for it (or for AnyClient) allows that operation on a
+// prefix of the path. Reports leave out reservations the client isn't
+// allowed to see. Clients are identified only in ways they can't
+// forge: by token name, certificate subject, or UID ("uid:1000") over
+// a Unix socket. Names clients declare for themselves, with the
+// ClientHeader or the line protocol's CLIENT, don't count, so those
+// clients get only the rules for AnyClient. Pass nil to let any client
+// do anything its token allows.
+func (service *VolumeService) SetACL(rules []ACLRule) error {
+	table, err := newACLTable(rules)
+	if err != nil {
+		return err
+	}
+	service.authMutex.Lock()
+	defer service.authMutex.Unlock()
+	service.acl = table
+	service.auditConfig("set %d ACL rules", len(rules))
+	return nil
+}
+
+// currentACL returns the service's ACL rules.
+func (service *VolumeService) currentACL() aclTable {
+	service.authMutex.RLock()
+	defer service.authMutex.RUnlock()
+	return service.acl
+}
+
+// checkACL returns an accessDeniedError, and logs the denial, unless
+// the ACL lets client perform op on path.
+func (service *VolumeService) checkACL(client string, op Operation, path string) error {
+	if service.currentACL().allows(client, op, path) {
+		return nil
+	}
+	service.logger.Warningf("[%s] ACL denied %s on %s", client, op, path)
+	if client == AnyClient {
+		return accessDeniedError(fmt.Sprintf("unauthenticated clients may not %s %s", op, path))
+	}
+	return accessDeniedError(fmt.Sprintf("client '%s' may not %s %s", client, op, path))
+}
+
+// visibleReservations returns the reservations the ACL lets client see.
+func (service *VolumeService) visibleReservations(client string, reservations []Reservation) []Reservation {
+	acl := service.currentACL()
+	if len(acl) == 0 {
+		return reservations
+	}
+	visible := make([]Reservation, 0, len(reservations))
+	for _, r := range reservations {
+		if acl.allows(client, OpReport, r.Path) {
+			visible = append(visible, r)
+		}
+	}
+	return visible
+}
+
+// eventVisible reports whether the ACL lets client see event. Events
+// about whole volumes, which have no path, are visible to everyone.
+func (service *VolumeService) eventVisible(client string, event Event) bool {
+	return event.Path == "" || service.currentACL().allows(client, OpReport, event.Path)
+}
@@ -0,0 +1,261 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/diamondap/vreserve/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newACLService returns a service that requires testTokens, with an
+// ACL that gives ingest and restore their own trees under dir, and
+// lets anyone see everything under dir/shared.
+func newACLService(t *testing.T, dir string) *core.VolumeService {
+	service := newTokenService(t)
+	all := []core.Operation{core.OpReserve, core.OpRelease, core.OpReport}
+	require.Nil(t, service.SetACL([]core.ACLRule{
+		{Client: "ingest", Prefix: filepath.Join(dir, "ingest"), Operations: all},
+		{Client: "restore", Prefix: filepath.Join(dir, "restore"), Operations: all},
+		{Client: core.AnyClient, Prefix: filepath.Join(dir, "shared"), Operations: []core.Operation{core.OpReport}},
+	}))
+	return service
+}
+
+func TestACL(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "acl")
+	service := newACLService(t, dir)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := func(name string) *core.VolumeClient {
+		return core.NewVolumeClient(server.URL, core.WithToken(name+"-secret"))
+	}
+	ingestFile := filepath.Join(dir, "ingest", "bag.tar")
+	restoreFile := filepath.Join(dir, "restore", "bag.tar")
+
+	id, err := client("ingest").AddReservation(ingestFile, 100, 0)
+	require.Nil(t, err)
+	_, err = client("restore").AddReservation(restoreFile, 200, 0)
+	require.Nil(t, err)
+
+	// A prefix covers the paths under it, not its siblings.
+	_, err = client("ingest").AddReservation(restoreFile, 100, 0)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+	var serviceErr *core.ServiceError
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, core.CodeAccessDenied, serviceErr.Code)
+	assert.Equal(t, http.StatusForbidden, serviceErr.StatusCode)
+	_, err = client("ingest").AddReservation(filepath.Join(dir, "ingest2", "bag.tar"), 100, 0)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+	_, err = client("ingest").AddReservation(filepath.Join(dir, "shared", "bag.tar"), 100, 0)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+
+	// Clients can release only under their own prefixes, by path or ID.
+	err = client("restore").Release(ingestFile)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+	err = client("restore").ReleaseID(id)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+	assert.Len(t, service.ReservationList(ingestFile), 2)
+
+	// Reports leave out what the client can't see.
+	reservations, err := client("ingest").Reservations(ingestFile)
+	require.Nil(t, err)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, ingestFile, reservations[0].Path)
+	report, err := client("ingest").Report(ingestFile)
+	require.Nil(t, err)
+	assert.Equal(t, map[string]uint64{ingestFile: 100}, report)
+	_, err = client("ingest").Reservations(restoreFile)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+	reservations, err = client("reader").Reservations(filepath.Join(dir, "shared"))
+	require.Nil(t, err)
+	assert.Empty(t, reservations)
+
+	assert.Nil(t, client("ingest").ReleaseID(id))
+	assert.Nil(t, client("restore").Release(restoreFile))
+	assert.Empty(t, service.ReservationList(ingestFile))
+}
+
+func TestACLV2(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "acl_v2")
+	service := newACLService(t, dir)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	ingestFile := filepath.Join(dir, "ingest", "bag.tar")
+	restoreFile := filepath.Join(dir, "restore", "bag.tar")
+	ingestID, err := service.AddReservation("ingest", ingestFile, 100, 0)
+	require.Nil(t, err)
+	_, err = service.AddReservation("restore", restoreFile, 100, 0)
+	require.Nil(t, err)
+
+	request := func(method, url, client, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+url, strings.NewReader(body))
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+client+"-secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	resp := request(http.MethodPost, "/v2/reservations", "restore",
+		`{"path": "`+ingestFile+`", "bytes": 100}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	errResp := core.ErrorResponseV2{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, core.CodeAccessDenied, errResp.Error.Code)
+
+	assert.Equal(t, http.StatusForbidden,
+		request(http.MethodDelete, "/v2/reservations/"+ingestID, "restore", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden,
+		request(http.MethodGet, "/v2/reservations/"+ingestID, "restore", "").StatusCode)
+	assert.Equal(t, http.StatusOK,
+		request(http.MethodGet, "/v2/reservations/"+ingestID, "ingest", "").StatusCode)
+
+	resp = request(http.MethodGet, "/v2/reservations", "restore", "")
+	list := core.ReservationListV2{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Len(t, list.Reservations, 1)
+	assert.Equal(t, restoreFile, list.Reservations[0].Path)
+}
+
+func TestACLGRPC(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "acl_grpc")
+	service := newACLService(t, dir)
+	client := newGRPCClient(t, service)
+	as := func(name string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+name+"-secret")
+	}
+	ingestFile := filepath.Join(dir, "ingest", "bag.tar")
+
+	_, err := client.Reserve(as("restore"), &rpc.ReserveRequest{Path: ingestFile, Bytes: 100})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	code, _ := core.RPCErrorCode(err)
+	assert.Equal(t, core.CodeAccessDenied, code)
+	resp, err := client.Reserve(as("ingest"), &rpc.ReserveRequest{Path: ingestFile, Bytes: 100})
+	require.Nil(t, err)
+
+	_, err = client.Report(as("restore"), &rpc.ReportRequest{Path: ingestFile})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	target := &rpc.ReleaseRequest_Id{Id: resp.Reservation.Id}
+	_, err = client.Release(as("restore"), &rpc.ReleaseRequest{Target: target})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Release(as("ingest"), &rpc.ReleaseRequest{Target: target})
+	assert.Nil(t, err)
+}
+
+func TestACLLineProtocol(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "acl_line")
+	service := newACLService(t, dir)
+	addr := serveLines(t, service, false)
+	ingestFile := filepath.Join(dir, "ingest", "bag.tar")
+
+	lines := dialLines(t, addr)
+	assert.Equal(t, "OK", lines.send(t, "AUTH restore-secret"))
+	assert.True(t, strings.HasPrefix(lines.send(t, "RESERVE "+ingestFile+" 100"), "ERR ACCESS_DENIED "))
+	assert.True(t, strings.HasPrefix(lines.send(t, "RELEASE "+ingestFile), "ERR ACCESS_DENIED "))
+	assert.True(t, strings.HasPrefix(lines.send(t, "REPORT "+ingestFile), "ERR ACCESS_DENIED "))
+	assert.Equal(t, "OK", lines.send(t, "AUTH ingest-secret"))
+	assert.True(t, strings.HasPrefix(lines.send(t, "RESERVE "+ingestFile+" 100"), "OK "))
+}
+
+func TestACLEvents(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "acl_events")
+	service := newACLService(t, dir)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	ingestFile := filepath.Join(dir, "ingest", "bag.tar")
+	restoreFile := filepath.Join(dir, "restore", "bag.tar")
+	_, err := service.AddReservation("restore", restoreFile, 100, 0)
+	require.Nil(t, err)
+	_, err = service.AddReservation("ingest", ingestFile, 100, 0)
+	require.Nil(t, err)
+
+	// The restore client sees neither the ingest reservation it missed
+	// nor the ones that follow, only its own.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := core.NewVolumeClient(server.URL, core.WithToken("restore-secret"))
+	events, err := client.Watch(ctx, core.WatchAfter(1))
+	require.Nil(t, err)
+	_, err = service.AddReservation("ingest", ingestFile, 100, 0)
+	require.Nil(t, err)
+	_, err = service.AddReservation("restore", restoreFile, 100, 0)
+	require.Nil(t, err)
+	event := nextEvent(t, events)
+	assert.Equal(t, uint64(4), event.ID)
+	assert.Equal(t, core.EventReserve, event.Type)
+	assert.Equal(t, restoreFile, event.Path)
+}
+
+func TestACLIgnoresDeclaredNames(t *testing.T) {
+	// Without tokens, clients can call themselves anything, so the ACL
+	// treats them all as AnyClient.
+	dir := filepath.Join(os.TempDir(), "acl_declared")
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	require.Nil(t, service.SetACL([]core.ACLRule{
+		{Client: "ingest", Prefix: filepath.Join(dir, "ingest"), Operations: []core.Operation{core.OpReserve}},
+		{Client: core.AnyClient, Prefix: filepath.Join(dir, "shared"), Operations: []core.Operation{core.OpReserve}},
+	}))
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	ingestFile := filepath.Join(dir, "ingest", "bag.tar")
+	sharedFile := filepath.Join(dir, "shared", "bag.tar")
+
+	spoofed := core.NewVolumeClient(server.URL, core.WithClientName("ingest"))
+	_, err := spoofed.AddReservation(ingestFile, 100, 0)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+	_, err = spoofed.AddReservation(sharedFile, 100, 0)
+	assert.Nil(t, err)
+
+	grpcClient := newGRPCClient(t, service)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), core.ClientHeader, "ingest")
+	_, err = grpcClient.Reserve(ctx, &rpc.ReserveRequest{Path: ingestFile, Bytes: 100})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	lines := dialLines(t, serveLines(t, service, false))
+	assert.Equal(t, "OK", lines.send(t, "CLIENT ingest"))
+	assert.True(t, strings.HasPrefix(lines.send(t, "RESERVE "+ingestFile+" 100"), "ERR ACCESS_DENIED "))
+	reservations := service.ReservationList(ingestFile)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, sharedFile, reservations[0].Path)
+}
+
+func TestSetACL(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	reserve := []core.Operation{core.OpReserve}
+	assert.NotNil(t, service.SetACL([]core.ACLRule{{Prefix: "/data", Operations: reserve}}))
+	assert.NotNil(t, service.SetACL([]core.ACLRule{{Client: "a", Prefix: "data", Operations: reserve}}))
+	assert.NotNil(t, service.SetACL([]core.ACLRule{{Client: "a", Prefix: "/data"}}))
+	assert.NotNil(t, service.SetACL([]core.ACLRule{
+		{Client: "a", Prefix: "/data", Operations: []core.Operation{"delete"}}}))
+	assert.Nil(t, service.SetACL([]core.ACLRule{{Client: "a", Prefix: "/data/", Operations: reserve}}))
+	assert.Nil(t, service.SetACL(nil))
+}
+
+func TestACLRootPrefix(t *testing.T) {
+	// A rule for "/" covers every absolute path, but not relative ones.
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	require.Nil(t, service.SetACL([]core.ACLRule{
+		{Client: core.AnyClient, Prefix: "/", Operations: []core.Operation{core.OpReserve}},
+	}))
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := core.NewVolumeClient(server.URL)
+
+	_, err := client.AddReservation(filepath.Join(os.TempDir(), "acl_root", "bag.tar"), 100, 0)
+	assert.Nil(t, err)
+	_, err = client.AddReservation(filepath.Join("acl_root", "bag.tar"), 100, 0)
+	assert.True(t, errors.Is(err, core.ErrAccessDenied), "got %v", err)
+}
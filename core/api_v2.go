@@ -0,0 +1,426 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The v2 API takes and returns JSON, uses HTTP verbs and status codes
+// the usual way, and identifies reservations by ID. It's served under
+// /v2/, alongside the original (v1) API, which is unchanged.
+//
+//	POST   /v2/reservations             ReserveRequestV2 -> 201 ReservationV2
+//	GET    /v2/reservations?path=<path> -> 200 ReservationListV2
+//	GET    /v2/reservations/<id>        -> 200 ReservationV2
+//	DELETE /v2/reservations/<id>        -> 204
+//	POST   /v2/reservations/<id>/renew  RenewRequestV2 -> 200 ReservationV2
+//	GET    /v2/volumes                  -> 200 VolumeListV2
+//
+// Errors come back as an ErrorResponseV2 with a 4xx or 5xx status.
+
+// maxRequestBodyV2 is the largest request body the v2 API accepts.
+const maxRequestBodyV2 = 1 << 20
+
+// Duration is a time.Duration that is written to JSON as a Go duration
+// string ("5m0s"), and read from JSON as either a duration string or
+// a number of seconds.
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration string or a number of seconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a number of seconds or a string such as '5m'")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ReserveRequestV2 is the body of POST /v2/reservations. Lease and
+// Wait work like the lease and wait params of the v1 /reserve/ call.
+type ReserveRequestV2 struct {
+	Path  string   `json:"path"`
+	Bytes uint64   `json:"bytes"`
+	Lease Duration `json:"lease,omitempty"`
+	Wait  Duration `json:"wait,omitempty"`
+}
+
+// RenewRequestV2 is the optional body of POST /v2/reservations/<id>/renew.
+// If Lease is zero, the lease is renewed for its original duration.
+type RenewRequestV2 struct {
+	Lease Duration `json:"lease,omitempty"`
+}
+
+// ReservationV2 describes a reservation. QueuePosition is set only in
+// the response to a request that had to wait for space.
+type ReservationV2 struct {
+	ID            string     `json:"id"`
+	Path          string     `json:"path"`
+	Bytes         uint64     `json:"bytes"`
+	Volume        string     `json:"volume"`
+	Client        string     `json:"client,omitempty"`
+	Expires       *time.Time `json:"expires,omitempty"`
+	QueuePosition int        `json:"queue_position,omitempty"`
+}
+
+// ReservationListV2 is the response to GET /v2/reservations.
+type ReservationListV2 struct {
+	Reservations []ReservationV2 `json:"reservations"`
+}
+
+// VolumeV2 describes a volume the service is tracking. TotalBytes and
+// FreeBytes come from the operating system, and are omitted if the
+// volume can't be measured, in which case Error says why.
+// AvailableBytes is FreeBytes minus ClaimedBytes.
+// BackgroundBytesPerSecond and TimeToFull are omitted until the service
+// can estimate background consumption, and TimeToFull is also omitted
+// if the volume isn't filling. Full is true if background consumption
+// has already used up the available bytes.
+type VolumeV2 struct {
+	MountPoint     string   `json:"mount_point"`
+	MountPoints    []string `json:"mount_points"`
+	Device         uint64   `json:"device"`
+	FsType         string   `json:"fs_type,omitempty"`
+	TotalBytes     uint64   `json:"total_bytes,omitempty"`
+	FreeBytes      uint64   `json:"free_bytes,omitempty"`
+	ClaimedBytes   uint64   `json:"claimed_bytes"`
+	AvailableBytes uint64   `json:"available_bytes"`
+	Reservations   int      `json:"reservations"`
+	QueueLength    int      `json:"queue_length"`
+	Error          string   `json:"error,omitempty"`
+
+	BackgroundBytesPerSecond float64  `json:"background_bytes_per_second,omitempty"`
+	TimeToFull               Duration `json:"time_to_full,omitempty"`
+	Full                     bool     `json:"full,omitempty"`
+}
+
+// VolumeListV2 is the response to GET /v2/volumes.
+type VolumeListV2 struct {
+	Volumes []VolumeV2 `json:"volumes"`
+}
+
+// ErrorV2 describes what went wrong with a v2 request. Code is one of
+// the same ErrorCodes the v1 API returns. QueuePosition
+// is set when a request gives up waiting for space.
+type ErrorV2 struct {
+	Code          ErrorCode `json:"code"`
+	Message       string    `json:"message"`
+	QueuePosition int       `json:"queue_position,omitempty"`
+}
+
+// ErrorResponseV2 is the body of every v2 error response.
+type ErrorResponseV2 struct {
+	Error ErrorV2 `json:"error"`
+}
+
+// v2EndpointName returns the name r's v2 route goes by in rate limits
+// and latency metrics, such as "v2.reserve", so a busy route doesn't
+// use up the limit for the others. Requests that don't match a route
+// go by "v2".
+func v2EndpointName(r *http.Request) string {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2/"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "reservations" && r.Method == http.MethodPost:
+		return "v2.reserve"
+	case len(parts) <= 2 && parts[0] == "reservations" && r.Method == http.MethodGet:
+		return "v2.reservations"
+	case len(parts) == 2 && parts[0] == "reservations" && r.Method == http.MethodDelete:
+		return "v2.release"
+	case len(parts) == 3 && parts[0] == "reservations" && parts[2] == "renew" && r.Method == http.MethodPost:
+		return "v2.renew"
+	case len(parts) == 1 && parts[0] == "volumes" && r.Method == http.MethodGet:
+		return "v2.volumes"
+	}
+	return v2Endpoint
+}
+
+// makeV2Handler routes requests under /v2/.
+func (service *VolumeService) makeV2Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := RoleReserver
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role = RoleReader
+		}
+		r, err := service.authorizeRequest(r, role)
+		if err != nil {
+			setAuthenticateHeader(w, err)
+			writeErrorV2(w, errorCode(err), err.Error())
+			return
+		}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2/"), "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "reservations":
+			switch r.Method {
+			case http.MethodPost:
+				service.v2Reserve(w, r)
+			case http.MethodGet:
+				service.v2ListReservations(w, r)
+			default:
+				methodNotAllowedV2(w, http.MethodGet, http.MethodPost)
+			}
+		case len(parts) == 2 && parts[0] == "reservations":
+			switch r.Method {
+			case http.MethodGet:
+				service.v2GetReservation(w, r, parts[1])
+			case http.MethodDelete:
+				service.v2Release(w, r, parts[1])
+			default:
+				methodNotAllowedV2(w, http.MethodGet, http.MethodDelete)
+			}
+		case len(parts) == 3 && parts[0] == "reservations" && parts[2] == "renew":
+			if r.Method != http.MethodPost {
+				methodNotAllowedV2(w, http.MethodPost)
+				return
+			}
+			service.v2Renew(w, r, parts[1])
+		case len(parts) == 1 && parts[0] == "volumes":
+			if r.Method != http.MethodGet {
+				methodNotAllowedV2(w, http.MethodGet)
+				return
+			}
+			service.v2Volumes(w, r)
+		default:
+			writeErrorV2(w, CodeNotFound, fmt.Sprintf("No such resource: %s", r.URL.Path))
+		}
+	}
+}
+
+func (service *VolumeService) v2Reserve(w http.ResponseWriter, r *http.Request) {
+	request := ReserveRequestV2{}
+	if err := readJSONV2(r, &request); err != nil {
+		writeErrorV2(w, CodeInvalidParam, err.Error())
+		return
+	}
+	if request.Path == "" {
+		writeErrorV2(w, CodeInvalidParam, "Field 'path' is required.")
+		return
+	}
+	if request.Bytes < 1 {
+		writeErrorV2(w, CodeInvalidParam, "Field 'bytes' must be an integer greater than zero.")
+		return
+	}
+	if request.Lease < 0 || request.Wait < 0 {
+		writeErrorV2(w, CodeInvalidParam, "Fields 'lease' and 'wait' cannot be negative.")
+		return
+	}
+	client := clientName(r)
+	volume := service.getVolume(request.Path)
+	if err := service.checkACL(aclName(r), OpReserve, request.Path); err != nil {
+		service.auditReserve(client, remoteAddr(r), volume, request.Path, request.Bytes, "", err)
+		writeErrorV2(w, CodeAccessDenied, fmt.Sprintf("Could not reserve %d bytes for file '%s': %v",
+			request.Bytes, request.Path, err))
+		return
+	}
+	peer := peerCredFrom(r.Context())
+	var id string
+	var position int
+	var err error
+	if request.Wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(request.Wait))
+		id, position, err = service.reserveWait(ctx, callerToken(r.Context()), client, peer,
+			volume, request.Path, request.Bytes, time.Duration(request.Lease), false)
+		cancel()
+	} else {
+		id, err = service.reserve(callerToken(r.Context()), client, peer,
+			volume, request.Path, request.Bytes, time.Duration(request.Lease), false)
+	}
+	service.auditReserve(client, remoteAddr(r), volume, request.Path, request.Bytes, id, err)
+	if err != nil {
+		message := fmt.Sprintf("Could not reserve %d bytes for file '%s': %v",
+			request.Bytes, request.Path, err)
+		service.logger.Warningf("[%s] %s", client, message)
+		code := errorCode(err)
+		writeJSONV2(w, code.Status(), ErrorResponseV2{Error: ErrorV2{
+			Code:          code,
+			Message:       message,
+			QueuePosition: position,
+		}})
+		return
+	}
+	service.logger.Infof("[%s] Reserved %d bytes for %s (%s)", client,
+		request.Bytes, request.Path, id)
+	reservation, ok := volume.Reservation(id)
+	if !ok {
+		// Released (or expired) already. Unlikely, but possible.
+		reservation = Reservation{ID: id, Path: request.Path, Bytes: request.Bytes, Client: client}
+	}
+	resource := reservationV2(volume, reservation)
+	resource.QueuePosition = position
+	w.Header().Set("Location", "/v2/reservations/"+id)
+	writeJSONV2(w, http.StatusCreated, resource)
+}
+
+func (service *VolumeService) v2ListReservations(w http.ResponseWriter, r *http.Request) {
+	client := aclName(r)
+	volumes := service.allVolumes()
+	if path := r.URL.Query().Get("path"); path != "" {
+		if err := service.checkACL(client, OpReport, path); err != nil {
+			writeErrorV2(w, CodeAccessDenied, err.Error())
+			return
+		}
+		volumes = []*Volume{service.getVolume(path)}
+	}
+	list := ReservationListV2{Reservations: make([]ReservationV2, 0)}
+	for _, volume := range sortVolumes(volumes) {
+		for _, reservation := range service.visibleReservations(client, volume.ReservationList()) {
+			list.Reservations = append(list.Reservations, reservationV2(volume, reservation))
+		}
+	}
+	writeJSONV2(w, http.StatusOK, list)
+}
+
+func (service *VolumeService) v2GetReservation(w http.ResponseWriter, r *http.Request, id string) {
+	volume, reservation, ok := service.findReservation(id)
+	if !ok {
+		writeErrorV2(w, CodeNotFound, fmt.Sprintf("No reservation has ID '%s'.", id))
+		return
+	}
+	if err := service.checkACL(aclName(r), OpReport, reservation.Path); err != nil {
+		writeErrorV2(w, CodeAccessDenied, err.Error())
+		return
+	}
+	writeJSONV2(w, http.StatusOK, reservationV2(volume, reservation))
+}
+
+func (service *VolumeService) v2Release(w http.ResponseWriter, r *http.Request, id string) {
+	volume, released, err := service.releaseAs(r.Context(), aclName(r), id, "")
+	service.auditRelease(clientName(r), remoteAddr(r), volume, id, "", released, err)
+	if errors.Is(err, ErrNotFound) {
+		writeErrorV2(w, CodeNotFound, fmt.Sprintf("No reservation has ID '%s'.", id))
+		return
+	} else if err != nil {
+		service.logger.Warningf("[%s] Could not release %s: %v", clientName(r), id, err)
+		writeErrorV2(w, errorCode(err), fmt.Sprintf("Could not release '%s': %v", id, err))
+		return
+	}
+	service.logger.Infof("[%s] Released %s", clientName(r), id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (service *VolumeService) v2Renew(w http.ResponseWriter, r *http.Request, id string) {
+	request := RenewRequestV2{}
+	if err := readJSONV2(r, &request); err != nil {
+		writeErrorV2(w, CodeInvalidParam, err.Error())
+		return
+	}
+	if request.Lease < 0 {
+		writeErrorV2(w, CodeInvalidParam, "Field 'lease' cannot be negative.")
+		return
+	}
+	if _, _, ok := service.findReservation(id); !ok {
+		writeErrorV2(w, CodeNotFound, fmt.Sprintf("No reservation has ID '%s'.", id))
+		return
+	}
+	volume, err := service.renewAs(r.Context(), aclName(r), id, "", time.Duration(request.Lease))
+	service.auditRenew(clientName(r), remoteAddr(r), volume, id, "", err)
+	if err != nil {
+		writeErrorV2(w, errorCode(err),
+			fmt.Sprintf("Could not renew lease for '%s': %v", id, err))
+		return
+	}
+	service.logger.Debugf("[%s] Renewed lease on %s", clientName(r), id)
+	service.v2GetReservation(w, r, id)
+}
+
+func (service *VolumeService) v2Volumes(w http.ResponseWriter, r *http.Request) {
+	list := VolumeListV2{Volumes: make([]VolumeV2, 0)}
+	for _, info := range service.Volumes() {
+		list.Volumes = append(list.Volumes, VolumeV2{
+			MountPoint:     info.MountPoint,
+			MountPoints:    info.MountPoints,
+			Device:         info.Device,
+			FsType:         info.FsType,
+			TotalBytes:     info.TotalBytes,
+			FreeBytes:      info.FreeBytes,
+			ClaimedBytes:   info.ClaimedBytes,
+			AvailableBytes: info.AvailableBytes,
+			Reservations:   info.Reservations,
+			QueueLength:    info.QueueLength,
+			Error:          info.Error,
+
+			BackgroundBytesPerSecond: info.BackgroundBytesPerSecond,
+			TimeToFull:               info.TimeToFull,
+			Full:                     info.Full,
+		})
+	}
+	writeJSONV2(w, http.StatusOK, list)
+}
+
+// reservationV2 converts a Reservation on volume to its v2 form.
+func reservationV2(volume *Volume, reservation Reservation) ReservationV2 {
+	return ReservationV2{
+		ID:      reservation.ID,
+		Path:    reservation.Path,
+		Bytes:   reservation.Bytes,
+		Volume:  volume.MountPoint(),
+		Client:  reservation.Client,
+		Expires: reservation.Expires,
+	}
+}
+
+// sortVolumes sorts volumes by mountpoint.
+func sortVolumes(volumes []*Volume) []*Volume {
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].MountPoint() < volumes[j].MountPoint()
+	})
+	return volumes
+}
+
+// readJSONV2 decodes the JSON body of r into value. An empty body
+// leaves value as is. Anything after the first JSON value, other than
+// white space, makes the body invalid.
+func readJSONV2(r *http.Request, value interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodyV2))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(value)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Request body is not valid: %v", err)
+	}
+	var extra json.RawMessage
+	if err := decoder.Decode(&extra); err != io.EOF {
+		return fmt.Errorf("Request body is not valid: it has data after the first JSON value")
+	}
+	return nil
+}
+
+func writeJSONV2(w http.ResponseWriter, status int, value interface{}) {
+	data, _ := json.Marshal(value)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// writeErrorV2 writes an error response with the HTTP status for code.
+func writeErrorV2(w http.ResponseWriter, code ErrorCode, message string) {
+	writeJSONV2(w, code.Status(), ErrorResponseV2{Error: ErrorV2{Code: code, Message: message}})
+}
+
+func methodNotAllowedV2(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeErrorV2(w, CodeMethodNotAllowed,
+		fmt.Sprintf("Method not allowed. Use %s.", strings.Join(allowed, " or ")))
+}
@@ -0,0 +1,170 @@
+package core_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// v2Request sends a v2 API request, and decodes the JSON response
+// into value, if value isn't nil.
+func v2Request(t *testing.T, method, resource, body string, value interface{}) *http.Response {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, serviceUrl+resource, reader)
+	require.Nil(t, err)
+	req.Header.Set(core.ClientHeader, "v2_test")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	if value != nil {
+		require.Nil(t, json.Unmarshal(data, value), string(data))
+	}
+	return resp
+}
+
+func TestDurationJSON(t *testing.T) {
+	request := core.ReserveRequestV2{}
+	require.Nil(t, json.Unmarshal([]byte(`{"path": "/tmp/x", "bytes": 10, "lease": 90, "wait": "2m"}`), &request))
+	assert.Equal(t, core.Duration(90*time.Second), request.Lease)
+	assert.Equal(t, core.Duration(2*time.Minute), request.Wait)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"lease": "soon"}`), &request))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"lease": true}`), &request))
+
+	data, err := json.Marshal(core.RenewRequestV2{Lease: core.Duration(5 * time.Minute)})
+	require.Nil(t, err)
+	assert.Equal(t, `{"lease":"5m0s"}`, string(data))
+}
+
+func TestV2Reservations(t *testing.T) {
+	runService(t)
+	path := "/tmp/v2_reservation"
+
+	// Create
+	created := core.ReservationV2{}
+	resp := v2Request(t, http.MethodPost, "/v2/reservations",
+		fmt.Sprintf(`{"path": %q, "bytes": 1000, "lease": "1m"}`, path), &created)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/v2/reservations/"+created.ID, resp.Header.Get("Location"))
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"))
+	assert.Regexp(t, "^[0-9a-f]{16}$", created.ID)
+	assert.Equal(t, path, created.Path)
+	assert.EqualValues(t, 1000, created.Bytes)
+	assert.Equal(t, "v2_test", created.Client)
+	assert.NotEmpty(t, created.Volume)
+	require.NotNil(t, created.Expires)
+
+	// Read
+	fetched := core.ReservationV2{}
+	resp = v2Request(t, http.MethodGet, "/v2/reservations/"+created.ID, "", &fetched)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, created, fetched)
+
+	list := core.ReservationListV2{}
+	resp = v2Request(t, http.MethodGet, "/v2/reservations?path="+path, "", &list)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, list.Reservations, created)
+
+	// Renew
+	renewed := core.ReservationV2{}
+	resp = v2Request(t, http.MethodPost, "/v2/reservations/"+created.ID+"/renew",
+		`{"lease": 3600}`, &renewed)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotNil(t, renewed.Expires)
+	assert.True(t, renewed.Expires.After(*created.Expires))
+
+	// Delete
+	resp = v2Request(t, http.MethodDelete, "/v2/reservations/"+created.ID, "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	errResp := core.ErrorResponseV2{}
+	resp = v2Request(t, http.MethodDelete, "/v2/reservations/"+created.ID, "", &errResp)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, errResp.Error.Message, created.ID)
+	resp = v2Request(t, http.MethodGet, "/v2/reservations/"+created.ID, "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = v2Request(t, http.MethodPost, "/v2/reservations/"+created.ID+"/renew", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestV2Errors(t *testing.T) {
+	runService(t)
+	testCases := []struct {
+		method   string
+		resource string
+		body     string
+		status   int
+	}{
+		{http.MethodPost, "/v2/reservations", `{"bytes": 100}`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `{"path": "/tmp/v2_bad"}`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `{"path": "/tmp/v2_bad", "bytes": -1}`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `{"path": "/tmp/v2_bad", "bytes": 1, "colour": "red"}`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `{"path": "/tmp/v2_bad", "bytes": 1, "lease": "-1m"}`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `{"path": "/tmp/v2_bad", "bytes": 1}{"bytes": 999}`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `{"path": "/tmp/v2_bad", "bytes": 1} junk`, http.StatusBadRequest},
+		{http.MethodPost, "/v2/reservations", `{"path": "/tmp/v2_bad", "bytes": 4611686018427387904}`, http.StatusInsufficientStorage},
+		{http.MethodPut, "/v2/reservations", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/v2/reservations/abc", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v2/reservations/abc/renew", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/v2/volumes", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v2/widgets", "", http.StatusNotFound},
+		{http.MethodGet, "/v2/reservations/abc/def", "", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		errResp := core.ErrorResponseV2{}
+		resp := v2Request(t, tc.method, tc.resource, tc.body, &errResp)
+		assert.Equal(t, tc.status, resp.StatusCode, "%s %s %s", tc.method, tc.resource, tc.body)
+		assert.NotEmpty(t, errResp.Error.Message, "%s %s %s", tc.method, tc.resource, tc.body)
+		assert.Equal(t, tc.status, errResp.Error.Code.Status(), "%s %s %s", tc.method, tc.resource, tc.body)
+		if tc.status == http.StatusMethodNotAllowed {
+			assert.NotEmpty(t, resp.Header.Get("Allow"))
+		}
+	}
+}
+
+func TestV2WaitTimesOut(t *testing.T) {
+	runService(t)
+	errResp := core.ErrorResponseV2{}
+	resp := v2Request(t, http.MethodPost, "/v2/reservations",
+		`{"path": "/tmp/v2_wait", "bytes": 4611686018427387904, "wait": 0.05}`, &errResp)
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	assert.Equal(t, 1, errResp.Error.QueuePosition)
+}
+
+func TestV2Volumes(t *testing.T) {
+	runService(t)
+	path := "/tmp/v2_volume"
+	created := core.ReservationV2{}
+	resp := v2Request(t, http.MethodPost, "/v2/reservations",
+		fmt.Sprintf(`{"path": %q, "bytes": 500}`, path), &created)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	defer v2Request(t, http.MethodDelete, "/v2/reservations/"+created.ID, "", nil)
+
+	list := core.VolumeListV2{}
+	resp = v2Request(t, http.MethodGet, "/v2/volumes", "", &list)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var volume *core.VolumeV2
+	for i := range list.Volumes {
+		if list.Volumes[i].MountPoint == created.Volume {
+			volume = &list.Volumes[i]
+		}
+	}
+	require.NotNil(t, volume, "volume %s not listed", created.Volume)
+	assert.Contains(t, volume.MountPoints, created.Volume)
+	assert.True(t, volume.TotalBytes > 0)
+	assert.True(t, volume.ClaimedBytes >= 500)
+	assert.True(t, volume.Reservations >= 1)
+	assert.True(t, volume.AvailableBytes <= volume.FreeBytes)
+}
@@ -0,0 +1,737 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditAction is the kind of change an AuditEntry records.
+type AuditAction string
+
+const (
+	// AuditReserve records a request for space.
+	AuditReserve AuditAction = "reserve"
+	// AuditRelease records a request to release reservations, with one
+	// entry for each reservation released. Reservations released
+	// because a new one replaced them, or because they were granted to
+	// a request that had given up, get one too, with the reason in its
+	// Message.
+	AuditRelease AuditAction = "release"
+	// AuditRenew records a request to renew leases.
+	AuditRenew AuditAction = "renew"
+	// AuditExpire records a reservation released because its lease
+	// expired.
+	AuditExpire AuditAction = "expire"
+	// AuditConfig records an administrative change to the service's
+	// settings, such as its quotas, tokens or ACL.
+	AuditConfig AuditAction = "config"
+)
+
+// AuditOK is the Outcome of an AuditEntry for a request that
+// succeeded. Requests that failed have their ErrorCode as the Outcome.
+const AuditOK = "ok"
+
+// auditHeadSize is the size of the head file, which is rewritten in
+// place after every entry. Padding it to a fixed size means a rewrite
+// never leaves the end of an older, longer head behind.
+const auditHeadSize = 128
+
+// AuditEntry is one entry in the AuditLog. Client is the identity of
+// the client that made the request (for expiries, the reservation's
+// owner), and Remote is its address. Owner is the client that held a
+// released reservation, which differs from Client when an admin
+// releases someone else's reservation. Prev is the Hash of the entry
+// before this one, and Hash is the SHA-256 of this entry's JSON
+// without its Hash, so changing, removing or reordering entries breaks
+// the chain.
+type AuditEntry struct {
+	Seq           uint64      `json:"seq"`
+	Time          time.Time   `json:"time"`
+	Action        AuditAction `json:"action"`
+	Outcome       string      `json:"outcome"`
+	Client        string      `json:"client,omitempty"`
+	Remote        string      `json:"remote,omitempty"`
+	Volume        string      `json:"volume,omitempty"`
+	Path          string      `json:"path,omitempty"`
+	ReservationID string      `json:"reservation_id,omitempty"`
+	Owner         string      `json:"owner,omitempty"`
+	Bytes         uint64      `json:"bytes,omitempty"`
+	Message       string      `json:"message,omitempty"`
+	Prev          string      `json:"prev"`
+	Hash          string      `json:"hash,omitempty"`
+}
+
+// hash returns the hash of entry, computed over its JSON without its
+// Hash.
+func (entry AuditEntry) hash() (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditHead is the contents of the head file: the Seq and Hash of the
+// last entry in the log. A log whose last entry comes before the head
+// has been truncated.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// AuditLog is an append-only, hash-chained record of every change to
+// the ledger and to the service's settings, for answering questions
+// such as "who released /data/xyz at 3am". Unlike the Journal, it's
+// never compacted. Next to the log, in a file with the same name plus
+// ".head", it keeps the Seq and Hash of the last entry, so
+// VerifyAuditLog can tell if entries were cut off the end.
+//
+// The chain has no secret in it, so someone who can write the log can
+// rewrite all of it. To catch that, copy the last hash that
+// VerifyAuditLog reports somewhere else from time to time.
+type AuditLog struct {
+	path   string
+	policy FsyncPolicy
+	mutex  sync.Mutex
+	file   *os.File
+	head   *os.File
+	seq    uint64
+	last   string
+	dirty  bool
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// AuditSummary describes a verified AuditLog.
+type AuditSummary struct {
+	Entries  uint64
+	LastHash string
+}
+
+// OpenAuditLog opens (or creates) the audit log at path, and verifies
+// it, so new entries extend an intact chain. If the last line is
+// incomplete, because the service crashed while writing it, it's
+// discarded. The policy says how often to sync the log to disk, as for
+// the Journal.
+func OpenAuditLog(path string, policy FsyncPolicy) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	head, err := os.OpenFile(path+".head", os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	log := &AuditLog{path: path, policy: policy, file: file, head: head}
+	summary, offset, err := verifyAudit(file, head, true)
+	if err != nil {
+		file.Close()
+		head.Close()
+		return nil, fmt.Errorf("audit log %s: %v", path, err)
+	}
+	if err = file.Truncate(offset); err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		head.Close()
+		return nil, err
+	}
+	log.seq = summary.Entries
+	log.last = summary.LastHash
+	if policy == FsyncInterval {
+		log.stop = make(chan struct{})
+		log.done = make(chan struct{})
+		go log.syncLoop()
+	}
+	return log, nil
+}
+
+// Path returns the path of the log file.
+func (log *AuditLog) Path() string {
+	return log.path
+}
+
+// Append adds entry to the log, filling in its Seq, Prev and Hash,
+// and its Time, if it doesn't have one. It returns the entry as
+// written.
+func (log *AuditLog) Append(entry AuditEntry) (AuditEntry, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if log.closed {
+		return entry, fmt.Errorf("audit log is closed")
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+	entry.Seq = log.seq + 1
+	entry.Prev = log.last
+	hash, err := entry.hash()
+	if err != nil {
+		return entry, err
+	}
+	entry.Hash = hash
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	if _, err = log.file.Write(append(data, '\n')); err != nil {
+		return entry, err
+	}
+	log.seq = entry.Seq
+	log.last = entry.Hash
+	log.dirty = true
+	if err = log.writeHead(); err != nil {
+		return entry, err
+	}
+	if log.policy == FsyncAlways {
+		return entry, log.sync()
+	}
+	return entry, nil
+}
+
+// Close syncs and closes the log. Entries appended after that are
+// lost.
+func (log *AuditLog) Close() error {
+	log.mutex.Lock()
+	if log.closed {
+		log.mutex.Unlock()
+		return nil
+	}
+	log.closed = true
+	log.mutex.Unlock()
+	if log.stop != nil {
+		close(log.stop)
+		<-log.done
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	err := log.sync()
+	for _, file := range []*os.File{log.file, log.head} {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// writeHead records the last entry in the head file. Caller must hold
+// the mutex.
+func (log *AuditLog) writeHead() error {
+	data, err := json.Marshal(auditHead{Seq: log.seq, Hash: log.last})
+	if err != nil {
+		return err
+	}
+	padded := make([]byte, auditHeadSize)
+	copy(padded, data)
+	for i := len(data); i < auditHeadSize-1; i++ {
+		padded[i] = ' '
+	}
+	padded[auditHeadSize-1] = '\n'
+	_, err = log.head.WriteAt(padded, 0)
+	return err
+}
+
+// sync flushes the log and its head to disk. Caller must hold the
+// mutex.
+func (log *AuditLog) sync() error {
+	if !log.dirty {
+		return nil
+	}
+	log.dirty = false
+	if err := log.file.Sync(); err != nil {
+		return err
+	}
+	return log.head.Sync()
+}
+
+func (log *AuditLog) syncLoop() {
+	defer close(log.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-log.stop:
+			return
+		case <-ticker.C:
+			log.mutex.Lock()
+			log.sync()
+			log.mutex.Unlock()
+		}
+	}
+}
+
+// VerifyAuditLog checks that every entry in the audit log at path
+// follows from the one before it, and that the log ends at the entry
+// its head file names, or one after, if the service crashed between
+// writing the two. It returns an error describing the first problem it
+// finds.
+func VerifyAuditLog(path string) (AuditSummary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return AuditSummary{}, err
+	}
+	defer file.Close()
+	var head io.Reader
+	headFile, err := os.Open(path + ".head")
+	if err == nil {
+		defer headFile.Close()
+		head = headFile
+	} else if !os.IsNotExist(err) {
+		return AuditSummary{}, err
+	}
+	summary, _, err := verifyAudit(file, head, false)
+	return summary, err
+}
+
+// ReadAuditLog calls fn with each entry in the audit log at path, in
+// order, until fn returns false. It doesn't verify the chain.
+func ReadAuditLog(path string, fn func(AuditEntry) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entry := AuditEntry{}
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("audit log %s is corrupt: %v", path, err)
+		}
+		if !fn(entry) {
+			return nil
+		}
+	}
+}
+
+// verifyAudit reads the log from file and checks its chain against
+// itself and against the head file, which may be nil if there isn't
+// one. If allowTorn is true, an incomplete last line isn't an error.
+// It returns the offset just past the last complete entry.
+func verifyAudit(file io.ReadSeeker, head io.Reader, allowTorn bool) (AuditSummary, int64, error) {
+	var expected *auditHead
+	if head != nil {
+		data, err := io.ReadAll(head)
+		if err != nil {
+			return AuditSummary{}, 0, err
+		}
+		if text := strings.TrimSpace(string(data)); text != "" {
+			expected = &auditHead{}
+			if err = json.Unmarshal([]byte(text), expected); err != nil {
+				return AuditSummary{}, 0, fmt.Errorf("head file is corrupt: %v", err)
+			}
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return AuditSummary{}, 0, err
+	}
+	summary := AuditSummary{}
+	headHash := ""
+	offset := int64(0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 && !allowTorn {
+				return summary, offset, fmt.Errorf("entry %d is incomplete", summary.Entries+1)
+			}
+			break
+		} else if err != nil {
+			return summary, offset, err
+		}
+		entry := AuditEntry{}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&entry); err != nil {
+			return summary, offset, fmt.Errorf("entry %d is corrupt: %v", summary.Entries+1, err)
+		}
+		if entry.Seq != summary.Entries+1 {
+			return summary, offset, fmt.Errorf("entry %d has seq %d, so entries are missing or out of order",
+				summary.Entries+1, entry.Seq)
+		}
+		if entry.Prev != summary.LastHash {
+			return summary, offset, fmt.Errorf("entry %d doesn't follow from entry %d", entry.Seq, summary.Entries)
+		}
+		hash, err := entry.hash()
+		if err != nil {
+			return summary, offset, err
+		}
+		if hash != entry.Hash {
+			return summary, offset, fmt.Errorf("entry %d has been altered", entry.Seq)
+		}
+		summary.Entries = entry.Seq
+		summary.LastHash = entry.Hash
+		if expected != nil && entry.Seq == expected.Seq {
+			headHash = entry.Hash
+		}
+		offset += int64(len(line))
+	}
+	switch {
+	case expected == nil && summary.Entries > 0:
+		return summary, offset, fmt.Errorf("head file is missing, so the log may have been truncated")
+	case expected == nil:
+	case expected.Seq > summary.Entries:
+		return summary, offset, fmt.Errorf("log ends at entry %d, but the head file says it should "+
+			"end at entry %d, so it has been truncated", summary.Entries, expected.Seq)
+	case expected.Seq+1 < summary.Entries:
+		return summary, offset, fmt.Errorf("log ends at entry %d, but the head file says it should "+
+			"end at entry %d", summary.Entries, expected.Seq)
+	case expected.Seq > 0 && headHash != expected.Hash:
+		return summary, offset, fmt.Errorf("entry %d doesn't match the head file", expected.Seq)
+	}
+	return summary, offset, nil
+}
+
+// UseAuditLog records every reserve, release, renewal, expiry and
+// settings change in log, from here on. Call this before changing the
+// service's settings, so those are recorded too, and before serving
+// requests. Close closes the log.
+func (service *VolumeService) UseAuditLog(log *AuditLog) {
+	service.auditLog = log
+}
+
+// audit appends entry to the audit log, if the service has one, with
+// the outcome of err.
+func (service *VolumeService) audit(entry AuditEntry, err error) {
+	if service.auditLog == nil {
+		return
+	}
+	entry.Outcome = AuditOK
+	if err != nil {
+		entry.Outcome = string(errorCode(err))
+		entry.Message = err.Error()
+	}
+	if _, err = service.auditLog.Append(entry); err != nil {
+		service.logger.Errorf("Cannot write to audit log %s: %v", service.auditLog.Path(), err)
+	}
+}
+
+// remoteAddr returns the address of the client that sent r. Requests
+// over a Unix socket have no address, so for those it returns the
+// peer's credentials, if there are any.
+func remoteAddr(r *http.Request) string {
+	if r.RemoteAddr != "" && r.RemoteAddr != "@" {
+		return r.RemoteAddr
+	}
+	if peer := peerCredFrom(r.Context()); peer != nil {
+		return "unix:" + peer.String()
+	}
+	return r.RemoteAddr
+}
+
+// auditReserve records a request from client at remote to reserve
+// bytes for path on volume, which was granted as reservation id unless
+// err says otherwise.
+func (service *VolumeService) auditReserve(client, remote string, volume *Volume, path string, bytes uint64, id string, err error) {
+	service.audit(AuditEntry{
+		Action:        AuditReserve,
+		Client:        client,
+		Remote:        remote,
+		Volume:        mountPointOf(volume),
+		Path:          path,
+		ReservationID: id,
+		Bytes:         bytes,
+	}, err)
+}
+
+// auditRelease records a request from client at remote to release the
+// reservation with the specified ID or, if id is empty, the
+// reservations for path. Volume is the volume they're on, or nil if
+// there's no such reservation, and released are the reservations it
+// released.
+func (service *VolumeService) auditRelease(client, remote string, volume *Volume, id, path string, released []Reservation, err error) {
+	if err != nil || len(released) == 0 {
+		service.audit(AuditEntry{
+			Action:        AuditRelease,
+			Client:        client,
+			Remote:        remote,
+			Volume:        mountPointOf(volume),
+			Path:          path,
+			ReservationID: id,
+		}, err)
+		return
+	}
+	for _, r := range released {
+		service.audit(AuditEntry{
+			Action:        AuditRelease,
+			Client:        client,
+			Remote:        remote,
+			Volume:        mountPointOf(volume),
+			Path:          r.Path,
+			ReservationID: r.ID,
+			Owner:         r.Client,
+			Bytes:         r.Bytes,
+		}, nil)
+	}
+}
+
+// auditReleased records that reservation r on volume left the ledger on
+// behalf of client for the specified reason, without a release request
+// of its own.
+func (service *VolumeService) auditReleased(client string, volume *Volume, r Reservation, reason string) {
+	service.audit(AuditEntry{
+		Action:        AuditRelease,
+		Client:        client,
+		Volume:        volume.MountPoint(),
+		Path:          r.Path,
+		ReservationID: r.ID,
+		Owner:         r.Client,
+		Bytes:         r.Bytes,
+		Message:       reason,
+	}, nil)
+}
+
+// auditRenew records a request from client at remote to renew the
+// lease on the reservation with the specified ID or, if id is empty,
+// the reservations for path. Volume is the volume they're on, or nil
+// if there's no such reservation.
+func (service *VolumeService) auditRenew(client, remote string, volume *Volume, id, path string, err error) {
+	entry := AuditEntry{
+		Action:        AuditRenew,
+		Client:        client,
+		Remote:        remote,
+		Volume:        mountPointOf(volume),
+		Path:          path,
+		ReservationID: id,
+	}
+	if id != "" && volume != nil {
+		if r, ok := volume.Reservation(id); ok {
+			entry.Path = r.Path
+		}
+	}
+	service.audit(entry, err)
+}
+
+// mountPointOf returns the mountpoint of volume, or "" if it's nil.
+func mountPointOf(volume *Volume) string {
+	if volume == nil {
+		return ""
+	}
+	return volume.MountPoint()
+}
+
+// auditConfig records a change to the service's settings.
+func (service *VolumeService) auditConfig(format string, args ...interface{}) {
+	service.audit(AuditEntry{Action: AuditConfig, Message: fmt.Sprintf(format, args...)}, nil)
+}
+
+// DefaultAuditLimit and MaxAuditLimit are the default and largest
+// number of entries the service returns for one audit query.
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 1000
+)
+
+// AuditQuery selects entries from the audit log. Zero values match
+// everything. From is inclusive and To exclusive. Path matches entries
+// for it and the paths under it, so /data/in matches /data/in/bag.tar
+// but not /data/ingest, and Volume matches entries on the volume
+// containing it. Entries come in order, starting after the one
+// whose Seq is After, up to Limit of them, which defaults to
+// DefaultAuditLimit and can't be more than MaxAuditLimit.
+type AuditQuery struct {
+	From    time.Time
+	To      time.Time
+	Client  string
+	Path    string
+	Volume  string
+	Actions []AuditAction
+	After   uint64
+	Limit   int
+}
+
+// AuditPage is one page of the results of an AuditQuery. If there are
+// more, Next is the After for the query that returns the next page.
+// Otherwise, it's zero.
+type AuditPage struct {
+	Entries []AuditEntry
+	Next    uint64
+}
+
+// values returns the query as URL params.
+func (query AuditQuery) values() url.Values {
+	params := url.Values{}
+	if !query.From.IsZero() {
+		params.Set("from", query.From.Format(time.RFC3339Nano))
+	}
+	if !query.To.IsZero() {
+		params.Set("to", query.To.Format(time.RFC3339Nano))
+	}
+	for name, value := range map[string]string{
+		"client": query.Client,
+		"path":   query.Path,
+		"volume": query.Volume,
+	} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	for _, action := range query.Actions {
+		params.Add("action", string(action))
+	}
+	if query.After > 0 {
+		params.Set("after", strconv.FormatUint(query.After, 10))
+	}
+	if query.Limit > 0 {
+		params.Set("limit", strconv.Itoa(query.Limit))
+	}
+	return params
+}
+
+// parseAuditQuery reads an AuditQuery from the params of r. Actions
+// may be repeated or separated by commas.
+func parseAuditQuery(r *http.Request) (AuditQuery, error) {
+	query := AuditQuery{
+		Client: r.FormValue("client"),
+		Path:   r.FormValue("path"),
+		Volume: r.FormValue("volume"),
+		Limit:  DefaultAuditLimit,
+	}
+	var err error
+	if value := r.FormValue("from"); value != "" {
+		if query.From, err = parseTimeParam("from", value); err != nil {
+			return query, err
+		}
+	}
+	if value := r.FormValue("to"); value != "" {
+		if query.To, err = parseTimeParam("to", value); err != nil {
+			return query, err
+		}
+	}
+	for _, value := range r.Form["action"] {
+		for _, action := range strings.Split(value, ",") {
+			switch AuditAction(action) {
+			case AuditReserve, AuditRelease, AuditRenew, AuditExpire, AuditConfig:
+				query.Actions = append(query.Actions, AuditAction(action))
+			default:
+				return query, paramError(fmt.Sprintf("Param 'action' has '%s', which should be "+
+					"reserve, release, renew, expire or config.", action))
+			}
+		}
+	}
+	if value := r.FormValue("after"); value != "" {
+		if query.After, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return query, paramError("Param 'after' must be an audit entry's seq.")
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		query.Limit, err = strconv.Atoi(value)
+		if err != nil || query.Limit < 1 || query.Limit > MaxAuditLimit {
+			return query, paramError(fmt.Sprintf(
+				"Param 'limit' must be an integer from 1 to %d.", MaxAuditLimit))
+		}
+	}
+	return query, nil
+}
+
+// matches reports whether entry is one the query selects, apart from
+// After and Limit. The query's Volume must be a mount point.
+func (query AuditQuery) matches(entry AuditEntry) bool {
+	if !query.From.IsZero() && entry.Time.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !entry.Time.Before(query.To) {
+		return false
+	}
+	if query.Client != "" && entry.Client != query.Client {
+		return false
+	}
+	if query.Path != "" && (entry.Path == "" || !pathIsUnder(filepath.Clean(entry.Path), query.Path)) {
+		return false
+	}
+	if query.Volume != "" && entry.Volume != query.Volume {
+		return false
+	}
+	if len(query.Actions) == 0 {
+		return true
+	}
+	for _, action := range query.Actions {
+		if entry.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryAudit returns the entries in the service's audit log that
+// query selects. It reads the whole log, so narrow queries on a large
+// log take as long as broad ones. It returns a notFoundError if the
+// service has no audit log.
+func (service *VolumeService) QueryAudit(query AuditQuery) (AuditPage, error) {
+	page := AuditPage{Entries: make([]AuditEntry, 0)}
+	if service.auditLog == nil {
+		return page, notFoundError("the service has no audit log")
+	}
+	if query.Path != "" {
+		query.Path = filepath.Clean(query.Path)
+	}
+	if query.Volume != "" {
+		query.Volume = service.getVolume(query.Volume).MountPoint()
+	}
+	if query.Limit < 1 || query.Limit > MaxAuditLimit {
+		query.Limit = DefaultAuditLimit
+	}
+	err := ReadAuditLog(service.auditLog.Path(), func(entry AuditEntry) bool {
+		if entry.Seq <= query.After || !query.matches(entry) {
+			return true
+		}
+		if len(page.Entries) == query.Limit {
+			page.Next = page.Entries[len(page.Entries)-1].Seq
+			return false
+		}
+		page.Entries = append(page.Entries, entry)
+		return true
+	})
+	return page, err
+}
+
+// makeAuditHandler returns the handler for /audit/, which returns the
+// audit log entries selected by the AuditQuery in its params, with the
+// next page's "after" in Data["next"].
+func (service *VolumeService) makeAuditHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := &VolumeResponse{}
+		query, err := parseAuditQuery(r)
+		if err == nil {
+			var page AuditPage
+			page, err = service.QueryAudit(query)
+			response.AuditEntries = page.Entries
+			response.Data = map[string]uint64{"next": page.Next}
+		}
+		if err != nil {
+			response.Succeeded = false
+			response.ErrorMessage = err.Error()
+			response.ErrorCode = errorCode(err)
+			service.logger.Warningf("[%s] Could not query audit log: %v", clientName(r), err)
+		} else {
+			response.Succeeded = true
+			service.logger.Infof("[%s] Audit query returned %d entries", clientName(r),
+				len(response.AuditEntries))
+		}
+		writeResponse(w, response)
+	}
+}
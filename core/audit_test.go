@@ -0,0 +1,362 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAudit returns the entries in the audit log at path.
+func readAudit(t *testing.T, path string) []core.AuditEntry {
+	entries := make([]core.AuditEntry, 0)
+	require.Nil(t, core.ReadAuditLog(path, func(entry core.AuditEntry) bool {
+		entries = append(entries, entry)
+		return true
+	}))
+	return entries
+}
+
+// writeAuditLog writes an audit log with n config entries at path.
+func writeAuditLog(t *testing.T, path string, n int) {
+	log, err := core.OpenAuditLog(path, core.FsyncNever)
+	require.Nil(t, err)
+	for i := 0; i < n; i++ {
+		_, err = log.Append(core.AuditEntry{Action: core.AuditConfig, Outcome: core.AuditOK})
+		require.Nil(t, err)
+	}
+	require.Nil(t, log.Close())
+}
+
+func TestAuditLog(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	log, err := core.OpenAuditLog(auditFile, core.FsyncAlways)
+	require.Nil(t, err)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	service.UseAuditLog(log)
+	require.Nil(t, service.SetQuotas([]core.Quota{{Client: "ingest", Bytes: 500}}))
+	now := time.Now()
+	service.SetClock(func() time.Time { return now })
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := core.NewVolumeClient(server.URL, core.WithClientName("ingest"))
+	path := filepath.Join(os.TempDir(), "audit_file")
+
+	id, err := client.AddReservation(path, 100, time.Minute)
+	require.Nil(t, err)
+	_, err = client.AddReservation(path, 1000, 0)
+	require.NotNil(t, err)
+	require.Nil(t, client.RenewID(id))
+	require.Nil(t, client.ReleaseID(id))
+	_, err = client.AddReservation(path, 200, time.Minute)
+	require.Nil(t, err)
+	now = now.Add(2 * time.Minute)
+	service.ReapExpired()
+	require.Nil(t, service.Close())
+
+	entries := readAudit(t, auditFile)
+	require.Len(t, entries, 7)
+	actions := make([]core.AuditAction, len(entries))
+	for i, entry := range entries {
+		actions[i] = entry.Action
+		assert.EqualValues(t, i+1, entry.Seq)
+		assert.False(t, entry.Time.IsZero())
+	}
+	assert.Equal(t, []core.AuditAction{core.AuditConfig, core.AuditReserve, core.AuditReserve,
+		core.AuditRenew, core.AuditRelease, core.AuditReserve, core.AuditExpire}, actions)
+
+	assert.Equal(t, "set 1 quotas", entries[0].Message)
+	granted := entries[1]
+	assert.Equal(t, core.AuditOK, granted.Outcome)
+	assert.Equal(t, "ingest", granted.Client)
+	assert.NotEmpty(t, granted.Remote)
+	assert.NotEmpty(t, granted.Volume)
+	assert.Equal(t, path, granted.Path)
+	assert.Equal(t, id, granted.ReservationID)
+	assert.EqualValues(t, 100, granted.Bytes)
+	assert.Equal(t, string(core.CodeQuotaExceeded), entries[2].Outcome)
+	assert.NotEmpty(t, entries[2].Message)
+	assert.Equal(t, id, entries[3].ReservationID)
+	assert.Equal(t, path, entries[3].Path)
+	assert.Equal(t, "ingest", entries[4].Owner)
+	assert.EqualValues(t, 100, entries[4].Bytes)
+	assert.Equal(t, "ingest", entries[6].Client)
+	assert.EqualValues(t, 200, entries[6].Bytes)
+
+	summary, err := core.VerifyAuditLog(auditFile)
+	require.Nil(t, err)
+	assert.EqualValues(t, 7, summary.Entries)
+	assert.Equal(t, entries[6].Hash, summary.LastHash)
+
+	// Reopening the log continues the chain.
+	log, err = core.OpenAuditLog(auditFile, core.FsyncNever)
+	require.Nil(t, err)
+	entry, err := log.Append(core.AuditEntry{Action: core.AuditConfig})
+	require.Nil(t, err)
+	assert.EqualValues(t, 8, entry.Seq)
+	assert.Equal(t, summary.LastHash, entry.Prev)
+	require.Nil(t, log.Close())
+	summary, err = core.VerifyAuditLog(auditFile)
+	require.Nil(t, err)
+	assert.EqualValues(t, 8, summary.Entries)
+}
+
+func TestAuditReplace(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	log, err := core.OpenAuditLog(auditFile, core.FsyncNever)
+	require.Nil(t, err)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	service.UseAuditLog(log)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	ingest := core.NewVolumeClient(server.URL, core.WithClientName("ingest"))
+	restore := core.NewVolumeClient(server.URL, core.WithClientName("restore"))
+	dir := os.TempDir()
+	path := filepath.Join(dir, "audit_replace_file")
+
+	// Replacing a reservation releases it.
+	first, err := ingest.AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	_, err = restore.Reserve(path, 50)
+	require.Nil(t, err)
+
+	// So does a queued request that replaces it when it's granted.
+	second, err := ingest.AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	hog, err := ingest.AddReservation(filepath.Join(dir, "audit_replace_hog"), 9700, 0)
+	require.Nil(t, err)
+	waited := make(chan error, 1)
+	go func() {
+		_, _, err := restore.ReserveWait(context.Background(), path, 300)
+		waited <- err
+	}()
+	waitForQueueLength(t, service, dir, 1)
+	require.Nil(t, ingest.ReleaseID(hog))
+	require.Nil(t, <-waited)
+	require.Nil(t, service.Close())
+
+	// The queued request replaces restore's reservation along with
+	// ingest's second one, in no particular order.
+	replaced := make(map[string]core.AuditEntry)
+	for _, entry := range readAudit(t, auditFile) {
+		if entry.Action == core.AuditRelease && entry.ReservationID != hog {
+			replaced[entry.ReservationID] = entry
+		}
+	}
+	require.Len(t, replaced, 3)
+	assert.Equal(t, "restore", replaced[first].Client)
+	assert.Equal(t, "ingest", replaced[first].Owner)
+	assert.EqualValues(t, 100, replaced[first].Bytes)
+	assert.Equal(t, path, replaced[first].Path)
+	assert.NotEmpty(t, replaced[first].Volume)
+	assert.Equal(t, "restore", replaced[second].Client)
+	assert.Equal(t, "ingest", replaced[second].Owner)
+	assert.EqualValues(t, 100, replaced[second].Bytes)
+	delete(replaced, first)
+	delete(replaced, second)
+	for _, entry := range replaced {
+		assert.Equal(t, "restore", entry.Owner)
+		assert.EqualValues(t, 50, entry.Bytes)
+	}
+}
+
+func TestAuditMountTableReads(t *testing.T) {
+	log, err := core.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), core.FsyncNever)
+	require.Nil(t, err)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	service.UseAuditLog(log)
+	defer service.Close()
+	var reads atomic.Int32
+	service.SetMountTableReader(func() (core.MountTable, error) {
+		reads.Add(1)
+		return core.ReadMountTable()
+	})
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := core.NewVolumeClient(server.URL)
+	path := filepath.Join(os.TempDir(), "audit_reads_file")
+	for i := 0; i < 3; i++ {
+		_, err = client.AddReservation(path, 100, 0)
+		require.Nil(t, err)
+	}
+
+	// Auditing the release of all three reservations doesn't look up
+	// their volume again.
+	reads.Store(0)
+	require.Nil(t, client.Release(path))
+	assert.EqualValues(t, 1, reads.Load())
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	tamper := func(name string, change func(lines [][]byte) [][]byte) string {
+		path := filepath.Join(dir, name)
+		writeAuditLog(t, path, 4)
+		data, err := os.ReadFile(path)
+		require.Nil(t, err)
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		require.Nil(t, os.WriteFile(path, bytes.Join(change(lines[:4]), nil), 0640))
+		_, err = core.VerifyAuditLog(path)
+		require.NotNil(t, err)
+		return err.Error()
+	}
+
+	message := tamper("altered", func(lines [][]byte) [][]byte {
+		lines[1] = bytes.Replace(lines[1], []byte(`"outcome":"ok"`), []byte(`"outcome":"no"`), 1)
+		return lines
+	})
+	assert.Contains(t, message, "entry 2 has been altered")
+	message = tamper("removed", func(lines [][]byte) [][]byte {
+		return append(lines[:1], lines[2:]...)
+	})
+	assert.Contains(t, message, "missing or out of order")
+	message = tamper("reordered", func(lines [][]byte) [][]byte {
+		lines[1], lines[2] = lines[2], lines[1]
+		return lines
+	})
+	assert.Contains(t, message, "missing or out of order")
+	message = tamper("truncated", func(lines [][]byte) [][]byte {
+		return lines[:2]
+	})
+	assert.Contains(t, message, "truncated")
+
+	// Deleting the head file to hide a truncation doesn't work.
+	path := filepath.Join(dir, "headless")
+	writeAuditLog(t, path, 2)
+	require.Nil(t, os.Remove(path+".head"))
+	_, err := core.VerifyAuditLog(path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "head file is missing")
+
+	// A crash while writing an entry leaves it incomplete. Verify
+	// reports it, and OpenAuditLog discards it, but OpenAuditLog
+	// refuses a log that's been tampered with.
+	path = filepath.Join(dir, "crashed")
+	writeAuditLog(t, path, 3)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+	require.Nil(t, err)
+	_, err = file.WriteString(`{"seq":4,"ti`)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	_, err = core.VerifyAuditLog(path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "entry 4 is incomplete")
+	log, err := core.OpenAuditLog(path, core.FsyncNever)
+	require.Nil(t, err)
+	entry, err := log.Append(core.AuditEntry{Action: core.AuditConfig})
+	require.Nil(t, err)
+	assert.EqualValues(t, 4, entry.Seq)
+	require.Nil(t, log.Close())
+	summary, err := core.VerifyAuditLog(path)
+	require.Nil(t, err)
+	assert.EqualValues(t, 4, summary.Entries)
+	_, err = core.OpenAuditLog(filepath.Join(dir, "altered"), core.FsyncNever)
+	assert.NotNil(t, err)
+
+	path = filepath.Join(dir, "empty")
+	writeAuditLog(t, path, 0)
+	summary, err = core.VerifyAuditLog(path)
+	require.Nil(t, err)
+	assert.Zero(t, summary.Entries)
+}
+
+func TestAuditQuery(t *testing.T) {
+	log, err := core.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"), core.FsyncNever)
+	require.Nil(t, err)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	service.UseAuditLog(log)
+	defer service.Close()
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	dir := filepath.Join(os.TempDir(), "audit_query")
+	for i, name := range []string{"ingest", "restore", "ingest", "restore", "ingest"} {
+		client := core.NewVolumeClient(server.URL, core.WithClientName(name))
+		_, err = client.AddReservation(filepath.Join(dir, name, strconv.Itoa(i)), 10, 0)
+		require.Nil(t, err)
+	}
+	admin := core.NewVolumeClient(server.URL, core.WithClientName("admin"))
+	require.Nil(t, admin.Release(filepath.Join(dir, "ingest", "0")))
+
+	page, err := admin.Audit(core.AuditQuery{})
+	require.Nil(t, err)
+	assert.Len(t, page.Entries, 6)
+	assert.Zero(t, page.Next)
+
+	page, err = admin.Audit(core.AuditQuery{Client: "ingest"})
+	require.Nil(t, err)
+	assert.Len(t, page.Entries, 3)
+	page, err = admin.Audit(core.AuditQuery{Path: filepath.Join(dir, "restore")})
+	require.Nil(t, err)
+	assert.Len(t, page.Entries, 2)
+	page, err = admin.Audit(core.AuditQuery{Path: filepath.Join(dir, "restore") + "/"})
+	require.Nil(t, err)
+	assert.Len(t, page.Entries, 2)
+	// Paths match by component, not by string prefix.
+	page, err = admin.Audit(core.AuditQuery{Path: filepath.Join(dir, "rest")})
+	require.Nil(t, err)
+	assert.Empty(t, page.Entries)
+	page, err = admin.Audit(core.AuditQuery{Actions: []core.AuditAction{core.AuditRelease}})
+	require.Nil(t, err)
+	require.Len(t, page.Entries, 1)
+	assert.Equal(t, "admin", page.Entries[0].Client)
+	assert.Equal(t, "ingest", page.Entries[0].Owner)
+	page, err = admin.Audit(core.AuditQuery{Volume: dir})
+	require.Nil(t, err)
+	assert.Len(t, page.Entries, 6)
+	page, err = admin.Audit(core.AuditQuery{From: time.Now().Add(time.Hour)})
+	require.Nil(t, err)
+	assert.Empty(t, page.Entries)
+	page, err = admin.Audit(core.AuditQuery{To: time.Now().Add(time.Hour)})
+	require.Nil(t, err)
+	assert.Len(t, page.Entries, 6)
+
+	// Pages pick up where the last one left off.
+	seqs := make([]uint64, 0)
+	query := core.AuditQuery{Limit: 4}
+	for {
+		page, err = admin.Audit(query)
+		require.Nil(t, err)
+		for _, entry := range page.Entries {
+			seqs = append(seqs, entry.Seq)
+		}
+		if page.Next == 0 {
+			break
+		}
+		query.After = page.Next
+	}
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, seqs)
+
+	_, err = admin.Audit(core.AuditQuery{Actions: []core.AuditAction{"delete"}})
+	assert.True(t, errors.Is(err, core.ErrInvalidParam), "got %v", err)
+	_, err = admin.Audit(core.AuditQuery{Limit: core.MaxAuditLimit + 1})
+	assert.True(t, errors.Is(err, core.ErrInvalidParam), "got %v", err)
+
+	// Only admins may read the log.
+	require.Nil(t, service.SetTokens([]core.Token{
+		{Name: "admin", Token: "admin-secret", Role: core.RoleAdmin},
+		{Name: "ingest", Token: "ingest-secret", Role: core.RoleReserver},
+	}))
+	_, err = core.NewVolumeClient(server.URL, core.WithToken("ingest-secret")).Audit(core.AuditQuery{})
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	page, err = core.NewVolumeClient(server.URL, core.WithToken("admin-secret")).Audit(
+		core.AuditQuery{Actions: []core.AuditAction{core.AuditConfig}})
+	require.Nil(t, err)
+	assert.Len(t, page.Entries, 1)
+
+	// Without an audit log, there's nothing to query.
+	other := httptest.NewServer(core.NewVolumeService(host, port, core.DiscardLogger(),
+		core.NewFakeStatProvider(10000)).Handler())
+	defer other.Close()
+	_, err = core.NewVolumeClient(other.URL).Audit(core.AuditQuery{})
+	assert.True(t, errors.Is(err, core.ErrNotFound), "got %v", err)
+}
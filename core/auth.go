@@ -0,0 +1,296 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Role says what a token lets its holder do. Each role may do
+// everything the roles before it may.
+type Role string
+
+const (
+	// RoleReader may read reservations, volumes, events and metrics.
+	RoleReader Role = "reader"
+	// RoleReserver may also reserve space, renew leases, and release
+	// its own reservations.
+	RoleReserver Role = "reserver"
+	// RoleAdmin may also release anyone's reservations and read the
+	// audit log.
+	RoleAdmin Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleReader:   1,
+	RoleReserver: 2,
+	RoleAdmin:    3,
+}
+
+// allows reports whether role may do what required may.
+func (role Role) allows(required Role) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// Token is a secret that clients send as a bearer token in the
+// Authorization header. When the service has tokens, the Name of the
+// client's token identifies it, for quotas and for ownership of its
+// reservations, in place of the ClientHeader.
+type Token struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  Role   `json:"role"`
+}
+
+// tokenTable maps the SHA-256 hash of each token's secret to the
+// token, so looking up a secret doesn't leak it through timing.
+type tokenTable map[[sha256.Size]byte]Token
+
+// newTokenTable validates tokens and returns them as a tokenTable.
+func newTokenTable(tokens []Token) (tokenTable, error) {
+	table := make(tokenTable)
+	for _, token := range tokens {
+		if token.Name == "" {
+			return nil, fmt.Errorf("every token must have a name")
+		}
+		if token.Name == AnyClient {
+			return nil, fmt.Errorf("no token may be named '%s', which ACL rules use for any client", AnyClient)
+		}
+		if strings.HasPrefix(token.Name, uidPrefix) {
+			return nil, fmt.Errorf("token '%s' can't be named for a Unix socket client: "+
+				"names starting with '%s' are reserved for those", token.Name, uidPrefix)
+		}
+		if token.Token == "" {
+			return nil, fmt.Errorf("token '%s' has no secret", token.Name)
+		}
+		if roleRanks[token.Role] == 0 {
+			return nil, fmt.Errorf("token '%s' has role '%s', which should be reader, reserver or admin",
+				token.Name, token.Role)
+		}
+		key := sha256.Sum256([]byte(token.Token))
+		if other, ok := table[key]; ok {
+			return nil, fmt.Errorf("tokens '%s' and '%s' have the same secret", other.Name, token.Name)
+		}
+		table[key] = token
+	}
+	return table, nil
+}
+
+// SetTokens replaces the service's tokens. Once the service has
+// tokens, every request except a ping must carry one with a role that
+// allows it, and only a reservation's owner or an admin may release
+// it. Pass nil to let anyone do anything.
+func (service *VolumeService) SetTokens(tokens []Token) error {
+	table, err := newTokenTable(tokens)
+	if err != nil {
+		return err
+	}
+	service.authMutex.Lock()
+	defer service.authMutex.Unlock()
+	service.tokens = table
+	service.auditConfig("set %d tokens", len(tokens))
+	return nil
+}
+
+// tokenKey is the context key for the token the client authenticated
+// with.
+type tokenKey struct{}
+
+// callerToken returns the token the client authenticated with, or nil
+// if it didn't.
+func callerToken(ctx context.Context) *Token {
+	token, _ := ctx.Value(tokenKey{}).(*Token)
+	return token
+}
+
+// authenticate returns ctx with the token whose secret is secret. If
+// the service has no tokens, or secret is empty, it returns ctx as is,
+// and leaves authorize to decide whether that's acceptable.
+func (service *VolumeService) authenticate(ctx context.Context, secret string) (context.Context, error) {
+	service.authMutex.RLock()
+	tokens := service.tokens
+	service.authMutex.RUnlock()
+	if len(tokens) == 0 || secret == "" {
+		return ctx, nil
+	}
+	token, ok := tokens[sha256.Sum256([]byte(secret))]
+	if !ok {
+		return ctx, unauthorizedError("invalid token")
+	}
+	return context.WithValue(ctx, tokenKey{}, &token), nil
+}
+
+// authorize returns an error unless the service has no tokens, or the
+// client authenticated with a token whose role allows role.
+func (service *VolumeService) authorize(ctx context.Context, role Role) error {
+	service.authMutex.RLock()
+	required := len(service.tokens) > 0
+	service.authMutex.RUnlock()
+	if !required {
+		return nil
+	}
+	token := callerToken(ctx)
+	if token == nil {
+		return unauthorizedError("a token is required")
+	}
+	if !token.Role.allows(role) {
+		return forbiddenError(fmt.Sprintf("token '%s' has role %s, but this requires %s",
+			token.Name, token.Role, role))
+	}
+	return nil
+}
+
+// bearerToken returns the secret in an Authorization header, or ""
+// if it doesn't have one.
+func bearerToken(authorization string) string {
+	const prefix = "bearer "
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len(prefix):])
+}
+
+// authorizeRequest authenticates the client that sent r, and checks
+// that it may do what role may. It returns r with the client's token
+// in its context.
+func (service *VolumeService) authorizeRequest(r *http.Request, role Role) (*http.Request, error) {
+	ctx, err := service.authenticate(r.Context(), bearerToken(r.Header.Get("Authorization")))
+	if err == nil {
+		err = service.authorize(ctx, role)
+	}
+	if err != nil {
+		service.logger.Warningf("[%s] Denied %s %s: %v", r.RemoteAddr, r.Method, r.URL.Path, err)
+		return r, err
+	}
+	return r.WithContext(ctx), nil
+}
+
+// authorized wraps handler so it serves only clients whose tokens allow
+// role.
+func (service *VolumeService) authorized(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, err := service.authorizeRequest(r, role)
+		if err != nil {
+			setAuthenticateHeader(w, err)
+			writeResponse(w, &VolumeResponse{
+				ErrorMessage: err.Error(),
+				ErrorCode:    errorCode(err),
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// setAuthenticateHeader tells the client how to authenticate, if err
+// says it has to.
+func setAuthenticateHeader(w http.ResponseWriter, err error) {
+	if errorCode(err) == CodeUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="vreserve"`)
+	}
+}
+
+// releaseAs releases the reservation with the specified ID or, if id
+// is empty, every reservation for path, on behalf of client, which
+// authenticated in ctx, and returns the volume they're on, or nil if
+// there's no reservation with the ID, and the reservations it
+// released. Clients other than admins may release only their own
+// reservations, and only where the ACL allows. If the service has no
+// tokens and no ACL, anyone may release anything.
+func (service *VolumeService) releaseAs(ctx context.Context, client, id, path string) (*Volume, []Reservation, error) {
+	caller := callerToken(ctx)
+	if id != "" {
+		service.ledgerMutex.Lock()
+		defer service.ledgerMutex.Unlock()
+		volume, r, ok := service.findReservation(id)
+		if !ok {
+			return nil, nil, notFoundError(fmt.Sprintf("no reservation has ID '%s'", id))
+		}
+		if err := service.checkACL(client, OpRelease, r.Path); err != nil {
+			return volume, nil, err
+		}
+		if err := checkOwner(caller, r, "release"); err != nil {
+			return volume, nil, err
+		}
+		service.releaseID(volume, id, EventRelease)
+		return volume, []Reservation{r}, nil
+	}
+	volume := service.getVolume(path)
+	if err := service.checkACL(client, OpRelease, path); err != nil {
+		return volume, nil, err
+	}
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	released := volume.reservationsAt(path)
+	for _, r := range released {
+		if err := checkOwner(caller, r, "release"); err != nil {
+			return volume, nil, err
+		}
+	}
+	service.release(volume, path)
+	return volume, released, nil
+}
+
+// renewAs renews the lease on the reservation with the specified ID
+// or, if id is empty, on every leased reservation for path, on behalf
+// of client, which authenticated in ctx. The same rules apply as for
+// releaseAs, except that the ACL must allow client to reserve the
+// path, since renewing keeps the space reserved. Like releaseAs, it
+// returns the volume the reservations are on.
+func (service *VolumeService) renewAs(ctx context.Context, client, id, path string, leaseDuration time.Duration) (*Volume, error) {
+	caller := callerToken(ctx)
+	if id != "" {
+		service.ledgerMutex.Lock()
+		defer service.ledgerMutex.Unlock()
+		volume, r, ok := service.findReservation(id)
+		if !ok {
+			return nil, notFoundError(fmt.Sprintf("no reservation has ID '%s'", id))
+		}
+		if err := service.checkACL(client, OpReserve, r.Path); err != nil {
+			return volume, err
+		}
+		if err := checkOwner(caller, r, "renew"); err != nil {
+			return volume, err
+		}
+		return volume, service.renewID(volume, r, leaseDuration)
+	}
+	volume := service.getVolume(path)
+	if err := service.checkACL(client, OpReserve, path); err != nil {
+		return volume, err
+	}
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	for _, r := range volume.reservationsAt(path) {
+		if r.Expires == nil {
+			continue
+		}
+		if err := checkOwner(caller, r, "renew"); err != nil {
+			return volume, err
+		}
+	}
+	return volume, service.renew(volume, path, leaseDuration)
+}
+
+// checkReplace returns an error unless caller may replace every
+// reservation for path on volume. Caller must hold the ledgerMutex.
+func checkReplace(caller *Token, volume *Volume, path string) error {
+	for _, r := range volume.reservationsAt(path) {
+		if err := checkOwner(caller, r, "replace"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOwner returns an error unless caller may perform action, such
+// as release or renew, on r.
+func checkOwner(caller *Token, r Reservation, action string) error {
+	if caller == nil || caller.Role == RoleAdmin || caller.Name == r.Client {
+		return nil
+	}
+	return forbiddenError(fmt.Sprintf("reservation %s for '%s' belongs to '%s', "+
+		"and only its owner or an admin may %s it", r.ID, r.Path, r.Client, action))
+}
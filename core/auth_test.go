@@ -0,0 +1,298 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/diamondap/vreserve/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+var testTokens = []core.Token{
+	{Name: "dashboard", Token: "reader-secret", Role: core.RoleReader},
+	{Name: "ingest", Token: "ingest-secret", Role: core.RoleReserver},
+	{Name: "restore", Token: "restore-secret", Role: core.RoleReserver},
+	{Name: "ops", Token: "admin-secret", Role: core.RoleAdmin},
+}
+
+// newTokenService returns a service that requires testTokens.
+func newTokenService(t *testing.T) *core.VolumeService {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	require.Nil(t, service.SetTokens(testTokens))
+	return service
+}
+
+func TestTokens(t *testing.T) {
+	service := newTokenService(t)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := func(token string) *core.VolumeClient {
+		return core.NewVolumeClient(server.URL, core.WithToken(token), core.WithClientName("spoof"))
+	}
+	path := filepath.Join(os.TempDir(), "token_file")
+
+	// Anyone can ping.
+	assert.Nil(t, client("").Ping(1000))
+
+	_, err := client("").AddReservation(path, 100, 0)
+	assert.True(t, errors.Is(err, core.ErrUnauthorized), "got %v", err)
+	var serviceErr *core.ServiceError
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, http.StatusUnauthorized, serviceErr.StatusCode)
+	_, err = client("wrong-secret").Reservations(path)
+	assert.True(t, errors.Is(err, core.ErrUnauthorized), "got %v", err)
+
+	// Readers can look, but not touch.
+	_, err = client("reader-secret").Reservations(path)
+	assert.Nil(t, err)
+	_, err = client("reader-secret").AddReservation(path, 100, 0)
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+
+	// The token, not the header, says who the client is.
+	id, err := client("ingest-secret").AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	reservations := service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, "ingest", reservations[0].Client)
+
+	// Only the owner or an admin may release a reservation.
+	err = client("restore-secret").ReleaseID(id)
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	err = client("restore-secret").Release(path)
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	assert.Len(t, service.ReservationList(path), 1)
+	assert.Nil(t, client("ingest-secret").ReleaseID(id))
+	_, err = client("ingest-secret").AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	assert.Nil(t, client("admin-secret").Release(path))
+	assert.Empty(t, service.ReservationList(path))
+
+	// The same goes for renewing a lease, so no one can keep another
+	// client's space from expiring.
+	id, err = client("ingest-secret").AddReservation(path, 100, time.Minute)
+	require.Nil(t, err)
+	err = client("restore-secret").RenewID(id)
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	err = client("restore-secret").Renew(path)
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	assert.Nil(t, client("ingest-secret").RenewID(id))
+	assert.Nil(t, client("admin-secret").Renew(path))
+}
+
+func TestTokensReplace(t *testing.T) {
+	service := newTokenService(t)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := func(token string) *core.VolumeClient {
+		return core.NewVolumeClient(server.URL, core.WithToken(token))
+	}
+	path := filepath.Join(os.TempDir(), "token_replace_file")
+	id, err := client("ingest-secret").AddReservation(path, 100, 0)
+	require.Nil(t, err)
+
+	// A v1 reserve replaces the reservations for the path, which
+	// releases them, so only their owner or an admin may do it.
+	_, err = client("restore-secret").Reserve(path, 1)
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = client("restore-secret").ReserveWait(ctx, path, 1)
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	reservations := service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, id, reservations[0].ID)
+
+	_, err = client("ingest-secret").Reserve(path, 200)
+	require.Nil(t, err)
+	reservations = service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, "ingest", reservations[0].Client)
+	assert.Equal(t, uint64(200), reservations[0].Bytes)
+
+	_, err = client("admin-secret").Reserve(path, 300)
+	require.Nil(t, err)
+	reservations = service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, "ops", reservations[0].Client)
+}
+
+func TestTokensReplaceQueued(t *testing.T) {
+	service := newTokenService(t)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := func(token string) *core.VolumeClient {
+		return core.NewVolumeClient(server.URL, core.WithToken(token))
+	}
+	dir := os.TempDir()
+	path := filepath.Join(dir, "token_replace_queued_file")
+	hog, err := client("admin-secret").AddReservation(filepath.Join(dir, "token_hog"), 9950, 0)
+	require.Nil(t, err)
+
+	// Ingest waits to add a reservation for the path, then restore
+	// waits to replace the reservations for it. There are none yet, so
+	// restore gets in line, but by the time it reaches the front,
+	// ingest's reservation is there, and restore doesn't own it.
+	ingest := make(chan error, 1)
+	go func() {
+		params := url.Values{"path": {path}, "bytes": {"100"}, "add": {"true"}, "wait": {"5s"}}
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/reserve/",
+			strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer ingest-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		ingest <- err
+	}()
+	waitForQueueLength(t, service, dir, 1)
+	restore := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _, err := client("restore-secret").ReserveWait(ctx, path, 100)
+		restore <- err
+	}()
+	waitForQueueLength(t, service, dir, 2)
+
+	require.Nil(t, client("admin-secret").ReleaseID(hog))
+	require.Nil(t, <-ingest)
+	err = <-restore
+	assert.True(t, errors.Is(err, core.ErrForbidden), "got %v", err)
+	reservations := service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, "ingest", reservations[0].Client)
+	assert.Equal(t, 0, service.QueueLength(dir))
+}
+
+func TestTokensV2(t *testing.T) {
+	service := newTokenService(t)
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	path := filepath.Join(os.TempDir(), "token_v2_file")
+	id, err := service.AddReservation("ingest", path, 100, time.Minute)
+	require.Nil(t, err)
+
+	request := func(method, url, token string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+url, strings.NewReader(""))
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := request(http.MethodGet, "/v2/volumes", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Bearer realm="vreserve"`, resp.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/v2/volumes", "reader-secret").StatusCode)
+	assert.Equal(t, http.StatusForbidden,
+		request(http.MethodDelete, "/v2/reservations/"+id, "reader-secret").StatusCode)
+	assert.Equal(t, http.StatusForbidden,
+		request(http.MethodDelete, "/v2/reservations/"+id, "restore-secret").StatusCode)
+	assert.Equal(t, http.StatusForbidden,
+		request(http.MethodPost, "/v2/reservations/"+id+"/renew", "restore-secret").StatusCode)
+	assert.Equal(t, http.StatusOK,
+		request(http.MethodPost, "/v2/reservations/"+id+"/renew", "ingest-secret").StatusCode)
+	assert.Equal(t, http.StatusNoContent,
+		request(http.MethodDelete, "/v2/reservations/"+id, "ingest-secret").StatusCode)
+
+	// Events and metrics need a token, too.
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/metrics", "").StatusCode)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/metrics", "reader-secret").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/events/", "").StatusCode)
+}
+
+func TestTokensGRPC(t *testing.T) {
+	service := newTokenService(t)
+	client := newGRPCClient(t, service)
+	path := filepath.Join(os.TempDir(), "token_grpc_file")
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+
+	_, err := client.Ping(context.Background(), &rpc.PingRequest{})
+	assert.Nil(t, err)
+	_, err = client.Reserve(context.Background(), &rpc.ReserveRequest{Path: path, Bytes: 100})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	code, _ := core.RPCErrorCode(err)
+	assert.Equal(t, core.CodeUnauthorized, code)
+	_, err = client.Reserve(withToken("reader-secret"), &rpc.ReserveRequest{Path: path, Bytes: 100})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	resp, err := client.Reserve(withToken("ingest-secret"), &rpc.ReserveRequest{
+		Path:  path,
+		Bytes: 100,
+		Lease: durationpb.New(time.Minute),
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "ingest", resp.Reservation.Client)
+	renew := &rpc.RenewRequest{Target: &rpc.RenewRequest_Id{Id: resp.Reservation.Id}}
+	_, err = client.Renew(withToken("restore-secret"), renew)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Renew(withToken("ingest-secret"), renew)
+	assert.Nil(t, err)
+	target := &rpc.ReleaseRequest_Id{Id: resp.Reservation.Id}
+	_, err = client.Release(withToken("restore-secret"), &rpc.ReleaseRequest{Target: target})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	code, _ = core.RPCErrorCode(err)
+	assert.Equal(t, core.CodeForbidden, code)
+	_, err = client.Release(withToken("admin-secret"), &rpc.ReleaseRequest{Target: target})
+	assert.Nil(t, err)
+
+	stream, err := client.Watch(context.Background(), &rpc.WatchRequest{})
+	require.Nil(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestTokensLineProtocol(t *testing.T) {
+	service := newTokenService(t)
+	addr := serveLines(t, service, false)
+	path := filepath.Join(os.TempDir(), "token_line_file")
+
+	owner := dialLines(t, addr)
+	assert.Equal(t, "OK", owner.send(t, "PING"))
+	assert.True(t, strings.HasPrefix(owner.send(t, "RESERVE "+path+" 100"), "ERR UNAUTHORIZED "))
+	assert.True(t, strings.HasPrefix(owner.send(t, "AUTH wrong-secret"), "ERR UNAUTHORIZED "))
+	assert.Equal(t, "OK", owner.send(t, "AUTH ingest-secret"))
+	assert.True(t, strings.HasPrefix(owner.send(t, "RESERVE "+path+" 100"), "OK "))
+	assert.Equal(t, "ingest", service.ReservationList(path)[0].Client)
+
+	other := dialLines(t, addr)
+	assert.Equal(t, "OK", other.send(t, "AUTH restore-secret"))
+	assert.True(t, strings.HasPrefix(other.send(t, "RELEASE "+path), "ERR FORBIDDEN "))
+	assert.Equal(t, "OK", owner.send(t, "RELEASE "+path))
+	assert.Empty(t, service.ReservationList(path))
+}
+
+func TestSetTokens(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	assert.NotNil(t, service.SetTokens([]core.Token{{Token: "secret", Role: core.RoleReader}}))
+	assert.NotNil(t, service.SetTokens([]core.Token{{Name: "a", Role: core.RoleReader}}))
+	assert.NotNil(t, service.SetTokens([]core.Token{{Name: core.AnyClient, Token: "secret", Role: core.RoleReader}}))
+	assert.NotNil(t, service.SetTokens([]core.Token{{Name: "uid:0", Token: "secret", Role: core.RoleAdmin}}))
+	assert.NotNil(t, service.SetTokens([]core.Token{{Name: "a", Token: "secret", Role: "root"}}))
+	assert.NotNil(t, service.SetTokens([]core.Token{
+		{Name: "a", Token: "secret", Role: core.RoleReader},
+		{Name: "b", Token: "secret", Role: core.RoleAdmin},
+	}))
+	assert.Nil(t, service.SetTokens(testTokens))
+	assert.Nil(t, service.SetTokens(nil))
+}
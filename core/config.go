@@ -0,0 +1,93 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config holds the VolumeService's optional settings, which main
+// loads from a JSON file. For example:
+//
+//	{
+//	  "quotas": [
+//	    {"client": "ingest", "bytes": 500000000000},
+//	    {"client": "ingest", "volume": "/mnt/staging", "bytes": 100000000000},
+//	    {"client": "*", "bytes": 50000000000}
+//	  ],
+//	  "free_space_thresholds": [20, 10, 5],
+//	  "fill_alerts": ["24h", "1h"],
+//	  "tokens": [
+//	    {"name": "ingest", "token": "3f9c1e...", "role": "reserver"},
+//	    {"name": "ops", "token": "b07d2a...", "role": "admin"}
+//	  ],
+//	  "acl": [
+//	    {"client": "ingest", "prefix": "/data/ingest", "operations": ["reserve", "release", "report"]},
+//	    {"client": "*", "prefix": "/data", "operations": ["report"]}
+//	  ],
+//	  "rate_limits": [
+//	    {"endpoint": "reserve", "rate": 5, "burst": 20},
+//	    {"endpoint": "*", "rate": 50}
+//	  ]
+//	}
+type Config struct {
+	Quotas []Quota `json:"quotas"`
+	// Tokens are the bearer tokens clients may use. If there are none,
+	// the service doesn't require them. See VolumeService.SetTokens.
+	Tokens []Token `json:"tokens"`
+	// ACL limits which paths each client may reserve, release and see.
+	// If it's empty, any client may do anything its token allows. See
+	// VolumeService.SetACL.
+	ACL []ACLRule `json:"acl"`
+	// RateLimits limit how often each client may call each HTTP
+	// endpoint. See VolumeService.SetRateLimits.
+	RateLimits []RateLimit `json:"rate_limits"`
+	// FreeSpaceThresholds are percentages of each volume's total
+	// space. See VolumeService.SetThresholds.
+	FreeSpaceThresholds []int `json:"free_space_thresholds"`
+	// FillAlerts are how long before background writers fill a volume
+	// the service should warn. See VolumeService.SetFillAlerts.
+	FillAlerts []Duration `json:"fill_alerts"`
+}
+
+// FillAlertHorizons returns the FillAlerts as time.Durations.
+func (config *Config) FillAlertHorizons() []time.Duration {
+	horizons := make([]time.Duration, len(config.FillAlerts))
+	for i, horizon := range config.FillAlerts {
+		horizons[i] = time.Duration(horizon)
+	}
+	return horizons
+}
+
+// LoadConfig reads and validates the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s is not valid JSON: %v", path, err)
+	}
+	if _, err = newQuotaTable(config.Quotas); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if _, err = sortThresholds(config.FreeSpaceThresholds); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if _, err = sortFillAlerts(config.FillAlertHorizons()); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if _, err = newTokenTable(config.Tokens); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if _, err = newACLTable(config.ACL); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if _, err = newRateLimitTable(config.RateLimits); err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	return config, nil
+}
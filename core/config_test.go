@@ -0,0 +1,66 @@
+package core_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfig writes contents to a config file in a temporary
+// directory and returns its path.
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.Nil(t, os.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := core.LoadConfig(writeConfig(t, `{
+		"quotas": [
+			{"client": "ingest", "bytes": 5000},
+			{"client": "ingest", "volume": "/mnt/staging", "bytes": 1000},
+			{"client": "*", "bytes": 500}],
+		"free_space_thresholds": [10, 25],
+		"fill_alerts": ["1h", 86400],
+		"tokens": [{"name": "ingest", "token": "secret", "role": "reserver"}],
+		"acl": [{"client": "ingest", "prefix": "/data/ingest", "operations": ["reserve", "report"]}],
+		"rate_limits": [{"endpoint": "reserve", "rate": 5, "burst": 20}]}`))
+	require.Nil(t, err)
+	expected := []core.Quota{
+		{Client: "ingest", Bytes: 5000},
+		{Client: "ingest", Volume: "/mnt/staging", Bytes: 1000},
+		{Client: "*", Bytes: 500},
+	}
+	assert.Equal(t, expected, config.Quotas)
+	assert.Equal(t, []int{10, 25}, config.FreeSpaceThresholds)
+	assert.Equal(t, []time.Duration{time.Hour, 24 * time.Hour}, config.FillAlertHorizons())
+	assert.Equal(t, []core.Token{{Name: "ingest", Token: "secret", Role: core.RoleReserver}}, config.Tokens)
+	assert.Equal(t, []core.ACLRule{{Client: "ingest", Prefix: "/data/ingest",
+		Operations: []core.Operation{core.OpReserve, core.OpReport}}}, config.ACL)
+	assert.Equal(t, []core.RateLimit{{Endpoint: "reserve", Rate: 5, Burst: 20}}, config.RateLimits)
+
+	// Each setting is checked the way the service's setter checks it.
+	invalid := []string{
+		`{"quotas": [`,
+		`{"quotas": [{"bytes": 5000}]}`,
+		`{"quotas": [{"client": "ingest", "bytes": 5000}, {"client": "ingest", "bytes": 1000}]}`,
+		`{"free_space_thresholds": [100]}`,
+		`{"fill_alerts": ["10s"]}`,
+		`{"tokens": [{"name": "ingest", "token": "secret", "role": "root"}]}`,
+		`{"tokens": [{"name": "*", "token": "secret", "role": "reader"}]}`,
+		`{"tokens": [{"token": "secret", "role": "reader"}]}`,
+		`{"acl": [{"client": "ingest", "prefix": "/data", "operations": ["delete"]}]}`,
+		`{"rate_limits": [{"endpoint": "reserve", "rate": 0}]}`,
+	}
+	for _, contents := range invalid {
+		_, err = core.LoadConfig(writeConfig(t, contents))
+		assert.NotNil(t, err, contents)
+	}
+	_, err = core.LoadConfig(filepath.Join(t.TempDir(), "no_such_file.json"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// ConsumptionWindow is how far back the VolumeService looks when it
+// estimates how fast processes that don't use vreserve are filling
+// each volume. A longer window smooths out bursts, but is slower to
+// notice a change.
+var ConsumptionWindow = time.Hour
+
+// minConsumptionSamples is the number of samples the VolumeService
+// needs before it estimates background consumption.
+const minConsumptionSamples = 3
+
+// consumptionSample is a volume's background level at a moment: its
+// free bytes, less the changes in free space the estimator has put down
+// to reservation holders. When the level falls, something else is
+// writing to the disk.
+type consumptionSample struct {
+	when  time.Time
+	level float64
+}
+
+// leftData is data holders left on the disk when they released their
+// reservations. If they delete it later, that isn't background cleanup.
+type leftData struct {
+	when  time.Time
+	bytes uint64
+}
+
+// consumptionEstimator estimates a volume's background consumption
+// from the samples in the last ConsumptionWindow. At each sample, it
+// puts as much of the fall in free space since the last one as it can
+// down to holders writing into the space they reserved, and as much of
+// each rise as it can down to holders deleting what they wrote, even
+// after releasing their reservations. Only the rest changes the level.
+// So granting a reservation doesn't change the level, and neither does
+// releasing one, whether its holder deletes its data or leaves it on
+// the disk.
+type consumptionEstimator struct {
+	samples []consumptionSample
+	sampled bool
+	free    uint64
+	level   float64
+	// released and releasedRoom are the bytes holders had written, and
+	// had yet to write, when they released their reservations since the
+	// last sample.
+	released     uint64
+	releasedRoom uint64
+	// left is the data holders have left on the disk in the last
+	// window, oldest first.
+	left []leftData
+}
+
+// release records that a holder released a reservation it had written
+// written bytes into, with room bytes left to write.
+func (estimator *consumptionEstimator) release(written, room uint64) {
+	estimator.released = addSaturating(estimator.released, written)
+	estimator.releasedRoom = addSaturating(estimator.releasedRoom, room)
+}
+
+// add records that the volume had free bytes at when, with holders
+// holding its reservations, and forgets samples and left data older
+// than window.
+func (estimator *consumptionEstimator) add(when time.Time, free uint64, holders []*reservation, window time.Duration) {
+	switch {
+	case !estimator.sampled:
+		estimator.level = float64(free)
+		estimator.sampled = true
+	case free < estimator.free:
+		fall := estimator.free - free
+		estimator.level -= float64(fall - estimator.attributeWrites(fall, holders))
+	default:
+		rise := free - estimator.free
+		estimator.level += float64(rise - estimator.attributeDeletes(rise, holders))
+	}
+	estimator.free = free
+	if estimator.released > 0 {
+		estimator.left = append(estimator.left, leftData{when: when, bytes: estimator.released})
+	}
+	estimator.released, estimator.releasedRoom = 0, 0
+	estimator.samples = append(estimator.samples, consumptionSample{when: when, level: estimator.level})
+
+	oldest := when.Add(-window)
+	keep := 0
+	for keep < len(estimator.samples) && estimator.samples[keep].when.Before(oldest) {
+		keep++
+	}
+	estimator.samples = estimator.samples[keep:]
+	keep = 0
+	for keep < len(estimator.left) && estimator.left[keep].when.Before(oldest) {
+		keep++
+	}
+	estimator.left = estimator.left[keep:]
+}
+
+// attributeWrites puts as much of a fall of bytes in free space as it
+// can down to holders writing into their reservations, including those
+// released since the last sample, and returns how much.
+func (estimator *consumptionEstimator) attributeWrites(bytes uint64, holders []*reservation) uint64 {
+	attributed := uint64(0)
+	for _, r := range holders {
+		written := min(bytes-attributed, r.numBytes-r.written)
+		r.written += written
+		attributed += written
+	}
+	written := min(bytes-attributed, estimator.releasedRoom)
+	estimator.releasedRoom -= written
+	estimator.released += written
+	return attributed + written
+}
+
+// attributeDeletes puts as much of a rise of bytes in free space as it
+// can down to holders deleting what they wrote, whether or not they
+// still hold their reservations, and returns how much.
+func (estimator *consumptionEstimator) attributeDeletes(bytes uint64, holders []*reservation) uint64 {
+	attributed := uint64(0)
+	for _, r := range holders {
+		deleted := min(bytes-attributed, r.written)
+		r.written -= deleted
+		attributed += deleted
+	}
+	deleted := min(bytes-attributed, estimator.released)
+	estimator.released -= deleted
+	attributed += deleted
+	for i := len(estimator.left) - 1; i >= 0 && attributed < bytes; i-- {
+		deleted = min(bytes-attributed, estimator.left[i].bytes)
+		estimator.left[i].bytes -= deleted
+		attributed += deleted
+	}
+	return attributed
+}
+
+// rate returns the background consumption in bytes per second, which
+// is the negative of the least squares slope of the samples. It's
+// negative if the disk is being cleaned up. It returns false if there
+// aren't enough samples to tell.
+func (estimator *consumptionEstimator) rate() (float64, bool) {
+	n := len(estimator.samples)
+	if n < minConsumptionSamples {
+		return 0, false
+	}
+	first := estimator.samples[0].when
+	var sumX, sumY float64
+	for _, sample := range estimator.samples {
+		sumX += sample.when.Sub(first).Seconds()
+		sumY += sample.level
+	}
+	meanX, meanY := sumX/float64(n), sumY/float64(n)
+	var covariance, variance float64
+	for _, sample := range estimator.samples {
+		dx := sample.when.Sub(first).Seconds() - meanX
+		covariance += dx * (sample.level - meanY)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return 0, false
+	}
+	return -covariance / variance, true
+}
+
+// timeToFull returns how long background consumption at rate bytes per
+// second would take to use up available bytes. It returns false if the
+// volume isn't filling. If it's filling but available is zero, the
+// volume is already full, and the time is zero.
+func timeToFull(available uint64, rate float64) (time.Duration, bool) {
+	if rate <= 0 {
+		return 0, false
+	}
+	seconds := float64(available) / rate
+	if seconds >= float64(math.MaxInt64/int64(time.Second)) {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// sortFillAlerts validates horizons and returns them longest first,
+// so a volume that's filling faster and faster crosses them in order.
+func sortFillAlerts(horizons []time.Duration) ([]time.Duration, error) {
+	sorted := make([]time.Duration, len(horizons))
+	for i, horizon := range horizons {
+		if horizon < time.Minute {
+			return nil, fmt.Errorf("fill alert %v must be at least a minute", horizon)
+		}
+		sorted[i] = horizon
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	return sorted, nil
+}
+
+// SetFillAlerts sets the fill alert horizons. Each time the projected
+// time until background consumption fills a volume (see
+// VolumeInfo.TimeToFull) falls below one of them, or rises back above
+// it, the service publishes an EventFilling. Pass nil to remove them
+// all.
+func (service *VolumeService) SetFillAlerts(horizons []time.Duration) error {
+	sorted, err := sortFillAlerts(horizons)
+	if err != nil {
+		return err
+	}
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	service.fillAlerts = sorted
+	service.fillLevels = make(map[string]int)
+	service.auditConfig("set fill alerts %v", sorted)
+	return nil
+}
+
+// checkFillAlerts publishes an EventFilling for each fill alert the
+// volume's projected time to full has crossed since the last check.
+// Caller must hold the ledgerMutex.
+func (service *VolumeService) checkFillAlerts(volume *Volume) {
+	if len(service.fillAlerts) == 0 {
+		return
+	}
+	info := volume.Info()
+	if info.Error != "" {
+		return
+	}
+	// level is the number of horizons the time to full is below. A
+	// full volume is below all of them.
+	filling := info.TimeToFull > 0 || info.Full
+	level := 0
+	for _, horizon := range service.fillAlerts {
+		if filling && time.Duration(info.TimeToFull) < horizon {
+			level++
+		}
+	}
+	previous := service.fillLevels[info.MountPoint]
+	service.fillLevels[info.MountPoint] = level
+	event := Event{
+		Type:           EventFilling,
+		Volume:         info.MountPoint,
+		AvailableBytes: info.AvailableBytes,
+		TotalBytes:     info.TotalBytes,
+		BytesPerSecond: info.BackgroundBytesPerSecond,
+		TimeToFull:     info.TimeToFull,
+		Full:           info.Full,
+	}
+	for i := previous; i < level; i++ {
+		event.Horizon = Duration(service.fillAlerts[i])
+		event.Below = true
+		service.publish(event)
+		service.logger.Warningf("Background writers will fill %s in %v, less than %v",
+			info.MountPoint, time.Duration(info.TimeToFull).Round(time.Second), service.fillAlerts[i])
+	}
+	for i := previous - 1; i >= level; i-- {
+		event.Horizon = Duration(service.fillAlerts[i])
+		event.Below = false
+		service.publish(event)
+		service.logger.Infof("Background writers will no longer fill %s within %v",
+			info.MountPoint, service.fillAlerts[i])
+	}
+}
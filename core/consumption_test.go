@@ -0,0 +1,226 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nextFillingEvent returns the next filling event from events,
+// skipping events of other types.
+func nextFillingEvent(t *testing.T, events <-chan core.Event) core.Event {
+	for {
+		event := nextEvent(t, events)
+		if event.Type == core.EventFilling {
+			return event
+		}
+	}
+}
+
+func TestBackgroundConsumption(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	require.Nil(t, service.SetFillAlerts([]time.Duration{30 * time.Minute, 2 * time.Hour}))
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	service.SetClock(func() time.Time { return now })
+	client := serveEvents(t, service)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := client.Watch(ctx)
+	require.Nil(t, err)
+	path := filepath.Join(os.TempDir(), "consumption_file")
+	service.Reservations(path)
+	volume := func() core.VolumeInfo {
+		volumes := service.Volumes()
+		require.Len(t, volumes, 1)
+		return volumes[0]
+	}
+
+	// Two samples aren't enough for an estimate.
+	service.SampleVolumes()
+	now = now.Add(time.Minute)
+	provider.Consume("", 10000)
+	service.SampleVolumes()
+	assert.Zero(t, volume().BackgroundBytesPerSecond)
+	assert.Zero(t, volume().TimeToFull)
+
+	// A reservation its holder writes into doesn't count, but the
+	// background writes alongside it do.
+	id, err := service.AddReservation("ingest", path, 400000, 0)
+	require.Nil(t, err)
+	provider.Consume("", 410000)
+	now = now.Add(time.Minute)
+	service.SampleVolumes()
+	info := volume()
+	assert.InDelta(t, 10000.0/60, info.BackgroundBytesPerSecond, 0.01)
+	assert.EqualValues(t, 180000, info.AvailableBytes)
+	assert.InDelta(t, 18*time.Minute, time.Duration(info.TimeToFull), float64(time.Second))
+	for _, horizon := range []time.Duration{2 * time.Hour, 30 * time.Minute} {
+		event := nextFillingEvent(t, events)
+		assert.Equal(t, core.Duration(horizon), event.Horizon)
+		assert.True(t, event.Below)
+		assert.Equal(t, info.TimeToFull, event.TimeToFull)
+		assert.Equal(t, info.BackgroundBytesPerSecond, event.BytesPerSecond)
+		assert.EqualValues(t, 180000, event.AvailableBytes)
+		assert.NotEmpty(t, event.Volume)
+	}
+
+	var metrics bytes.Buffer
+	require.Nil(t, service.WriteMetrics(&metrics))
+	assert.Contains(t, metrics.String(), "vreserve_volume_background_bytes_per_second{volume=")
+	assert.Contains(t, metrics.String(), "vreserve_volume_seconds_to_full{volume=")
+
+	// The holder cleans up and releases, and the background writes
+	// stop, so the volume fills more slowly.
+	provider.Reclaim("", 400000)
+	require.True(t, service.ReleaseID(id))
+	now = now.Add(time.Minute)
+	service.SampleVolumes()
+	info = volume()
+	assert.InDelta(t, 7000.0/60, info.BackgroundBytesPerSecond, 0.01)
+	assert.InDelta(t, 140*time.Minute, time.Duration(info.TimeToFull), float64(time.Second))
+	for _, horizon := range []time.Duration{30 * time.Minute, 2 * time.Hour} {
+		event := nextFillingEvent(t, events)
+		assert.Equal(t, core.Duration(horizon), event.Horizon)
+		assert.False(t, event.Below)
+	}
+
+	// Samples older than the window are forgotten. Once space is being
+	// freed, the volume isn't filling.
+	for i := 0; i < 60; i++ {
+		now = now.Add(time.Minute)
+		provider.Reclaim("", 100)
+		service.SampleVolumes()
+	}
+	info = volume()
+	assert.InDelta(t, -100.0/60, info.BackgroundBytesPerSecond, 0.01)
+	assert.Zero(t, info.TimeToFull)
+	metrics.Reset()
+	require.Nil(t, service.WriteMetrics(&metrics))
+	assert.Contains(t, metrics.String(), "vreserve_volume_background_bytes_per_second{volume=")
+	assert.NotContains(t, metrics.String(), "vreserve_volume_seconds_to_full{volume=")
+
+	assert.NotNil(t, service.SetFillAlerts([]time.Duration{time.Second}))
+	assert.Nil(t, service.SetFillAlerts(nil))
+}
+
+func TestFullVolumeStaysBelowFillAlerts(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	require.Nil(t, service.SetFillAlerts([]time.Duration{30 * time.Minute, 2 * time.Hour}))
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	service.SetClock(func() time.Time { return now })
+	client := serveEvents(t, service)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := client.Watch(ctx)
+	require.Nil(t, err)
+	path := filepath.Join(os.TempDir(), "full_volume_file")
+	id, err := service.AddReservation("ingest", path, 1, 0)
+	require.Nil(t, err)
+	sample := func() core.VolumeInfo {
+		service.SampleVolumes()
+		volumes := service.Volumes()
+		require.Len(t, volumes, 1)
+		return volumes[0]
+	}
+
+	// Background writers fill the volume fast enough to set off both
+	// alerts.
+	sample()
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Minute)
+		provider.Consume("", 100000)
+		sample()
+	}
+	for range 2 {
+		assert.True(t, nextFillingEvent(t, events).Below)
+	}
+
+	// Then they use up the rest of it. The volume is full, which is
+	// below every alert, so none of them clears.
+	now = now.Add(time.Minute)
+	provider.Consume("", 799999)
+	info := sample()
+	assert.Zero(t, info.AvailableBytes)
+	assert.Positive(t, info.BackgroundBytesPerSecond)
+	assert.Zero(t, info.TimeToFull)
+	assert.True(t, info.Full)
+	var metrics bytes.Buffer
+	require.Nil(t, service.WriteMetrics(&metrics))
+	assert.Regexp(t, `vreserve_volume_seconds_to_full\{volume="[^"]*"\} 0\n`, metrics.String())
+	require.True(t, service.ReleaseID(id))
+	for {
+		event := nextEvent(t, events)
+		require.NotEqual(t, core.EventFilling, event.Type)
+		if event.Type == core.EventRelease {
+			break
+		}
+	}
+}
+
+func TestConsumptionIgnoresLedgerChanges(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	require.Nil(t, service.SetFillAlerts([]time.Duration{30 * time.Minute, 2 * time.Hour}))
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	service.SetClock(func() time.Time { return now })
+	client := serveEvents(t, service)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := client.Watch(ctx)
+	require.Nil(t, err)
+	path := filepath.Join(os.TempDir(), "ledger_changes_file")
+	service.Reservations(path)
+	sample := func() core.VolumeInfo {
+		now = now.Add(time.Minute)
+		service.SampleVolumes()
+		volumes := service.Volumes()
+		require.Len(t, volumes, 1)
+		return volumes[0]
+	}
+
+	// Half the data for this reservation is on the disk already, so
+	// its holder writes only the other half.
+	provider.Consume("", 100000)
+	sample()
+	id, err := service.AddReservation("ingest", path, 200000, 0)
+	require.Nil(t, err)
+	provider.Consume("", 100000)
+	sample()
+	info := sample()
+	assert.Zero(t, info.BackgroundBytesPerSecond)
+	require.True(t, service.ReleaseID(id))
+
+	// The holder releases its reservation but leaves its data on the
+	// disk, and then deletes it.
+	id, err = service.AddReservation("ingest", path, 400000, 0)
+	require.Nil(t, err)
+	provider.Consume("", 400000)
+	sample()
+	require.True(t, service.ReleaseID(id))
+	info = sample()
+	assert.Zero(t, info.BackgroundBytesPerSecond)
+	assert.Zero(t, info.TimeToFull)
+	provider.Reclaim("", 400000)
+	info = sample()
+	assert.Zero(t, info.BackgroundBytesPerSecond)
+
+	// None of that set off a fill alert.
+	_, err = service.AddReservation("ingest", path, 1, 0)
+	require.Nil(t, err)
+	for {
+		event := nextEvent(t, events)
+		require.NotEqual(t, core.EventFilling, event.Type)
+		if event.Type == core.EventReserve && event.Bytes == 1 {
+			break
+		}
+	}
+}
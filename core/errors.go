@@ -0,0 +1,277 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrorCode is a stable, machine-readable name for the reason a request
+// failed. The service returns it in VolumeResponse.ErrorCode, so clients
+// don't have to match on error messages, which may change.
+type ErrorCode string
+
+const (
+	// CodeInsufficientSpace means the volume doesn't have enough free
+	// space for the request, or the request gave up waiting for it.
+	CodeInsufficientSpace ErrorCode = "INSUFFICIENT_SPACE"
+	// CodeQuotaExceeded means the request would put the client over
+	// its quota.
+	CodeQuotaExceeded ErrorCode = "QUOTA_EXCEEDED"
+	// CodeInvalidParam means a required param is missing or malformed.
+	CodeInvalidParam ErrorCode = "INVALID_PARAM"
+	// CodeVolumeUnavailable means the service couldn't measure the
+	// free space on the volume.
+	CodeVolumeUnavailable ErrorCode = "VOLUME_UNAVAILABLE"
+	// CodeNotFound means there's no such reservation.
+	CodeNotFound ErrorCode = "NOT_FOUND"
+	// CodeMethodNotAllowed means the v2 API resource doesn't support
+	// the request's HTTP method.
+	CodeMethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+	// CodeUnauthorized means the service requires a token, and the
+	// request didn't have a valid one.
+	CodeUnauthorized ErrorCode = "UNAUTHORIZED"
+	// CodeForbidden means the client's token doesn't allow the request,
+	// or the client tried to release someone else's reservation.
+	CodeForbidden ErrorCode = "FORBIDDEN"
+	// CodeAccessDenied means the service's ACL doesn't let the client
+	// perform the operation on the path.
+	CodeAccessDenied ErrorCode = "ACCESS_DENIED"
+	// CodeRateLimited means the client has made too many requests to
+	// the endpoint. The response's Retry-After header says when to try
+	// again.
+	CodeRateLimited ErrorCode = "RATE_LIMITED"
+	// CodeCanceled means the client gave up on the request, for
+	// example by disconnecting while it waited for space. It's not a
+	// failure of the service.
+	CodeCanceled ErrorCode = "CANCELED"
+	// CodeInternal is any other failure.
+	CodeInternal ErrorCode = "INTERNAL"
+)
+
+// Sentinel errors for each ErrorCode. Errors from the service and the
+// VolumeClient match these with errors.Is. For example:
+//
+//	_, err := client.AddReservation(path, bytes, lease)
+//	if errors.Is(err, core.ErrInsufficientSpace) {
+//		// Try again later.
+//	}
+var (
+	ErrInsufficientSpace = errors.New("insufficient space")
+	ErrQuotaExceeded     = errors.New("quota exceeded")
+	ErrInvalidParam      = errors.New("invalid param")
+	ErrVolumeUnavailable = errors.New("volume unavailable")
+	ErrNotFound          = errors.New("not found")
+	ErrMethodNotAllowed  = errors.New("method not allowed")
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrForbidden         = errors.New("forbidden")
+	ErrAccessDenied      = errors.New("access denied")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrCanceled          = errors.New("canceled")
+	ErrInternal          = errors.New("internal error")
+)
+
+var codeErrors = map[ErrorCode]error{
+	CodeInsufficientSpace: ErrInsufficientSpace,
+	CodeQuotaExceeded:     ErrQuotaExceeded,
+	CodeInvalidParam:      ErrInvalidParam,
+	CodeVolumeUnavailable: ErrVolumeUnavailable,
+	CodeNotFound:          ErrNotFound,
+	CodeMethodNotAllowed:  ErrMethodNotAllowed,
+	CodeUnauthorized:      ErrUnauthorized,
+	CodeForbidden:         ErrForbidden,
+	CodeAccessDenied:      ErrAccessDenied,
+	CodeRateLimited:       ErrRateLimited,
+	CodeCanceled:          ErrCanceled,
+	CodeInternal:          ErrInternal,
+}
+
+// statusClientClosedRequest is the status nginx and others log when the
+// client goes away before the response is ready. net/http has no name
+// for it.
+const statusClientClosedRequest = 499
+
+var codeStatuses = map[ErrorCode]int{
+	CodeInsufficientSpace: http.StatusInsufficientStorage,
+	CodeQuotaExceeded:     http.StatusForbidden,
+	CodeInvalidParam:      http.StatusBadRequest,
+	CodeVolumeUnavailable: http.StatusServiceUnavailable,
+	CodeNotFound:          http.StatusNotFound,
+	CodeMethodNotAllowed:  http.StatusMethodNotAllowed,
+	CodeUnauthorized:      http.StatusUnauthorized,
+	CodeForbidden:         http.StatusForbidden,
+	CodeAccessDenied:      http.StatusForbidden,
+	CodeRateLimited:       http.StatusTooManyRequests,
+	CodeCanceled:          statusClientClosedRequest,
+	CodeInternal:          http.StatusInternalServerError,
+}
+
+// Status returns the HTTP status the service sends with code.
+func (code ErrorCode) Status() int {
+	if status, ok := codeStatuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// ServiceError is the error the VolumeClient returns when the service
+// rejects a request. It matches the sentinel error for its Code, so
+// callers can use errors.Is, or errors.As to get at the details.
+// QueuePosition is set when a request gives up waiting for space, and
+// RetryAfter when the service says when to try again.
+type ServiceError struct {
+	Code          ErrorCode
+	Message       string
+	StatusCode    int
+	QueuePosition int
+	RetryAfter    time.Duration
+}
+
+func (err *ServiceError) Error() string {
+	return err.Message
+}
+
+// Is reports whether target is the sentinel error for err.Code.
+func (err *ServiceError) Is(target error) bool {
+	return codeErrors[err.Code] == target
+}
+
+// VolumeUnavailableError is the error returned when the StatProvider
+// can't measure a volume.
+type VolumeUnavailableError struct {
+	MountPoint string
+	Err        error
+}
+
+func (err *VolumeUnavailableError) Error() string {
+	return fmt.Sprintf("cannot get free space on %s: %v", err.MountPoint, err.Err)
+}
+
+func (err *VolumeUnavailableError) Unwrap() error {
+	return err.Err
+}
+
+// Is reports whether target is ErrVolumeUnavailable.
+func (err *VolumeUnavailableError) Is(target error) bool {
+	return target == ErrVolumeUnavailable
+}
+
+// Is reports whether target is ErrInsufficientSpace.
+func (err *SpaceError) Is(target error) bool {
+	return target == ErrInsufficientSpace
+}
+
+// Is reports whether target is ErrQuotaExceeded.
+func (err *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// errorCode returns the ErrorCode for an error from the VolumeService.
+// A request that gives up waiting for space fails for lack of space,
+// unless the client canceled it.
+func errorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, ErrInsufficientSpace), errors.Is(err, context.DeadlineExceeded):
+		return CodeInsufficientSpace
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, ErrQuotaExceeded):
+		return CodeQuotaExceeded
+	case errors.Is(err, ErrVolumeUnavailable):
+		return CodeVolumeUnavailable
+	case errors.Is(err, ErrNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrInvalidParam):
+		return CodeInvalidParam
+	case errors.Is(err, ErrUnauthorized):
+		return CodeUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return CodeForbidden
+	case errors.Is(err, ErrAccessDenied):
+		return CodeAccessDenied
+	}
+	return CodeInternal
+}
+
+// statusCode guesses the ErrorCode from the HTTP status of a response
+// that didn't include one, from an older version of the service.
+// Services that old had no tokens or ACLs, so a 403 meant a quota.
+func statusCode(status int) ErrorCode {
+	if status == http.StatusForbidden {
+		return CodeQuotaExceeded
+	}
+	for code, codeStatus := range codeStatuses {
+		if codeStatus == status {
+			return code
+		}
+	}
+	return CodeInternal
+}
+
+// paramError is the error returned when a request is missing a param
+// it needs, or has one the VolumeClient can reject without asking the
+// service.
+type paramError string
+
+func (err paramError) Error() string {
+	return string(err)
+}
+
+// Is reports whether target is ErrInvalidParam.
+func (err paramError) Is(target error) bool {
+	return target == ErrInvalidParam
+}
+
+// notFoundError is the error returned when there's no reservation
+// for an ID or path.
+type notFoundError string
+
+func (err notFoundError) Error() string {
+	return string(err)
+}
+
+// Is reports whether target is ErrNotFound.
+func (err notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// unauthorizedError is the error returned when a request needs a
+// token and doesn't have a valid one.
+type unauthorizedError string
+
+func (err unauthorizedError) Error() string {
+	return string(err)
+}
+
+// Is reports whether target is ErrUnauthorized.
+func (err unauthorizedError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// forbiddenError is the error returned when a client's token doesn't
+// allow what it asked for.
+type forbiddenError string
+
+func (err forbiddenError) Error() string {
+	return string(err)
+}
+
+// Is reports whether target is ErrForbidden.
+func (err forbiddenError) Is(target error) bool {
+	return target == ErrForbidden
+}
+
+// accessDeniedError is the error returned when the service's ACL
+// doesn't let a client perform an operation on a path.
+type accessDeniedError string
+
+func (err accessDeniedError) Error() string {
+	return string(err)
+}
+
+// Is reports whether target is ErrAccessDenied.
+func (err accessDeniedError) Is(target error) bool {
+	return target == ErrAccessDenied
+}
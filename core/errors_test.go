@@ -0,0 +1,129 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceErrors(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	path := filepath.Join(os.TempDir(), "service_errors")
+
+	_, err := service.AddReservation("", path, 2000, 0)
+	assert.True(t, errors.Is(err, core.ErrInsufficientSpace), "got %v", err)
+	var spaceErr *core.SpaceError
+	require.True(t, errors.As(err, &spaceErr))
+	assert.EqualValues(t, 2000, spaceErr.Requested)
+
+	require.Nil(t, service.SetQuotas([]core.Quota{{Client: "*", Bytes: 100}}))
+	_, err = service.AddReservation("", path, 200, 0)
+	assert.True(t, errors.Is(err, core.ErrQuotaExceeded), "got %v", err)
+	require.Nil(t, service.SetQuotas(nil))
+
+	assert.True(t, errors.Is(service.RenewID("0123456789abcdef", 0), core.ErrNotFound))
+	assert.True(t, errors.Is(service.Renew(path, 0), core.ErrNotFound))
+	require.Nil(t, service.Reserve(path, 10))
+	assert.True(t, errors.Is(service.Renew(path, 0), core.ErrNotFound))
+
+	provider.SetError(fmt.Errorf("disk on fire"))
+	_, err = service.AddReservation("", path, 10, 0)
+	assert.True(t, errors.Is(err, core.ErrVolumeUnavailable), "got %v", err)
+	assert.Contains(t, err.Error(), "disk on fire")
+}
+
+func TestCanceledError(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	client := serveEvents(t, service)
+	path := filepath.Join(os.TempDir(), "canceled_error")
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	events, err := client.Watch(watchCtx)
+	require.Nil(t, err)
+
+	// A client that gives up waiting hasn't hit a server error.
+	provider.Consume("", 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan error, 1)
+	go func() {
+		_, _, err := service.ReserveWait(ctx, "impatient", path, 100, 0)
+		results <- err
+	}()
+	waitForQueueLength(t, service, os.TempDir(), 1)
+	cancel()
+	assert.True(t, errors.Is(<-results, context.Canceled))
+	event := nextEvent(t, events)
+	assert.Equal(t, core.EventDeny, event.Type)
+	assert.Equal(t, core.CodeCanceled, event.ErrorCode)
+	assert.Equal(t, 499, core.CodeCanceled.Status())
+}
+
+func TestClientErrors(t *testing.T) {
+	runService(t)
+	client := core.NewVolumeClient(serviceUrl)
+
+	_, err := client.AddReservation("", 100, 0)
+	assert.True(t, errors.Is(err, core.ErrInvalidParam))
+	_, err = client.Reserve("/tmp/client_errors", 0)
+	assert.True(t, errors.Is(err, core.ErrInvalidParam))
+
+	// Checked by the service, not the client.
+	err = client.Renew("/tmp/client_errors")
+	var serviceErr *core.ServiceError
+	require.True(t, errors.As(err, &serviceErr), "got %v", err)
+	assert.Equal(t, core.CodeNotFound, serviceErr.Code)
+	assert.Equal(t, http.StatusNotFound, serviceErr.StatusCode)
+	assert.True(t, errors.Is(client.ReleaseID("0123456789abcdef"), core.ErrNotFound))
+
+	_, err = client.Reserve("/tmp/client_errors", 4611686018427387904)
+	assert.True(t, errors.Is(err, core.ErrInsufficientSpace), "got %v", err)
+	assert.False(t, errors.Is(err, core.ErrQuotaExceeded))
+
+	require.Nil(t, volumeService.SetQuotas([]core.Quota{{Client: "stingy", Bytes: 10}}))
+	defer volumeService.SetQuotas(nil)
+	stingy := core.NewVolumeClient(serviceUrl, core.WithClientName("stingy"))
+	_, err = stingy.AddReservation("/tmp/client_errors", 100, 0)
+	require.True(t, errors.As(err, &serviceErr), "got %v", err)
+	assert.Equal(t, core.CodeQuotaExceeded, serviceErr.Code)
+	assert.Equal(t, http.StatusForbidden, serviceErr.StatusCode)
+	assert.True(t, errors.Is(err, core.ErrQuotaExceeded))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err = client.ReserveWait(ctx, "/tmp/client_errors", 4611686018427387904)
+	require.True(t, errors.As(err, &serviceErr), "got %v", err)
+	assert.Equal(t, core.CodeInsufficientSpace, serviceErr.Code)
+	assert.Equal(t, 1, serviceErr.QueuePosition)
+}
+
+func TestClientErrorsWithoutCode(t *testing.T) {
+	// Older versions of the service don't send an ErrorCode, so the
+	// client goes by the HTTP status.
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"Succeeded":false,"ErrorMessage":"Something went wrong.","Data":null}`)
+	}))
+	defer server.Close()
+	client := core.NewVolumeClient(server.URL)
+
+	err := client.Release("/tmp/old_service")
+	assert.True(t, errors.Is(err, core.ErrNotFound), "got %v", err)
+	assert.Equal(t, "Something went wrong.", err.Error())
+
+	status = http.StatusInternalServerError
+	err = client.Release("/tmp/old_service")
+	assert.True(t, errors.Is(err, core.ErrInternal), "got %v", err)
+}
@@ -0,0 +1,367 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventType identifies what an Event describes.
+type EventType string
+
+const (
+	// EventReserve means space was granted, right away or to a request
+	// that was waiting in line.
+	EventReserve EventType = "reserve"
+	// EventRelease means a reservation was released.
+	EventRelease EventType = "release"
+	// EventExpire means a reservation was released because its lease
+	// expired.
+	EventExpire EventType = "expire"
+	// EventDeny means a request for space was refused, or gave up
+	// waiting in line.
+	EventDeny EventType = "deny"
+	// EventThreshold means the space available on a volume crossed one
+	// of the service's free space thresholds.
+	EventThreshold EventType = "threshold"
+	// EventFilling means the projected time until background writers
+	// fill a volume crossed one of the service's fill alerts.
+	EventFilling EventType = "filling"
+)
+
+// Event describes one change to the ledger, or a volume's available
+// space crossing a threshold. IDs increase by one with each event, and
+// start over when the service restarts.
+type Event struct {
+	ID            uint64
+	Type          EventType
+	Time          time.Time
+	Volume        string
+	Path          string    `json:",omitempty"`
+	ReservationID string    `json:",omitempty"`
+	Client        string    `json:",omitempty"`
+	Bytes         uint64    `json:",omitempty"`
+	ErrorCode     ErrorCode `json:",omitempty"`
+	Message       string    `json:",omitempty"`
+	// Threshold events only. Threshold is a percentage of the volume's
+	// total space. Below is true if AvailableBytes fell below it, and
+	// false if AvailableBytes rose back above it.
+	Threshold      int    `json:",omitempty"`
+	Below          bool   `json:",omitempty"`
+	AvailableBytes uint64 `json:",omitempty"`
+	TotalBytes     uint64 `json:",omitempty"`
+	// Filling events only. Horizon is the fill alert. Below is true if
+	// TimeToFull fell below it, and false if it rose back above it.
+	// Full is true if the volume has no unreserved space left, which
+	// is below every horizon. BytesPerSecond is the estimated
+	// background consumption.
+	Horizon        Duration `json:",omitempty"`
+	TimeToFull     Duration `json:",omitempty"`
+	Full           bool     `json:",omitempty"`
+	BytesPerSecond float64  `json:",omitempty"`
+}
+
+// EventBufferSize is the number of recent events the service keeps, so
+// clients that reconnect can pick up where they left off.
+var EventBufferSize = 1000
+
+// EventKeepAlive is how often the /events/ endpoint sends a comment to
+// idle clients, so proxies don't close the connection.
+var EventKeepAlive = 15 * time.Second
+
+// subscriberBuffer is the number of events a subscriber can fall behind
+// before the service gives up on it.
+const subscriberBuffer = 256
+
+// eventFilter selects the events a subscriber wants. An empty field
+// matches everything. PathPrefix matches events for paths at or under
+// it, and must be clean.
+type eventFilter struct {
+	volume     string
+	pathPrefix string
+}
+
+func (filter eventFilter) match(event Event) bool {
+	if filter.volume != "" && event.Volume != filter.volume {
+		return false
+	}
+	if filter.pathPrefix != "" &&
+		(event.Path == "" || !pathIsUnder(filepath.Clean(event.Path), filter.pathPrefix)) {
+		return false
+	}
+	return true
+}
+
+// subscriber receives events on its channel until it unsubscribes, or
+// until it falls too far behind and the eventBus closes the channel.
+type subscriber struct {
+	events chan Event
+	filter eventFilter
+}
+
+// eventBus numbers events, keeps the most recent of them, and passes
+// them along to subscribers.
+type eventBus struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	recent      []Event
+	subscribers map[*subscriber]bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*subscriber]bool)}
+}
+
+// publish assigns event the next ID and sends it to every subscriber
+// whose filter it matches.
+func (bus *eventBus) publish(event Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.lastID++
+	event.ID = bus.lastID
+	bus.recent = append(bus.recent, event)
+	if excess := len(bus.recent) - EventBufferSize; excess > 0 {
+		bus.recent = append(bus.recent[:0], bus.recent[excess:]...)
+	}
+	for sub := range bus.subscribers {
+		if !sub.filter.match(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// A subscriber that can't keep up would hold back
+			// everyone else. It can reconnect and resume.
+			delete(bus.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe returns a new subscriber for the events that match filter,
+// along with the recent matching events with IDs greater than afterID.
+// If afterID is zero, there are no recent events, just new ones.
+func (bus *eventBus) subscribe(filter eventFilter, afterID uint64) (*subscriber, []Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	sub := &subscriber{
+		events: make(chan Event, subscriberBuffer),
+		filter: filter,
+	}
+	bus.subscribers[sub] = true
+	missed := make([]Event, 0)
+	if afterID == 0 {
+		return sub, missed
+	}
+	for _, event := range bus.recent {
+		if event.ID > afterID && filter.match(event) {
+			missed = append(missed, event)
+		}
+	}
+	return sub, missed
+}
+
+// unsubscribe stops sending events to sub.
+func (bus *eventBus) unsubscribe(sub *subscriber) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	if bus.subscribers[sub] {
+		delete(bus.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// SetThresholds sets the free space thresholds, as percentages of each
+// volume's total space. Each time the space available on a volume
+// (free space minus claimed space) falls below one of them, or rises
+// back above it, the service publishes an EventThreshold. Pass nil to
+// remove them all.
+func (service *VolumeService) SetThresholds(percents []int) error {
+	thresholds, err := sortThresholds(percents)
+	if err != nil {
+		return err
+	}
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	service.thresholds = thresholds
+	service.thresholdLevels = make(map[string]int)
+	service.auditConfig("set free space thresholds %v", thresholds)
+	return nil
+}
+
+// sortThresholds validates percents and returns them highest first, so
+// a volume that's filling up crosses them in order.
+func sortThresholds(percents []int) ([]int, error) {
+	thresholds := make([]int, len(percents))
+	for i, percent := range percents {
+		if percent < 1 || percent > 99 {
+			return nil, fmt.Errorf("free space threshold %d must be between 1 and 99 percent", percent)
+		}
+		thresholds[i] = percent
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(thresholds)))
+	return thresholds, nil
+}
+
+// publish timestamps event and sends it to the service's subscribers.
+// Caller must hold the ledgerMutex.
+func (service *VolumeService) publish(event Event) {
+	event.Time = service.now().UTC()
+	service.events.publish(event)
+}
+
+// publishReservation publishes an event about reservation r on volume.
+// Caller must hold the ledgerMutex.
+func (service *VolumeService) publishReservation(eventType EventType, volume *Volume, r Reservation) {
+	service.publish(Event{
+		Type:          eventType,
+		Volume:        volume.MountPoint(),
+		Path:          r.Path,
+		ReservationID: r.ID,
+		Client:        r.Client,
+		Bytes:         r.Bytes,
+	})
+}
+
+// publishDenial publishes an EventDeny for a request that failed with
+// err. Caller must hold the ledgerMutex.
+func (service *VolumeService) publishDenial(volume *Volume, client, path string, numBytes uint64, err error) {
+	service.publish(Event{
+		Type:      EventDeny,
+		Volume:    volume.MountPoint(),
+		Path:      path,
+		Client:    client,
+		Bytes:     numBytes,
+		ErrorCode: errorCode(err),
+		Message:   err.Error(),
+	})
+}
+
+// checkThresholds publishes an EventThreshold for each threshold the
+// space available on volume has crossed since the last check. Caller
+// must hold the ledgerMutex.
+func (service *VolumeService) checkThresholds(volume *Volume) {
+	if len(service.thresholds) == 0 {
+		return
+	}
+	info := volume.Info()
+	if info.Error != "" || info.TotalBytes == 0 {
+		return
+	}
+	// level is the number of thresholds the volume is below.
+	level := 0
+	for _, percent := range service.thresholds {
+		if info.AvailableBytes*100 < uint64(percent)*info.TotalBytes {
+			level++
+		}
+	}
+	previous := service.thresholdLevels[info.MountPoint]
+	service.thresholdLevels[info.MountPoint] = level
+	event := Event{
+		Type:           EventThreshold,
+		Volume:         info.MountPoint,
+		AvailableBytes: info.AvailableBytes,
+		TotalBytes:     info.TotalBytes,
+	}
+	for i := previous; i < level; i++ {
+		event.Threshold = service.thresholds[i]
+		event.Below = true
+		service.publish(event)
+		service.logger.Warningf("Available space on %s fell below %d%%",
+			info.MountPoint, event.Threshold)
+	}
+	for i := previous - 1; i >= level; i-- {
+		event.Threshold = service.thresholds[i]
+		event.Below = false
+		service.publish(event)
+		service.logger.Infof("Available space on %s rose above %d%%",
+			info.MountPoint, event.Threshold)
+	}
+}
+
+// makeEventsHandler streams events to the client as Server-Sent Events.
+// Optional params volume and path limit the stream to events on the
+// volume containing volume, and to events for path and paths under it.
+// Clients resume after an event with the Last-Event-ID header, which
+// browsers send when they reconnect, or the last_event_id param. The
+// stream leaves out events for paths the ACL doesn't let the client
+// see.
+func (service *VolumeService) makeEventsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeResponse(w, &VolumeResponse{
+				ErrorMessage: "Streaming is not supported.",
+				ErrorCode:    CodeInternal,
+			})
+			return
+		}
+		filter := eventFilter{}
+		if path := r.FormValue("path"); path != "" {
+			filter.pathPrefix = filepath.Clean(path)
+		}
+		if volume := r.FormValue("volume"); volume != "" {
+			filter.volume = service.getVolume(volume).MountPoint()
+		}
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.FormValue("last_event_id")
+		}
+		afterID, err := strconv.ParseUint(lastID, 10, 64)
+		if lastID != "" && err != nil {
+			writeResponse(w, &VolumeResponse{
+				ErrorMessage: "Param 'last_event_id' must be an event ID.",
+				ErrorCode:    CodeInvalidParam,
+			})
+			return
+		}
+
+		client := aclName(r)
+		sub, missed := service.events.subscribe(filter, afterID)
+		defer service.events.unsubscribe(sub)
+		service.logger.Infof("[%s] Watching events (volume '%s', path '%s')",
+			clientName(r), filter.volume, filter.pathPrefix)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		for _, event := range missed {
+			if service.eventVisible(client, event) {
+				writeEvent(w, event)
+			}
+		}
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(EventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-sub.events:
+				if !ok {
+					service.logger.Warningf("[%s] Dropped event stream: client fell behind",
+						clientName(r))
+					return
+				}
+				if !service.eventVisible(client, event) {
+					continue
+				}
+				writeEvent(w, event)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes event in the Server-Sent Events format.
+func writeEvent(w http.ResponseWriter, event Event) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
@@ -0,0 +1,201 @@
+package core_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveEvents serves service's HTTP interface on a random port and
+// returns a client for it.
+func serveEvents(t *testing.T, service *core.VolumeService) *core.VolumeClient {
+	server := httptest.NewServer(service.Handler())
+	t.Cleanup(server.Close)
+	return core.NewVolumeClient(server.URL, core.WithClientName("watcher"))
+}
+
+// nextEvent returns the next event from events, failing the test if
+// none arrives in time.
+func nextEvent(t *testing.T, events <-chan core.Event) core.Event {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "event channel closed")
+		return event
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "no event")
+	}
+	return core.Event{}
+}
+
+func TestWatch(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	require.Nil(t, service.SetThresholds([]int{50, 20}))
+	client := serveEvents(t, service)
+	path := filepath.Join(os.TempDir(), "watch_file")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := client.Watch(ctx)
+	require.Nil(t, err)
+
+	id, err := service.AddReservation("ingest", path, 6000, 0)
+	require.Nil(t, err)
+	event := nextEvent(t, events)
+	assert.Equal(t, core.EventReserve, event.Type)
+	assert.Equal(t, id, event.ReservationID)
+	assert.Equal(t, path, event.Path)
+	assert.Equal(t, "ingest", event.Client)
+	assert.EqualValues(t, 6000, event.Bytes)
+	assert.NotEmpty(t, event.Volume)
+	assert.False(t, event.Time.IsZero())
+	firstID := event.ID
+
+	event = nextEvent(t, events)
+	assert.Equal(t, core.EventThreshold, event.Type)
+	assert.Equal(t, 50, event.Threshold)
+	assert.True(t, event.Below)
+	assert.EqualValues(t, 4000, event.AvailableBytes)
+	assert.EqualValues(t, 10000, event.TotalBytes)
+	assert.Equal(t, firstID+1, event.ID)
+
+	_, err = service.AddReservation("ingest", path, 5000, 0)
+	require.NotNil(t, err)
+	event = nextEvent(t, events)
+	assert.Equal(t, core.EventDeny, event.Type)
+	assert.Equal(t, core.CodeInsufficientSpace, event.ErrorCode)
+	assert.EqualValues(t, 5000, event.Bytes)
+	assert.NotEmpty(t, event.Message)
+
+	require.True(t, service.ReleaseID(id))
+	event = nextEvent(t, events)
+	assert.Equal(t, core.EventRelease, event.Type)
+	assert.Equal(t, id, event.ReservationID)
+	event = nextEvent(t, events)
+	assert.Equal(t, core.EventThreshold, event.Type)
+	assert.Equal(t, 50, event.Threshold)
+	assert.False(t, event.Below)
+
+	// Background writes cross thresholds, too, and are noticed when
+	// the service reaps expired leases.
+	now := time.Now()
+	service.SetClock(func() time.Time { return now })
+	require.Nil(t, service.ReserveWithLease(path, 1000, time.Minute))
+	event = nextEvent(t, events)
+	assert.Equal(t, core.EventReserve, event.Type)
+	provider.Consume("", 8500)
+	now = now.Add(2 * time.Minute)
+	service.ReapExpired()
+	event = nextEvent(t, events)
+	assert.Equal(t, core.EventExpire, event.Type)
+	assert.EqualValues(t, 1000, event.Bytes)
+	for _, threshold := range []int{50, 20} {
+		event = nextEvent(t, events)
+		assert.Equal(t, core.EventThreshold, event.Type)
+		assert.Equal(t, threshold, event.Threshold)
+		assert.True(t, event.Below)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchFilters(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	client := serveEvents(t, service)
+	dir := filepath.Join(os.TempDir(), "watch_filters")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.Nil(t, service.Reserve(filepath.Join(dir, "a", "file"), 100))
+	require.Nil(t, service.Reserve(filepath.Join(dir, "b", "file"), 200))
+	require.Nil(t, service.Reserve(filepath.Join(dir, "a", "other"), 300))
+
+	// Resume from the beginning, but only under dir/a.
+	events, err := client.Watch(ctx, core.WatchPath(filepath.Join(dir, "a")), core.WatchAfter(1),
+		core.WatchVolume(dir))
+	require.Nil(t, err)
+	event := nextEvent(t, events)
+	assert.EqualValues(t, 3, event.ID)
+	assert.EqualValues(t, 300, event.Bytes)
+
+	// dir/a-old starts with dir/a, but isn't under it.
+	require.Nil(t, service.Reserve(filepath.Join(dir, "a-old", "file"), 400))
+	service.Release(filepath.Join(dir, "b", "file"))
+	service.Release(filepath.Join(dir, "a", "file"))
+	event = nextEvent(t, events)
+	assert.Equal(t, core.EventRelease, event.Type)
+	assert.Equal(t, filepath.Join(dir, "a", "file"), event.Path)
+	assert.EqualValues(t, 6, event.ID)
+
+	_, err = client.Watch(ctx, func(params url.Values) {
+		params.Set("last_event_id", "latest")
+	})
+	var serviceErr *core.ServiceError
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, core.CodeInvalidParam, serviceErr.Code)
+}
+
+func TestEventStreamFormat(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	path := filepath.Join(os.TempDir(), "event_stream")
+	require.Nil(t, service.Reserve(path, 100))
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events/", nil)
+	require.Nil(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	service.Release(path)
+	scanner := bufio.NewScanner(resp.Body)
+	lines := make([]string, 0)
+	for len(lines) < 3 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "id: 2", lines[0])
+	assert.Equal(t, "event: release", lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], `data: {"ID":2,"Type":"release"`), lines[2])
+}
+
+func TestWatchReconnects(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := core.NewVolumeClient(server.URL)
+	path := filepath.Join(os.TempDir(), "watch_reconnects")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := client.Watch(ctx)
+	require.Nil(t, err)
+
+	require.Nil(t, service.Reserve(path, 100))
+	assert.EqualValues(t, 1, nextEvent(t, events).ID)
+
+	// Events that happen while the client is disconnected arrive
+	// after it reconnects.
+	server.CloseClientConnections()
+	service.Release(path)
+	event := nextEvent(t, events)
+	assert.EqualValues(t, 2, event.ID)
+	assert.Equal(t, core.EventRelease, event.Type)
+}
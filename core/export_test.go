@@ -0,0 +1,4 @@
+package core
+
+// ListenUnix exposes listenUnix to the tests in package core_test.
+var ListenUnix = listenUnix
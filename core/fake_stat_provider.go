@@ -0,0 +1,104 @@
+package core
+
+import (
+	"sync"
+)
+
+// FakeStatProvider is an in-memory StatProvider for testing. It reports
+// the same stats for every path, unless you set stats for a specific
+// mountpoint with SetStats. Tests can call Consume and Reclaim to
+// simulate other processes filling up and freeing space on the disk.
+type FakeStatProvider struct {
+	mutex        sync.Mutex
+	defaultStats VolumeStats
+	stats        map[string]VolumeStats
+	err          error
+}
+
+// NewFakeStatProvider returns a FakeStatProvider for an empty disk
+// of totalBytes.
+func NewFakeStatProvider(totalBytes uint64) *FakeStatProvider {
+	return &FakeStatProvider{
+		defaultStats: VolumeStats{
+			TotalBytes:     totalBytes,
+			FreeBytes:      totalBytes,
+			AvailableBytes: totalBytes,
+			TotalInodes:    1000000,
+			FreeInodes:     1000000,
+		},
+		stats: make(map[string]VolumeStats),
+	}
+}
+
+// Stat returns the stats for path, or the error set with SetError.
+func (provider *FakeStatProvider) Stat(path string) (VolumeStats, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.err != nil {
+		return VolumeStats{}, provider.err
+	}
+	if stats, ok := provider.stats[path]; ok {
+		return stats, nil
+	}
+	return provider.defaultStats, nil
+}
+
+// SetStats sets the stats for the mountpoint at path. If path is
+// empty, this sets the stats for every path that doesn't have its own.
+func (provider *FakeStatProvider) SetStats(path string, stats VolumeStats) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if path == "" {
+		provider.defaultStats = stats
+	} else {
+		provider.stats[path] = stats
+	}
+}
+
+// SetError makes Stat fail with err. Pass nil to make it succeed again.
+func (provider *FakeStatProvider) SetError(err error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.err = err
+}
+
+// Consume simulates another process writing numBytes to the disk
+// mounted at path. If path is empty, it applies to every disk that
+// doesn't have its own stats.
+func (provider *FakeStatProvider) Consume(path string, numBytes uint64) {
+	provider.adjust(path, func(stats *VolumeStats) {
+		stats.FreeBytes = subSaturating(stats.FreeBytes, numBytes)
+		stats.AvailableBytes = subSaturating(stats.AvailableBytes, numBytes)
+	})
+}
+
+// Reclaim simulates another process deleting numBytes from the disk
+// mounted at path. If path is empty, it applies to every disk that
+// doesn't have its own stats.
+func (provider *FakeStatProvider) Reclaim(path string, numBytes uint64) {
+	provider.adjust(path, func(stats *VolumeStats) {
+		stats.FreeBytes = addSaturating(stats.FreeBytes, numBytes)
+		stats.AvailableBytes = addSaturating(stats.AvailableBytes, numBytes)
+		if stats.FreeBytes > stats.TotalBytes {
+			stats.FreeBytes = stats.TotalBytes
+		}
+		if stats.AvailableBytes > stats.TotalBytes {
+			stats.AvailableBytes = stats.TotalBytes
+		}
+	})
+}
+
+func (provider *FakeStatProvider) adjust(path string, change func(*VolumeStats)) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if path == "" {
+		change(&provider.defaultStats)
+		return
+	}
+	stats, ok := provider.stats[path]
+	if !ok {
+		stats = provider.defaultStats
+	}
+	change(&stats)
+	provider.stats[path] = stats
+}
@@ -0,0 +1,493 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diamondap/vreserve/rpc"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ErrorDomain is the domain of the errdetails.ErrorInfo attached to
+// gRPC errors from the VolumeService. Its Reason is the ErrorCode.
+const ErrorDomain = "vreserve"
+
+// DefaultWatchInterval is how often a Watch call checks for changes in
+// the free space the OS reports, if the client doesn't say. Changes to
+// the ledger are sent as they happen.
+const DefaultWatchInterval = time.Minute
+
+// rpcCodes maps ErrorCodes to gRPC status codes.
+var rpcCodes = map[ErrorCode]codes.Code{
+	CodeInsufficientSpace: codes.ResourceExhausted,
+	CodeQuotaExceeded:     codes.PermissionDenied,
+	CodeInvalidParam:      codes.InvalidArgument,
+	CodeVolumeUnavailable: codes.Unavailable,
+	CodeNotFound:          codes.NotFound,
+	CodeMethodNotAllowed:  codes.Unimplemented,
+	CodeUnauthorized:      codes.Unauthenticated,
+	CodeForbidden:         codes.PermissionDenied,
+	CodeAccessDenied:      codes.PermissionDenied,
+	CodeRateLimited:       codes.ResourceExhausted,
+	CodeCanceled:          codes.Canceled,
+	CodeInternal:          codes.Internal,
+}
+
+// rpcRoles are the roles each gRPC method requires when the service
+// has tokens. Methods that aren't listed require RoleAdmin, and Ping
+// requires nothing.
+var rpcRoles = map[string]Role{
+	"Ping":    "",
+	"Reserve": RoleReserver,
+	"Release": RoleReserver,
+	"Renew":   RoleReserver,
+	"Report":  RoleReader,
+	"Volumes": RoleReader,
+	"Watch":   RoleReader,
+}
+
+// NewGRPCServer returns a gRPC server that serves the VolumeService's
+// gRPC interface (see rpc/vreserve.proto), sharing its ledger with the
+// HTTP interface. Use this to serve on a listener of your own, or
+// ServeGRPC to listen on a port. If the service has a TLS config (see
+// UseTLS), the server uses it.
+func (service *VolumeService) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	if service.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(service.tlsConfig)))
+	}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(service.timedRPC, service.authorizedRPC),
+		grpc.ChainStreamInterceptor(service.authorizedStream, service.loggedStream))
+	server := grpc.NewServer(opts...)
+	rpc.RegisterVolumeServiceServer(server, &grpcServer{service: service})
+	return server
+}
+
+// ServeGRPC serves the gRPC interface on port, on the same host as
+// the HTTP interface. Serve must also be running, to reap expired
+// leases. ServeGRPC returns only if the server fails.
+func (service *VolumeService) ServeGRPC(port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", service.host, port))
+	if err != nil {
+		return err
+	}
+	return service.NewGRPCServer().Serve(listener)
+}
+
+// timedRPC records how long each unary call takes in the latency
+// histogram, under handler "grpc_<method>".
+func (service *VolumeService) timedRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	service.metrics.observe("grpc_"+strings.ToLower(path.Base(info.FullMethod)), time.Since(start))
+	return resp, err
+}
+
+// authorizeRPC authenticates the client that made a call to method,
+// with the bearer token in the call's "authorization" metadata, and
+// checks that it may make the call. It returns ctx with the client's
+// token.
+func (service *VolumeService) authorizeRPC(ctx context.Context, method string) (context.Context, error) {
+	role, ok := rpcRoles[path.Base(method)]
+	if !ok {
+		role = RoleAdmin
+	}
+	if role == "" {
+		return ctx, nil
+	}
+	secret := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			secret = bearerToken(values[0])
+		}
+	}
+	ctx, err := service.authenticate(ctx, secret)
+	if err == nil {
+		err = service.authorize(ctx, role)
+	}
+	if err != nil {
+		service.logger.Warningf("[%s] Denied %s: %v", rpcClientName(ctx), method, err)
+		return ctx, rpcError(err, 0)
+	}
+	return ctx, nil
+}
+
+// authorizedRPC rejects unary calls the client isn't allowed to make.
+func (service *VolumeService) authorizedRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := service.authorizeRPC(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authorizedStream rejects streaming calls the client isn't allowed to
+// make.
+func (service *VolumeService) authorizedStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := service.authorizeRPC(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// contextStream is a grpc.ServerStream with a different context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *contextStream) Context() context.Context {
+	return stream.ctx
+}
+
+// loggedStream logs the start and end of streaming calls, whose
+// durations aren't meaningful latencies.
+func (service *VolumeService) loggedStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	client := rpcClientName(stream.Context())
+	service.logger.Infof("[%s] Started %s", client, info.FullMethod)
+	err := handler(srv, stream)
+	service.logger.Infof("[%s] Finished %s", client, info.FullMethod)
+	return err
+}
+
+// grpcServer implements rpc.VolumeServiceServer on top of a
+// VolumeService.
+type grpcServer struct {
+	rpc.UnimplementedVolumeServiceServer
+	service *VolumeService
+}
+
+func (s *grpcServer) Ping(ctx context.Context, req *rpc.PingRequest) (*rpc.PingResponse, error) {
+	return &rpc.PingResponse{}, nil
+}
+
+func (s *grpcServer) Reserve(ctx context.Context, req *rpc.ReserveRequest) (*rpc.ReserveResponse, error) {
+	lease := req.GetLease().AsDuration()
+	wait := req.GetWait().AsDuration()
+	switch {
+	case req.Path == "":
+		return nil, rpcError(paramError("path is required"), 0)
+	case req.Bytes < 1:
+		return nil, rpcError(paramError("bytes must be greater than zero"), 0)
+	case lease < 0 || wait < 0:
+		return nil, rpcError(paramError("lease and wait cannot be negative"), 0)
+	}
+	client := rpcClientName(ctx)
+	volume := s.service.getVolume(req.Path)
+	if err := s.service.checkACL(rpcACLName(ctx), OpReserve, req.Path); err != nil {
+		s.service.auditReserve(client, rpcRemoteAddr(ctx), volume, req.Path, req.Bytes, "", err)
+		return nil, rpcError(err, 0)
+	}
+	var id string
+	var position int
+	var err error
+	if wait > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		id, position, err = s.service.reserveWait(waitCtx, nil, client, nil, volume,
+			req.Path, req.Bytes, lease, false)
+		cancel()
+	} else {
+		id, err = s.service.reserve(nil, client, nil, volume, req.Path, req.Bytes, lease, false)
+	}
+	s.service.auditReserve(client, rpcRemoteAddr(ctx), volume, req.Path, req.Bytes, id, err)
+	if err != nil {
+		s.service.logger.Warningf("[%s] Could not reserve %d bytes for file '%s': %v",
+			client, req.Bytes, req.Path, err)
+		return nil, rpcError(err, position)
+	}
+	s.service.logger.Infof("[%s] Reserved %d bytes for %s (%s)", client, req.Bytes, req.Path, id)
+	reservation := Reservation{ID: id, Path: req.Path, Bytes: req.Bytes, Client: client}
+	if found, ok := volume.Reservation(id); ok {
+		reservation = found
+	}
+	return &rpc.ReserveResponse{
+		Reservation:   rpcReservation(reservation),
+		QueuePosition: int32(position),
+	}, nil
+}
+
+func (s *grpcServer) Release(ctx context.Context, req *rpc.ReleaseRequest) (*rpc.ReleaseResponse, error) {
+	client := rpcClientName(ctx)
+	id, path := req.GetId(), req.GetPath()
+	if id == "" && path == "" {
+		return nil, rpcError(paramError("path or id is required"), 0)
+	}
+	target := id
+	if target == "" {
+		target = path
+	}
+	volume, released, err := s.service.releaseAs(ctx, rpcACLName(ctx), id, path)
+	s.service.auditRelease(client, rpcRemoteAddr(ctx), volume, id, path, released, err)
+	if err != nil {
+		s.service.logger.Warningf("[%s] Could not release %s: %v", client, target, err)
+		return nil, rpcError(err, 0)
+	}
+	s.service.logger.Infof("[%s] Released %s", client, target)
+	return &rpc.ReleaseResponse{}, nil
+}
+
+func (s *grpcServer) Renew(ctx context.Context, req *rpc.RenewRequest) (*rpc.RenewResponse, error) {
+	lease := req.GetLease().AsDuration()
+	if lease < 0 {
+		return nil, rpcError(paramError("lease cannot be negative"), 0)
+	}
+	client := rpcClientName(ctx)
+	var volume *Volume
+	var err error
+	switch target := req.Target.(type) {
+	case *rpc.RenewRequest_Id:
+		volume, err = s.service.renewAs(ctx, rpcACLName(ctx), target.Id, "", lease)
+	case *rpc.RenewRequest_Path:
+		if target.Path == "" {
+			return nil, rpcError(paramError("path or id is required"), 0)
+		}
+		volume, err = s.service.renewAs(ctx, rpcACLName(ctx), "", target.Path, lease)
+	default:
+		return nil, rpcError(paramError("path or id is required"), 0)
+	}
+	s.service.auditRenew(client, rpcRemoteAddr(ctx), volume, req.GetId(), req.GetPath(), err)
+	if err != nil {
+		return nil, rpcError(err, 0)
+	}
+	return &rpc.RenewResponse{}, nil
+}
+
+func (s *grpcServer) Report(ctx context.Context, req *rpc.ReportRequest) (*rpc.ReportResponse, error) {
+	if req.Path == "" {
+		return nil, rpcError(paramError("path is required"), 0)
+	}
+	client := rpcACLName(ctx)
+	if err := s.service.checkACL(client, OpReport, req.Path); err != nil {
+		return nil, rpcError(err, 0)
+	}
+	report := &VolumeResponse{}
+	s.service.report(client, req.Path, report)
+	resp := &rpc.ReportResponse{MountPoints: report.MountPoints}
+	for _, reservation := range report.Reservations {
+		resp.Reservations = append(resp.Reservations, rpcReservation(reservation))
+	}
+	for _, usage := range report.Quotas {
+		resp.Quotas = append(resp.Quotas, &rpc.QuotaUsage{
+			Client: usage.Client,
+			Volume: usage.Volume,
+			Bytes:  usage.Bytes,
+			Used:   usage.Used,
+		})
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Volumes(ctx context.Context, req *rpc.VolumesRequest) (*rpc.VolumesResponse, error) {
+	return rpcVolumes(s.service.Volumes()), nil
+}
+
+func (s *grpcServer) Watch(req *rpc.WatchRequest, stream rpc.VolumeService_WatchServer) error {
+	interval := req.GetInterval().AsDuration()
+	if interval < 0 {
+		return rpcError(paramError("interval cannot be negative"), 0)
+	}
+	if interval == 0 {
+		interval = DefaultWatchInterval
+	}
+	snapshot := s.service.Volumes
+	filter := eventFilter{}
+	if req.Path != "" {
+		volume := s.service.getVolume(req.Path)
+		snapshot = func() []VolumeInfo { return []VolumeInfo{volume.Info()} }
+		filter.volume = volume.MountPoint()
+	}
+	// Every change to the ledger publishes an event, so the events tell
+	// us when to send a new summary. The ticker catches changes in free
+	// space that the ledger doesn't know about.
+	sub, _ := s.service.events.subscribe(filter, 0)
+	defer func() { s.service.events.unsubscribe(sub) }()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last *rpc.VolumesResponse
+	for {
+		current := rpcVolumes(snapshot())
+		if last == nil || !proto.Equal(current, last) {
+			if err := stream.Send(current); err != nil {
+				return err
+			}
+			last = current
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case _, ok := <-sub.events:
+			if !ok {
+				// We fell behind. The summary we're about to send
+				// covers whatever we missed.
+				sub, _ = s.service.events.subscribe(filter, 0)
+			}
+			drainEvents(sub)
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainEvents discards the events waiting for sub, since one summary
+// covers them all.
+func drainEvents(sub *subscriber) {
+	for {
+		select {
+		case _, ok := <-sub.events:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// rpcClientName returns the identity of the gRPC client: the name of
+// its token if it authenticated with one, or else the subject of its
+// verified TLS client certificate, or else the value of the
+// ClientHeader in the call's metadata if there is one, or else the
+// client's IP address.
+func rpcClientName(ctx context.Context) string {
+	if token := callerToken(ctx); token != nil {
+		return token.Name
+	}
+	p, _ := peer.FromContext(ctx)
+	if p != nil {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if name := certName(&info.State); name != "" {
+				return name
+			}
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if names := md.Get(ClientHeader); len(names) > 0 && names[0] != "" {
+			return names[0]
+		}
+	}
+	if p != nil && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			return p.Addr.String()
+		}
+		return host
+	}
+	return ""
+}
+
+// rpcACLName returns the identity the ACL knows the gRPC client by:
+// the name of its token if it authenticated with one, or else the
+// subject of its verified TLS client certificate, or else AnyClient.
+// Names in the call's metadata prove nothing, as with aclName.
+func rpcACLName(ctx context.Context) string {
+	if token := callerToken(ctx); token != nil {
+		return token.Name
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if name := certName(&info.State); name != "" {
+				return name
+			}
+		}
+	}
+	return AnyClient
+}
+
+// rpcRemoteAddr returns the address of the gRPC client, for the audit
+// log.
+func rpcRemoteAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// rpcError converts an error from the VolumeService to a gRPC status
+// error, with the ErrorCode (and queue position, if any) attached as
+// an errdetails.ErrorInfo.
+func rpcError(err error, position int) error {
+	code := errorCode(err)
+	rpcCode, ok := rpcCodes[code]
+	if !ok {
+		rpcCode = codes.Internal
+	}
+	st := status.New(rpcCode, err.Error())
+	info := &errdetails.ErrorInfo{Reason: string(code), Domain: ErrorDomain}
+	if position > 0 {
+		info.Metadata = map[string]string{"queue_position": strconv.Itoa(position)}
+	}
+	if detailed, detailErr := st.WithDetails(info); detailErr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// RPCErrorCode returns the ErrorCode of an error from a gRPC call to
+// the VolumeService, and the request's position in the queue if it
+// gave up waiting for space. It returns CodeInternal for errors that
+// didn't come from the service, such as connection failures.
+func RPCErrorCode(err error) (ErrorCode, int) {
+	for _, detail := range status.Convert(err).Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != ErrorDomain {
+			continue
+		}
+		position, _ := strconv.Atoi(info.Metadata["queue_position"])
+		return ErrorCode(info.Reason), position
+	}
+	return CodeInternal, 0
+}
+
+func rpcReservation(reservation Reservation) *rpc.Reservation {
+	r := &rpc.Reservation{
+		Id:     reservation.ID,
+		Path:   reservation.Path,
+		Bytes:  reservation.Bytes,
+		Client: reservation.Client,
+	}
+	if reservation.Expires != nil {
+		r.Expires = timestamppb.New(*reservation.Expires)
+	}
+	return r
+}
+
+func rpcVolumes(infos []VolumeInfo) *rpc.VolumesResponse {
+	resp := &rpc.VolumesResponse{}
+	for _, info := range infos {
+		volume := &rpc.Volume{
+			MountPoint:     info.MountPoint,
+			MountPoints:    info.MountPoints,
+			Device:         info.Device,
+			FsType:         info.FsType,
+			TotalBytes:     info.TotalBytes,
+			FreeBytes:      info.FreeBytes,
+			ClaimedBytes:   info.ClaimedBytes,
+			AvailableBytes: info.AvailableBytes,
+			Reservations:   int32(info.Reservations),
+			QueueLength:    int32(info.QueueLength),
+			Error:          info.Error,
+		}
+		if info.BackgroundBytesPerSecond != 0 {
+			volume.BackgroundBytesPerSecond = proto.Float64(info.BackgroundBytesPerSecond)
+		}
+		if info.TimeToFull > 0 || info.Full {
+			volume.TimeToFull = durationpb.New(time.Duration(info.TimeToFull))
+		}
+		resp.Volumes = append(resp.Volumes, volume)
+	}
+	return resp
+}
@@ -0,0 +1,195 @@
+package core_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/diamondap/vreserve/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// newGRPCClient serves service's gRPC interface on a random port and
+// returns a client connected to it. The server stops gracefully when
+// the test ends, so no handler outlives the test.
+func newGRPCClient(t *testing.T, service *core.VolumeService) rpc.VolumeServiceClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := service.NewGRPCServer()
+	go server.Serve(listener)
+	t.Cleanup(server.GracefulStop)
+	conn, err := grpc.NewClient(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return rpc.NewVolumeServiceClient(conn)
+}
+
+func TestGRPCReserveRelease(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	client := newGRPCClient(t, service)
+	path := filepath.Join(os.TempDir(), "grpc_file")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), core.ClientHeader, "grpc_test")
+
+	_, err := client.Ping(ctx, &rpc.PingRequest{})
+	require.Nil(t, err)
+
+	resp, err := client.Reserve(ctx, &rpc.ReserveRequest{
+		Path:  path,
+		Bytes: 3000,
+		Lease: durationpb.New(time.Minute),
+	})
+	require.Nil(t, err)
+	reservation := resp.Reservation
+	assert.Regexp(t, "^[0-9a-f]{16}$", reservation.Id)
+	assert.Equal(t, path, reservation.Path)
+	assert.EqualValues(t, 3000, reservation.Bytes)
+	assert.Equal(t, "grpc_test", reservation.Client)
+	assert.NotNil(t, reservation.Expires)
+
+	// The HTTP side sees the same ledger.
+	reservations := service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, reservation.Id, reservations[0].ID)
+
+	report, err := client.Report(ctx, &rpc.ReportRequest{Path: path})
+	require.Nil(t, err)
+	require.Len(t, report.Reservations, 1)
+	assert.Equal(t, reservation.Id, report.Reservations[0].Id)
+
+	volumes, err := client.Volumes(ctx, &rpc.VolumesRequest{})
+	require.Nil(t, err)
+	require.Len(t, volumes.Volumes, 1)
+	assert.EqualValues(t, 3000, volumes.Volumes[0].ClaimedBytes)
+	assert.EqualValues(t, 7000, volumes.Volumes[0].AvailableBytes)
+
+	_, err = client.Renew(ctx, &rpc.RenewRequest{Target: &rpc.RenewRequest_Id{Id: reservation.Id}})
+	assert.Nil(t, err)
+	_, err = client.Release(ctx, &rpc.ReleaseRequest{Target: &rpc.ReleaseRequest_Id{Id: reservation.Id}})
+	assert.Nil(t, err)
+	assert.Empty(t, service.ReservationList(path))
+
+	_, err = client.Release(ctx, &rpc.ReleaseRequest{Target: &rpc.ReleaseRequest_Id{Id: reservation.Id}})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	code, _ := core.RPCErrorCode(err)
+	assert.Equal(t, core.CodeNotFound, code)
+}
+
+func TestGRPCErrors(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	client := newGRPCClient(t, service)
+	path := filepath.Join(os.TempDir(), "grpc_errors")
+	ctx := context.Background()
+
+	_, err := client.Reserve(ctx, &rpc.ReserveRequest{Bytes: 100})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Release(ctx, &rpc.ReleaseRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.Reserve(ctx, &rpc.ReserveRequest{Path: path, Bytes: 20000})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	code, _ := core.RPCErrorCode(err)
+	assert.Equal(t, core.CodeInsufficientSpace, code)
+
+	_, err = client.Reserve(ctx, &rpc.ReserveRequest{
+		Path:  path,
+		Bytes: 20000,
+		Wait:  durationpb.New(50 * time.Millisecond),
+	})
+	code, position := core.RPCErrorCode(err)
+	assert.Equal(t, core.CodeInsufficientSpace, code)
+	assert.Equal(t, 1, position)
+
+	require.Nil(t, service.SetQuotas([]core.Quota{{Client: "*", Bytes: 10}}))
+	_, err = client.Reserve(ctx, &rpc.ReserveRequest{Path: path, Bytes: 100})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	code, _ = core.RPCErrorCode(err)
+	assert.Equal(t, core.CodeQuotaExceeded, code)
+}
+
+func TestGRPCWatch(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	client := newGRPCClient(t, service)
+	path := filepath.Join(os.TempDir(), "grpc_watch")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Watch(ctx, &rpc.WatchRequest{Path: path})
+	require.Nil(t, err)
+
+	// We get the current state right away, then each change to the
+	// ledger as it happens.
+	resp, err := stream.Recv()
+	require.Nil(t, err)
+	require.Len(t, resp.Volumes, 1)
+	assert.EqualValues(t, 0, resp.Volumes[0].ClaimedBytes)
+
+	require.Nil(t, service.Reserve(path, 1234))
+	resp, err = stream.Recv()
+	require.Nil(t, err)
+	assert.EqualValues(t, 1234, resp.Volumes[0].ClaimedBytes)
+	assert.EqualValues(t, 1, resp.Volumes[0].Reservations)
+
+	service.Release(path)
+	resp, err = stream.Recv()
+	require.Nil(t, err)
+	assert.EqualValues(t, 0, resp.Volumes[0].ClaimedBytes)
+
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+
+	// Changes in free space that don't touch the ledger show up at
+	// the interval.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream, err = client.Watch(ctx, &rpc.WatchRequest{
+		Path:     path,
+		Interval: durationpb.New(10 * time.Millisecond),
+	})
+	require.Nil(t, err)
+	resp, err = stream.Recv()
+	require.Nil(t, err)
+	assert.EqualValues(t, 10000, resp.Volumes[0].FreeBytes)
+	provider.Consume("", 4000)
+	resp, err = stream.Recv()
+	require.Nil(t, err)
+	assert.EqualValues(t, 6000, resp.Volumes[0].FreeBytes)
+}
+
+func TestGRPCVolumesConsumption(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	service.SetClock(func() time.Time { return now })
+	client := newGRPCClient(t, service)
+	service.Reservations(filepath.Join(os.TempDir(), "grpc_consumption"))
+
+	for i := 0; i < 3; i++ {
+		service.SampleVolumes()
+		now = now.Add(time.Minute)
+		provider.Consume("", 6000)
+	}
+	resp, err := client.Volumes(context.Background(), &rpc.VolumesRequest{})
+	require.Nil(t, err)
+	require.Len(t, resp.Volumes, 1)
+	volume := resp.Volumes[0]
+	require.NotNil(t, volume.BackgroundBytesPerSecond)
+	assert.InDelta(t, 100, volume.GetBackgroundBytesPerSecond(), 0.01)
+	require.NotNil(t, volume.TimeToFull)
+	assert.Equal(t, service.Volumes()[0].TimeToFull, core.Duration(volume.TimeToFull.AsDuration()))
+}
@@ -0,0 +1,440 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryTier is one resolution at which the History keeps samples:
+// the average of the samples in each Step, for the last Slots steps.
+type HistoryTier struct {
+	Step  time.Duration
+	Slots int
+}
+
+// HistoryTiers are the resolutions at which the History keeps
+// samples, finest first. Each tier must cover more time than the one
+// before it. Changing them discards existing history.
+var HistoryTiers = []HistoryTier{
+	{Step: time.Minute, Slots: 24 * 60},
+	{Step: 10 * time.Minute, Slots: 8 * 24 * 6},
+	{Step: time.Hour, Slots: 90 * 24},
+}
+
+// DefaultHistoryRange is how far back a history query goes if it
+// doesn't say.
+const DefaultHistoryRange = 24 * time.Hour
+
+// historyMagic starts every history file.
+const historyMagic = "VRHIST1\n"
+
+// historySlotSize is the size of a slot on disk: the start of its
+// step in Unix nanoseconds, the number of samples in it, and the sums
+// of their claimed and free bytes.
+const historySlotSize = 32
+
+// historySlot is one step of a tier.
+type historySlot struct {
+	start   int64
+	count   uint64
+	claimed uint64
+	free    uint64
+}
+
+// HistoryPoint is the average claimed and free bytes on a volume over
+// the step that starts at Time. FreeBytes is what the OS reports as
+// available to ordinary processes, as in VolumeInfo.
+type HistoryPoint struct {
+	Time         time.Time
+	ClaimedBytes uint64
+	FreeBytes    uint64
+}
+
+// VolumeHistory is how a volume's claimed and free bytes changed over
+// time, one HistoryPoint per step of StepSeconds. Steps without
+// samples, when the service wasn't running, are left out.
+type VolumeHistory struct {
+	MountPoint  string
+	StepSeconds uint64
+	Points      []HistoryPoint
+}
+
+// History keeps samples of each volume's claimed and free bytes in a
+// directory, in one file per volume. Each file is a set of ring
+// buffers, one for each of the HistoryTiers, so it never grows: once
+// a tier is full, each new step overwrites the oldest. Every sample
+// goes into every tier, so the coarser tiers are downsampled versions
+// of the finer ones that go back further.
+type History struct {
+	dir   string
+	tiers []HistoryTier
+	mutex sync.Mutex
+	files map[string]*os.File
+}
+
+// OpenHistory opens (or creates) the history in directory dir.
+func OpenHistory(dir string) (*History, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &History{
+		dir:   dir,
+		tiers: HistoryTiers,
+		files: make(map[string]*os.File),
+	}, nil
+}
+
+// Dir returns the directory containing the history.
+func (history *History) Dir() string {
+	return history.dir
+}
+
+// Record adds a sample of the claimed and free bytes on the volume
+// mounted at mountPoint, taken at when, to every tier.
+func (history *History) Record(mountPoint string, when time.Time, claimed, free uint64) error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	file, err := history.open(mountPoint)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, historySlotSize)
+	for i, tier := range history.tiers {
+		start := when.Truncate(tier.Step).UnixNano()
+		offset := history.slotOffset(i, start)
+		if _, err = file.ReadAt(buf, offset); err != nil {
+			return err
+		}
+		slot := decodeSlot(buf)
+		if slot.start != start {
+			slot = historySlot{start: start}
+		}
+		slot.count++
+		slot.claimed = addSaturating(slot.claimed, claimed)
+		slot.free = addSaturating(slot.free, free)
+		encodeSlot(buf, slot)
+		if _, err = file.WriteAt(buf, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Series returns the average claimed and free bytes on the volume
+// mounted at mountPoint, in steps of step, from from until to. It
+// reads the coarsest tier that's at least as fine as step and still
+// goes back to from, as of now, or the finest tier that goes back to
+// from, if none are that fine. The step is rounded up to a multiple of
+// that tier's step, which Series returns along with the points.
+func (history *History) Series(mountPoint string, from, to, now time.Time, step time.Duration) ([]HistoryPoint, time.Duration, error) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	tierIndex := len(history.tiers) - 1
+	for i, tier := range history.tiers {
+		if now.Sub(from) <= tier.Step*time.Duration(tier.Slots) {
+			tierIndex = i
+			break
+		}
+	}
+	for i := tierIndex + 1; i < len(history.tiers); i++ {
+		if history.tiers[i].Step <= step {
+			tierIndex = i
+		}
+	}
+	tier := history.tiers[tierIndex]
+	if step < tier.Step {
+		step = tier.Step
+	}
+	step = (step + tier.Step - 1) / tier.Step * tier.Step
+	if oldest := now.Add(-tier.Step * time.Duration(tier.Slots)); from.Before(oldest) {
+		from = oldest
+	}
+	if latest := now.Add(tier.Step); to.After(latest) {
+		to = latest
+	}
+	points := make([]HistoryPoint, 0)
+
+	file, err := history.open(mountPoint)
+	if err != nil {
+		return points, step, err
+	}
+	data := make([]byte, tier.Slots*historySlotSize)
+	if _, err = file.ReadAt(data, history.tierOffset(tierIndex)); err != nil {
+		return points, step, err
+	}
+	var bucket historySlot
+	flush := func() {
+		if bucket.count > 0 {
+			points = append(points, HistoryPoint{
+				Time:         time.Unix(0, bucket.start).UTC(),
+				ClaimedBytes: bucket.claimed / bucket.count,
+				FreeBytes:    bucket.free / bucket.count,
+			})
+		}
+	}
+	for t := from.Truncate(tier.Step); t.Before(to); t = t.Add(tier.Step) {
+		bucketStart := t.Truncate(step).UnixNano()
+		if bucketStart != bucket.start {
+			flush()
+			bucket = historySlot{start: bucketStart}
+		}
+		offset := history.slotIndexOffset(tierIndex, t.UnixNano())
+		slot := decodeSlot(data[offset : offset+historySlotSize])
+		if slot.start != t.UnixNano() || slot.count == 0 {
+			continue
+		}
+		bucket.count += slot.count
+		bucket.claimed = addSaturating(bucket.claimed, slot.claimed)
+		bucket.free = addSaturating(bucket.free, slot.free)
+	}
+	flush()
+	return points, step, nil
+}
+
+// Close closes the history's files.
+func (history *History) Close() error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	var err error
+	for mountPoint, file := range history.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		delete(history.files, mountPoint)
+	}
+	return err
+}
+
+// open returns the history file for mountPoint, creating it if it
+// doesn't exist. If it has a different layout, because the tiers have
+// changed, open starts it over. Caller must hold the mutex.
+func (history *History) open(mountPoint string) (*os.File, error) {
+	if file, ok := history.files[mountPoint]; ok {
+		return file, nil
+	}
+	path := filepath.Join(history.dir, url.PathEscape(mountPoint)+".history")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	header := history.header()
+	existing := make([]byte, len(header))
+	_, err = file.ReadAt(existing, 0)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	if !bytes.Equal(existing, header) {
+		size := history.tierOffset(len(history.tiers))
+		err = file.Truncate(0)
+		if err == nil {
+			err = file.Truncate(size)
+		}
+		if err == nil {
+			_, err = file.WriteAt(header, 0)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	history.files[mountPoint] = file
+	return file, nil
+}
+
+// header returns the header of a history file: the magic string, then
+// the step and number of slots in each tier.
+func (history *History) header() []byte {
+	header := make([]byte, len(historyMagic)+16*len(history.tiers))
+	copy(header, historyMagic)
+	for i, tier := range history.tiers {
+		offset := len(historyMagic) + 16*i
+		binary.LittleEndian.PutUint64(header[offset:], uint64(tier.Step))
+		binary.LittleEndian.PutUint64(header[offset+8:], uint64(tier.Slots))
+	}
+	return header
+}
+
+// tierOffset returns the offset in a history file of the first slot in
+// tier. The offset of the tier after the last is the size of the file.
+func (history *History) tierOffset(tier int) int64 {
+	offset := int64(len(history.header()))
+	for _, earlier := range history.tiers[:tier] {
+		offset += int64(earlier.Slots * historySlotSize)
+	}
+	return offset
+}
+
+// slotOffset returns the offset in a history file of the slot in tier
+// for the step starting at start.
+func (history *History) slotOffset(tier int, start int64) int64 {
+	return history.tierOffset(tier) + history.slotIndexOffset(tier, start)
+}
+
+// slotIndexOffset returns the offset of the slot for the step starting
+// at start, from the beginning of tier.
+func (history *History) slotIndexOffset(tier int, start int64) int64 {
+	step := int64(history.tiers[tier].Step)
+	slots := int64(history.tiers[tier].Slots)
+	index := (start / step) % slots
+	if index < 0 {
+		index += slots
+	}
+	return index * historySlotSize
+}
+
+func decodeSlot(buf []byte) historySlot {
+	return historySlot{
+		start:   int64(binary.LittleEndian.Uint64(buf)),
+		count:   binary.LittleEndian.Uint64(buf[8:]),
+		claimed: binary.LittleEndian.Uint64(buf[16:]),
+		free:    binary.LittleEndian.Uint64(buf[24:]),
+	}
+}
+
+func encodeSlot(buf []byte, slot historySlot) {
+	binary.LittleEndian.PutUint64(buf, uint64(slot.start))
+	binary.LittleEndian.PutUint64(buf[8:], slot.count)
+	binary.LittleEndian.PutUint64(buf[16:], slot.claimed)
+	binary.LittleEndian.PutUint64(buf[24:], slot.free)
+}
+
+// UseHistory records every volume's claimed and free bytes in history
+// every SampleInterval, once the service is serving, and serves the
+// samples at /history/. Close closes the history.
+func (service *VolumeService) UseHistory(history *History) {
+	service.history = history
+}
+
+// VolumeHistory returns the history of the volume containing path,
+// from from until to, in steps of at least step (see History.Series).
+// It returns a notFoundError if the service has no history.
+func (service *VolumeService) VolumeHistory(path string, from, to time.Time, step time.Duration) (*VolumeHistory, error) {
+	if service.history == nil {
+		return nil, notFoundError("the service has no history")
+	}
+	service.ledgerMutex.Lock()
+	now := service.now()
+	service.ledgerMutex.Unlock()
+	mountPoint := service.getVolume(path).MountPoint()
+	points, step, err := service.history.Series(mountPoint, from, to, now, step)
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeHistory{
+		MountPoint:  mountPoint,
+		StepSeconds: uint64(step / time.Second),
+		Points:      points,
+	}, nil
+}
+
+// parseTimeParam parses the RFC 3339 time in the param called name.
+func parseTimeParam(name, value string) (time.Time, error) {
+	when, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return when, paramError(fmt.Sprintf("Param '%s' must be an RFC 3339 time, "+
+			"such as 2024-01-02T15:04:05Z.", name))
+	}
+	return when, nil
+}
+
+// makeHistoryHandler returns the handler for /history/, which takes
+// the volume (any path on it), the from and to times, which default to
+// DefaultHistoryRange ago and now, and the step, in seconds or as a Go
+// duration. It returns the VolumeHistory in History, or as CSV, if the
+// format param is "csv".
+func (service *VolumeService) makeHistoryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := &VolumeResponse{}
+		history, err := service.queryHistory(r)
+		if err != nil {
+			response.Succeeded = false
+			response.ErrorMessage = err.Error()
+			response.ErrorCode = errorCode(err)
+			service.logger.Warningf("[%s] Could not get history: %v", clientName(r), err)
+			writeResponse(w, response)
+			return
+		}
+		service.logger.Infof("[%s] History of %s (%d points)", clientName(r),
+			history.MountPoint, len(history.Points))
+		if r.FormValue("format") == "csv" {
+			writeHistoryCSV(w, history)
+			return
+		}
+		response.Succeeded = true
+		response.History = history
+		writeResponse(w, response)
+	}
+}
+
+// queryHistory returns the history the params of r ask for.
+func (service *VolumeService) queryHistory(r *http.Request) (*VolumeHistory, error) {
+	volume := r.FormValue("volume")
+	if volume == "" {
+		return nil, paramError("Param 'volume' is required.")
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		return nil, paramError("Param 'format' must be json or csv.")
+	}
+	service.ledgerMutex.Lock()
+	to := service.now()
+	service.ledgerMutex.Unlock()
+	var err error
+	if value := r.FormValue("to"); value != "" {
+		if to, err = parseTimeParam("to", value); err != nil {
+			return nil, err
+		}
+	}
+	from := to.Add(-DefaultHistoryRange)
+	if value := r.FormValue("from"); value != "" {
+		if from, err = parseTimeParam("from", value); err != nil {
+			return nil, err
+		}
+	}
+	if !from.Before(to) {
+		return nil, paramError("Param 'from' must be before 'to'.")
+	}
+	var step time.Duration
+	if value := r.FormValue("step"); value != "" {
+		step, err = time.ParseDuration(value)
+		if err != nil {
+			var seconds uint64
+			seconds, err = strconv.ParseUint(value, 10, 32)
+			step = time.Duration(seconds) * time.Second
+		}
+		if err != nil || step <= 0 {
+			return nil, paramError("Param 'step' must be a number of seconds " +
+				"or a duration such as '10m' or '1h'.")
+		}
+	}
+	return service.VolumeHistory(volume, from, to, step)
+}
+
+// writeHistoryCSV writes history as CSV, with a header row.
+func writeHistoryCSV(w http.ResponseWriter, history *VolumeHistory) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q",
+		"history"+strings.ReplaceAll(history.MountPoint, "/", "_")+".csv"))
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "claimed_bytes", "free_bytes"})
+	for _, point := range history.Points {
+		writer.Write([]string{
+			point.Time.Format(time.RFC3339),
+			strconv.FormatUint(point.ClaimedBytes, 10),
+			strconv.FormatUint(point.FreeBytes, 10),
+		})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,150 @@
+package core_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	tiers := core.HistoryTiers
+	defer func() { core.HistoryTiers = tiers }()
+	core.HistoryTiers = []core.HistoryTier{
+		{Step: time.Minute, Slots: 60},
+		{Step: 10 * time.Minute, Slots: 36},
+	}
+	dir := t.TempDir()
+	history, err := core.OpenHistory(dir)
+	require.Nil(t, err)
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// Two samples a minute for three hours.
+	now := start
+	for i := 0; i < 360; i++ {
+		now = start.Add(time.Duration(i) * 30 * time.Second)
+		minute := uint64(i / 2)
+		require.Nil(t, history.Record("/data", now, minute, 1000-minute))
+	}
+	end := start.Add(3 * time.Hour)
+
+	// The last hour is in the minute tier.
+	points, step, err := history.Series("/data", end.Add(-time.Hour), end, now, 0)
+	require.Nil(t, err)
+	assert.Equal(t, time.Minute, step)
+	require.Len(t, points, 60)
+	assert.Equal(t, end.Add(-time.Hour), points[0].Time)
+	assert.EqualValues(t, 120, points[0].ClaimedBytes)
+	assert.EqualValues(t, 880, points[0].FreeBytes)
+	assert.EqualValues(t, 179, points[59].ClaimedBytes)
+
+	// Steps are averages, rounded up to a multiple of the tier's step.
+	points, step, err = history.Series("/data", end.Add(-time.Hour), end, now, 25*time.Minute)
+	require.Nil(t, err)
+	assert.Equal(t, 30*time.Minute, step)
+	require.Len(t, points, 2)
+	assert.EqualValues(t, 134, points[0].ClaimedBytes)
+	assert.EqualValues(t, 164, points[1].ClaimedBytes)
+
+	// Older samples have been overwritten in the minute tier, but the
+	// ten minute tier still has them.
+	points, step, err = history.Series("/data", start, end, now, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, step)
+	require.Len(t, points, 18)
+	assert.Equal(t, start, points[0].Time)
+	assert.EqualValues(t, 4, points[0].ClaimedBytes)
+	points, _, err = history.Series("/data", start, start.Add(time.Hour), now, time.Minute)
+	require.Nil(t, err)
+	assert.Len(t, points, 6)
+
+	// The history survives a restart, and files don't grow.
+	info, err := os.Stat(filepath.Join(dir, "%2Fdata.history"))
+	require.Nil(t, err)
+	require.Nil(t, history.Close())
+	history, err = core.OpenHistory(dir)
+	require.Nil(t, err)
+	defer history.Close()
+	require.Nil(t, history.Record("/data", end, 500, 500))
+	points, _, err = history.Series("/data", end.Add(-time.Hour), end.Add(time.Minute), end, 0)
+	require.Nil(t, err)
+	// The new sample took the slot of the oldest.
+	require.Len(t, points, 60)
+	assert.Equal(t, end.Add(-59*time.Minute), points[0].Time)
+	assert.EqualValues(t, 500, points[59].ClaimedBytes)
+	after, err := os.Stat(filepath.Join(dir, "%2Fdata.history"))
+	require.Nil(t, err)
+	assert.Equal(t, info.Size(), after.Size())
+
+	points, _, err = history.Series("/other", start, end, now, 0)
+	require.Nil(t, err)
+	assert.Empty(t, points)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	stats := core.NewFakeStatProvider(10000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), stats)
+	history, err := core.OpenHistory(t.TempDir())
+	require.Nil(t, err)
+	service.UseHistory(history)
+	defer service.Close()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	service.SetClock(func() time.Time { return now })
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	path := filepath.Join(os.TempDir(), "history_file")
+
+	_, err = service.AddReservation("ingest", path, 1000, 0)
+	require.Nil(t, err)
+	service.SampleVolumes()
+	now = now.Add(time.Minute)
+	stats.Consume("", 500)
+	service.SampleVolumes()
+	now = now.Add(time.Minute)
+
+	get := func(params string) *http.Response {
+		resp, err := http.Get(server.URL + "/history/?" + params)
+		require.Nil(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	resp := get("volume=" + path + "&from=2024-03-01T11:00:00Z")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	response := core.VolumeResponse{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&response))
+	require.NotNil(t, response.History)
+	assert.EqualValues(t, 60, response.History.StepSeconds)
+	require.Len(t, response.History.Points, 2)
+	assert.Equal(t, core.HistoryPoint{Time: now.Add(-2 * time.Minute), ClaimedBytes: 1000, FreeBytes: 10000},
+		response.History.Points[0])
+	assert.EqualValues(t, 9500, response.History.Points[1].FreeBytes)
+
+	resp = get("volume=" + path + "&step=2m&format=csv")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	require.Nil(t, err)
+	assert.Equal(t, [][]string{
+		{"time", "claimed_bytes", "free_bytes"},
+		{"2024-03-01T12:00:00Z", "1000", "9750"},
+	}, records)
+
+	for _, params := range []string{"", "volume=/&from=yesterday", "volume=/&step=-1",
+		"volume=/&format=xml", "volume=/&from=2024-03-01T12:00:00Z&to=2024-03-01T11:00:00Z"} {
+		assert.Equal(t, http.StatusBadRequest, get(params).StatusCode, params)
+	}
+	other := httptest.NewServer(core.NewVolumeService(host, port, core.DiscardLogger(),
+		core.NewFakeStatProvider(10000)).Handler())
+	defer other.Close()
+	resp, err = http.Get(other.URL + "/history/?volume=/")
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,396 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// JournalFileName is the name of the write-ahead journal inside
+	// the journal directory.
+	JournalFileName = "journal.log"
+
+	// SnapshotFileName is the name of the compacted snapshot inside
+	// the journal directory.
+	SnapshotFileName = "snapshot.json"
+
+	// DefaultCompactEvery is the number of journal entries after which
+	// the VolumeService compacts the journal into a snapshot.
+	DefaultCompactEvery = 1000
+
+	// Journal operations.
+	JournalReserve = "reserve"
+	JournalRelease = "release"
+	JournalRenew   = "renew"
+)
+
+// FsyncPolicy controls how often the Journal flushes its writes
+// to stable storage.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs after every entry. This is the slowest and
+	// safest option: once Reserve or Release returns, the change
+	// survives a crash of the process or the machine.
+	FsyncAlways FsyncPolicy = iota
+
+	// FsyncInterval syncs once per second in the background. A machine
+	// crash may lose up to a second of changes. A process crash loses
+	// nothing, because the data is already in the OS page cache.
+	FsyncInterval
+
+	// FsyncNever leaves syncing entirely up to the operating system.
+	FsyncNever
+)
+
+// ParseFsyncPolicy converts "always", "interval" or "never" to an
+// FsyncPolicy.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch strings.ToLower(name) {
+	case "always":
+		return FsyncAlways, nil
+	case "interval":
+		return FsyncInterval, nil
+	case "never":
+		return FsyncNever, nil
+	}
+	return FsyncAlways, fmt.Errorf("unknown fsync policy '%s': "+
+		"use always, interval or never", name)
+}
+
+// String returns the name of the policy, as accepted by ParseFsyncPolicy.
+func (policy FsyncPolicy) String() string {
+	switch policy {
+	case FsyncAlways:
+		return "always"
+	case FsyncInterval:
+		return "interval"
+	case FsyncNever:
+		return "never"
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(policy))
+}
+
+// JournalEntry describes a single change to the ledger. Lease and
+// Expires are set only for reservations that carry a lease. ID is the
+// reservation ID. Releases and renewals without an ID apply to every
+// reservation for Path. A reservation with Replace set replaces every
+// existing reservation for Path. Client is the client that made the
+// reservation.
+type JournalEntry struct {
+	Seq     uint64        `json:"seq"`
+	Op      string        `json:"op"`
+	ID      string        `json:"id,omitempty"`
+	Client  string        `json:"client,omitempty"`
+	Peer    *PeerCred     `json:"peer,omitempty"`
+	Volume  string        `json:"volume"`
+	Path    string        `json:"path"`
+	Bytes   uint64        `json:"bytes,omitempty"`
+	Replace bool          `json:"replace,omitempty"`
+	Lease   time.Duration `json:"lease,omitempty"`
+	Expires *time.Time    `json:"expires,omitempty"`
+}
+
+// journalSnapshot is the on-disk format of a compacted ledger.
+// Entries with a Seq at or below the snapshot's Seq are already
+// reflected in Reservations and are skipped on replay. Snapshots
+// written before reservations had leases have Volumes instead, which
+// maps each volume's mountpoint to the bytes reserved for each path.
+type journalSnapshot struct {
+	Seq          uint64                       `json:"seq"`
+	Reservations []JournalEntry               `json:"reservations"`
+	Volumes      map[string]map[string]uint64 `json:"volumes,omitempty"`
+}
+
+// Journal is an append-only, on-disk record of every Reserve and
+// Release handled by the VolumeService. On startup, the service
+// replays the most recent snapshot plus the journal entries written
+// after it to rebuild its ledger. Periodically, the service compacts
+// the journal by writing a new snapshot and truncating the journal.
+type Journal struct {
+	dir          string
+	policy       FsyncPolicy
+	compactEvery int
+	mutex        sync.Mutex
+	file         *os.File
+	seq          uint64
+	snapshotSeq  uint64
+	entries      int
+	dirty        bool
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// OpenJournal opens (or creates) the journal in directory dir.
+// Param compactEvery is the number of entries after which
+// NeedsCompaction returns true. If it's less than one,
+// DefaultCompactEvery is used.
+func OpenJournal(dir string, policy FsyncPolicy, compactEvery int) (*Journal, error) {
+	if compactEvery < 1 {
+		compactEvery = DefaultCompactEvery
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, JournalFileName),
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	journal := &Journal{
+		dir:          dir,
+		policy:       policy,
+		compactEvery: compactEvery,
+		file:         file,
+	}
+	if policy == FsyncInterval {
+		journal.stop = make(chan struct{})
+		journal.done = make(chan struct{})
+		go journal.syncLoop()
+	}
+	return journal, nil
+}
+
+// Dir returns the directory containing the journal and snapshot.
+func (journal *Journal) Dir() string {
+	return journal.dir
+}
+
+// Replay calls apply for each reservation in the snapshot, followed by
+// each entry in the journal, in the order they were written. If the
+// last line of the journal is incomplete (because we crashed while
+// writing it), it is discarded. Call Replay once, before calling Append.
+func (journal *Journal) Replay(apply func(JournalEntry)) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	snapshot, err := journal.readSnapshot()
+	if err != nil {
+		return err
+	}
+	journal.snapshotSeq = snapshot.Seq
+	journal.seq = snapshot.Seq
+	for _, entry := range snapshot.Reservations {
+		apply(entry)
+	}
+
+	_, err = journal.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(journal.file)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line without a newline is a torn write.
+			break
+		} else if err != nil {
+			return err
+		}
+		entry := JournalEntry{}
+		if err = json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			return fmt.Errorf("journal %s is corrupt at offset %d: %v",
+				journal.file.Name(), offset, err)
+		}
+		offset += int64(len(line))
+		journal.entries++
+		if entry.Seq <= journal.snapshotSeq {
+			continue
+		}
+		journal.seq = entry.Seq
+		apply(entry)
+	}
+
+	// Drop the torn tail, if there is one, and position ourselves
+	// for appending.
+	err = journal.file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = journal.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Append writes entry to the journal, assigning it the next sequence
+// number. Depending on the FsyncPolicy, the entry may be synced to disk
+// before Append returns.
+func (journal *Journal) Append(entry JournalEntry) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	entry.Seq = journal.seq + 1
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = journal.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	journal.seq = entry.Seq
+	journal.entries++
+	journal.dirty = true
+	if journal.policy == FsyncAlways {
+		return journal.sync()
+	}
+	return nil
+}
+
+// NeedsCompaction returns true if enough entries have been written
+// since the last snapshot to make compaction worthwhile.
+func (journal *Journal) NeedsCompaction() bool {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return journal.entries >= journal.compactEvery
+}
+
+// Compact writes reservations, which must reflect every entry appended
+// so far, as the new snapshot, and then truncates the journal. Each of
+// the reservations should be a JournalReserve entry. The caller
+// must make sure no entries are appended while Compact is running.
+// The snapshot is written to a temp file and renamed into place, so a
+// crash at any point leaves either the old or the new snapshot intact.
+func (journal *Journal) Compact(reservations []JournalEntry) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	snapshot := journalSnapshot{
+		Seq:          journal.seq,
+		Reservations: reservations,
+	}
+	for i := range snapshot.Reservations {
+		snapshot.Reservations[i].Seq = journal.seq
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmpFile := filepath.Join(journal.dir, SnapshotFileName+".tmp")
+	err = writeFileSync(tmpFile, data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, filepath.Join(journal.dir, SnapshotFileName))
+	if err != nil {
+		return err
+	}
+	err = syncDir(journal.dir)
+	if err != nil {
+		return err
+	}
+	journal.snapshotSeq = journal.seq
+
+	// Entries in the journal are now covered by the snapshot.
+	err = journal.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = journal.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	journal.entries = 0
+	return journal.sync()
+}
+
+// Close syncs and closes the journal.
+func (journal *Journal) Close() error {
+	if journal.stop != nil {
+		close(journal.stop)
+		<-journal.done
+	}
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	err := journal.sync()
+	closeErr := journal.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (journal *Journal) readSnapshot() (*journalSnapshot, error) {
+	snapshot := &journalSnapshot{}
+	data, err := os.ReadFile(filepath.Join(journal.dir, SnapshotFileName))
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot in %s is corrupt: %v", journal.dir, err)
+	}
+	for mountPoint, reservations := range snapshot.Volumes {
+		for path, numBytes := range reservations {
+			snapshot.Reservations = append(snapshot.Reservations, JournalEntry{
+				Seq:    snapshot.Seq,
+				Op:     JournalReserve,
+				Volume: mountPoint,
+				Path:   path,
+				Bytes:  numBytes,
+			})
+		}
+	}
+	snapshot.Volumes = nil
+	return snapshot, nil
+}
+
+// sync flushes the journal to disk. Caller must hold the mutex.
+func (journal *Journal) sync() error {
+	if !journal.dirty {
+		return nil
+	}
+	journal.dirty = false
+	return journal.file.Sync()
+}
+
+func (journal *Journal) syncLoop() {
+	defer close(journal.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-journal.stop:
+			return
+		case <-ticker.C:
+			journal.mutex.Lock()
+			journal.sync()
+			journal.mutex.Unlock()
+		}
+	}
+}
+
+func writeFileSync(filename string, data []byte) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,354 @@
+package core_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const crashDirEnv = "VRESERVE_CRASH_TEST_DIR"
+
+// crashPath returns the path used by step i of the crash test.
+// All of these are on the same volume.
+func crashPath(i int) string {
+	return fmt.Sprintf("%s/vreserve_crash_test/file_%d", os.TempDir(), i)
+}
+
+// crashStep performs step i of the crash test against service. Every
+// fourth step releases the path reserved in the step before it.
+func crashStep(service *core.VolumeService, i int) error {
+	if i%4 == 3 {
+		service.Release(crashPath(i - 1))
+		return nil
+	}
+	return service.Reserve(crashPath(i), uint64(i+1))
+}
+
+// expectedAfter returns the reservations we expect after the first
+// n steps of the crash test have completed.
+func expectedAfter(n int) map[string]uint64 {
+	expected := make(map[string]uint64)
+	for i := 0; i < n; i++ {
+		if i%4 == 3 {
+			delete(expected, crashPath(i-1))
+		} else {
+			expected[crashPath(i)] = uint64(i + 1)
+		}
+	}
+	return expected
+}
+
+func newJournaledService(t *testing.T, dir string, compactEvery int) *core.VolumeService {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), nil)
+	journal, err := core.OpenJournal(dir, core.FsyncAlways, compactEvery)
+	require.Nil(t, err)
+	require.Nil(t, service.UseJournal(journal))
+	return service
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, policy := range []core.FsyncPolicy{core.FsyncAlways, core.FsyncInterval, core.FsyncNever} {
+		parsed, err := core.ParseFsyncPolicy(policy.String())
+		assert.Nil(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := core.ParseFsyncPolicy("sometimes")
+	assert.NotNil(t, err)
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	service := newJournaledService(t, dir, 1000)
+	for i := 0; i < 50; i++ {
+		require.Nil(t, crashStep(service, i))
+	}
+	require.Nil(t, service.Close())
+
+	recovered := newJournaledService(t, dir, 1000)
+	defer recovered.Close()
+	assert.Equal(t, expectedAfter(50), recovered.Reservations(crashPath(0)))
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir := t.TempDir()
+	service := newJournaledService(t, dir, 10)
+	for i := 0; i < 25; i++ {
+		require.Nil(t, crashStep(service, i))
+	}
+	require.Nil(t, service.Close())
+
+	// 25 entries with compaction every 10 leaves 5 in the journal.
+	_, err := os.Stat(filepath.Join(dir, core.SnapshotFileName))
+	assert.Nil(t, err)
+	journalFile, err := os.Open(filepath.Join(dir, core.JournalFileName))
+	require.Nil(t, err)
+	lines := 0
+	scanner := bufio.NewScanner(journalFile)
+	for scanner.Scan() {
+		lines++
+	}
+	journalFile.Close()
+	assert.Equal(t, 5, lines)
+
+	recovered := newJournaledService(t, dir, 10)
+	defer recovered.Close()
+	assert.Equal(t, expectedAfter(25), recovered.Reservations(crashPath(0)))
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	service := newJournaledService(t, dir, 1000)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, crashStep(service, i))
+	}
+	require.Nil(t, service.Close())
+
+	// Simulate a crash in the middle of writing an entry.
+	journalFile, err := os.OpenFile(filepath.Join(dir, core.JournalFileName),
+		os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = journalFile.WriteString(`{"seq":11,"op":"reserve","volu`)
+	require.Nil(t, err)
+	journalFile.Close()
+
+	recovered := newJournaledService(t, dir, 1000)
+	assert.Equal(t, expectedAfter(10), recovered.Reservations(crashPath(0)))
+
+	// New entries must land after the last good one.
+	for i := 10; i < 20; i++ {
+		require.Nil(t, crashStep(recovered, i))
+	}
+	require.Nil(t, recovered.Close())
+	recovered = newJournaledService(t, dir, 1000)
+	defer recovered.Close()
+	assert.Equal(t, expectedAfter(20), recovered.Reservations(crashPath(0)))
+}
+
+// TestJournalCrashChild is the process that gets killed in
+// TestJournalCrashRecovery. It runs steps until it's killed, printing
+// the number of each step after that step completes.
+func TestJournalCrashChild(t *testing.T) {
+	dir := os.Getenv(crashDirEnv)
+	if dir == "" {
+		t.Skip("Only runs as a child of TestJournalCrashRecovery")
+	}
+	service := newJournaledService(t, dir, 100)
+	for i := 0; ; i++ {
+		if err := crashStep(service, i); err != nil {
+			fmt.Println("error", err)
+			os.Exit(1)
+		}
+		fmt.Println(i)
+	}
+}
+
+// TestJournalCrashRecovery kills a process mid-stream with SIGKILL and
+// makes sure the ledger we recover from its journal includes every
+// change the process acknowledged.
+func TestJournalCrashRecovery(t *testing.T) {
+	if os.Getenv(crashDirEnv) != "" {
+		t.Skip("Running as child")
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestJournalCrashChild$")
+	cmd.Env = append(os.Environ(), crashDirEnv+"="+dir)
+	stdout, err := cmd.StdoutPipe()
+	require.Nil(t, err)
+	require.Nil(t, cmd.Start())
+
+	// Let it get through a few compactions, then kill it.
+	lastAcked := -1
+	scanner := bufio.NewScanner(stdout)
+	timeout := time.After(30 * time.Second)
+	for lastAcked < 350 {
+		select {
+		case <-timeout:
+			cmd.Process.Kill()
+			t.Fatal("Timed out waiting for child process")
+		default:
+		}
+		require.True(t, scanner.Scan(), "child process exited early")
+		if n, err := strconv.Atoi(scanner.Text()); err == nil {
+			lastAcked = n
+		} else {
+			t.Logf("child: %s", scanner.Text())
+		}
+	}
+	require.Nil(t, cmd.Process.Kill())
+
+	// Collect anything the child acknowledged before it died.
+	for scanner.Scan() {
+		if n, err := strconv.Atoi(scanner.Text()); err == nil {
+			lastAcked = n
+		}
+	}
+	cmd.Wait()
+
+	// The child may have completed one more step than it reported.
+	recovered := newJournaledService(t, dir, 100)
+	defer recovered.Close()
+	reservations := recovered.Reservations(crashPath(0))
+	acked := expectedAfter(lastAcked + 1)
+	unacked := expectedAfter(lastAcked + 2)
+	if !assert.ObjectsAreEqual(acked, reservations) {
+		assert.Equal(t, unacked, reservations)
+	}
+}
+
+func TestJournalLeases(t *testing.T) {
+	dir := t.TempDir()
+	clock := newFakeClock()
+	service := newJournaledService(t, dir, 3)
+	service.SetClock(clock.Now)
+	require.Nil(t, service.ReserveWithLease(crashPath(1), 100, time.Minute))
+	require.Nil(t, service.ReserveWithLease(crashPath(2), 200, time.Minute))
+	require.Nil(t, service.Reserve(crashPath(3), 300))
+	clock.Advance(30 * time.Second)
+	require.Nil(t, service.Renew(crashPath(2), time.Hour))
+	require.Nil(t, service.Close())
+
+	// Leases survive the restart, and expire on schedule.
+	recovered := newJournaledService(t, dir, 3)
+	defer recovered.Close()
+	recovered.SetClock(clock.Now)
+	assert.Empty(t, recovered.ReapExpired())
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, []string{crashPath(1)}, recovered.ReapExpired())
+	clock.Advance(time.Hour)
+	assert.Equal(t, []string{crashPath(2)}, recovered.ReapExpired())
+	expected := map[string]uint64{crashPath(3): 300}
+	assert.Equal(t, expected, recovered.Reservations(crashPath(0)))
+}
+
+func TestJournalReservationIDs(t *testing.T) {
+	dir := t.TempDir()
+	service := newJournaledService(t, dir, 1000)
+	id1, err := service.AddReservation("", crashPath(1), 100, time.Minute)
+	require.Nil(t, err)
+	id2, err := service.AddReservation("", crashPath(1), 200, 0)
+	require.Nil(t, err)
+	id3, err := service.AddReservation("", crashPath(2), 300, 0)
+	require.Nil(t, err)
+	require.Nil(t, service.RenewID(id1, time.Hour))
+	assert.True(t, service.ReleaseID(id2))
+	assert.False(t, service.ReleaseID(id2))
+	require.Nil(t, service.Close())
+
+	// IDs survive the restart, and compaction.
+	checkIDs := func(service *core.VolumeService) {
+		reservations := service.ReservationList(crashPath(0))
+		require.Len(t, reservations, 2)
+		assert.Equal(t, id1, reservations[0].ID)
+		assert.EqualValues(t, 100, reservations[0].Bytes)
+		assert.NotNil(t, reservations[0].Expires)
+		assert.Equal(t, id3, reservations[1].ID)
+		assert.EqualValues(t, 300, reservations[1].Bytes)
+	}
+	recovered := newJournaledService(t, dir, 1)
+	checkIDs(recovered)
+	require.Nil(t, recovered.RenewID(id1, time.Hour))
+	require.Nil(t, recovered.Close())
+	_, err = os.Stat(filepath.Join(dir, core.SnapshotFileName))
+	require.Nil(t, err)
+
+	recovered = newJournaledService(t, dir, 1000)
+	defer recovered.Close()
+	checkIDs(recovered)
+}
+
+func TestJournalWithoutIDs(t *testing.T) {
+	// A journal written before reservations had IDs. Reserving a
+	// path twice replaced the first reservation.
+	dir := t.TempDir()
+	journal := fmt.Sprintf(`{"seq":1,"op":"reserve","volume":"/","path":"%s","bytes":100}
+{"seq":2,"op":"reserve","volume":"/","path":"%s","bytes":200}
+{"seq":3,"op":"reserve","volume":"/","path":"%s","bytes":300}
+{"seq":4,"op":"release","volume":"/","path":"%s"}
+`, crashPath(1), crashPath(1), crashPath(2), crashPath(2))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, core.JournalFileName), []byte(journal), 0644))
+
+	recovered := newJournaledService(t, dir, 1000)
+	defer recovered.Close()
+	expected := map[string]uint64{crashPath(1): 200}
+	assert.Equal(t, expected, recovered.Reservations(crashPath(0)))
+	reservations := recovered.ReservationList(crashPath(0))
+	require.Len(t, reservations, 1)
+	assert.Len(t, reservations[0].ID, 16)
+}
+
+func TestJournalSnapshotWithoutIDs(t *testing.T) {
+	// A snapshot written before reservations had leases or IDs, which
+	// maps each volume to the bytes reserved for each path, and the
+	// journal entries written after it.
+	dir := t.TempDir()
+	snapshot := fmt.Sprintf(`{"seq":7,"volumes":{"/":{"%s":100,"%s":200}}}`,
+		crashPath(1), crashPath(2))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, core.SnapshotFileName), []byte(snapshot), 0644))
+	journal := fmt.Sprintf(`{"seq":7,"op":"release","volume":"/","path":"%s"}
+{"seq":8,"op":"reserve","volume":"/","path":"%s","bytes":300}
+{"seq":9,"op":"release","volume":"/","path":"%s"}
+`, crashPath(1), crashPath(3), crashPath(2))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, core.JournalFileName), []byte(journal), 0644))
+
+	recovered := newJournaledService(t, dir, 1000)
+	expected := map[string]uint64{crashPath(1): 100, crashPath(3): 300}
+	assert.Equal(t, expected, recovered.Reservations(crashPath(0)))
+	for _, r := range recovered.ReservationList(crashPath(0)) {
+		assert.Len(t, r.ID, 16)
+	}
+
+	// Once we've compacted, the snapshot is in the new format.
+	recovered.Release(crashPath(3))
+	_, err := recovered.AddReservation("", crashPath(4), 400, 0)
+	require.Nil(t, err)
+	require.Nil(t, recovered.Close())
+	recovered = newJournaledService(t, dir, 1)
+	_, err = recovered.AddReservation("", crashPath(5), 500, 0)
+	require.Nil(t, err)
+	require.Nil(t, recovered.Close())
+	data, err := os.ReadFile(filepath.Join(dir, core.SnapshotFileName))
+	require.Nil(t, err)
+	assert.NotContains(t, string(data), `"volumes"`)
+
+	recovered = newJournaledService(t, dir, 1000)
+	defer recovered.Close()
+	expected = map[string]uint64{crashPath(1): 100, crashPath(4): 400, crashPath(5): 500}
+	assert.Equal(t, expected, recovered.Reservations(crashPath(0)))
+}
+
+func TestJournalQueuedGrantFails(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	journal, err := core.OpenJournal(t.TempDir(), core.FsyncAlways, 1000)
+	require.Nil(t, err)
+	require.Nil(t, service.UseJournal(journal))
+	dir := os.TempDir()
+	path := filepath.Join(dir, "journal_queued_file")
+	hog, err := service.AddReservation("", filepath.Join(dir, "journal_queued_hog"), 9950, 0)
+	require.Nil(t, err)
+	waited := make(chan error, 1)
+	go func() {
+		_, _, err := service.ReserveWait(context.Background(), "", path, 100, 0)
+		waited <- err
+	}()
+	waitForQueueLength(t, service, dir, 1)
+
+	// Once the journal can't be written, a queued request can't be
+	// granted, because the grant wouldn't survive a crash.
+	require.Nil(t, journal.Close())
+	require.True(t, service.ReleaseID(hog))
+	err = <-waited
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot write journal")
+	assert.Empty(t, service.Reservations(path))
+	assert.Equal(t, 0, service.QueueLength(dir))
+}
@@ -0,0 +1,298 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The line protocol is a plain-text interface to the VolumeService for
+// shell scripts and small agents that don't speak HTTP. Each request is
+// one line, and so is each response, except for REPORT:
+//
+//	PING                   -> OK
+//	AUTH <token>           -> OK
+//	CLIENT <name>          -> OK
+//	RESERVE <path> <bytes> -> OK <id>
+//	RELEASE <path>         -> OK
+//	REPORT <path>          -> OK <n>, then n lines of "<id> <bytes> <path>"
+//	QUIT                   -> OK, and the service closes the connection
+//
+// Commands are case-insensitive. Paths may contain spaces, but not
+// newlines. Errors look like "ERR <code> <message>", where code is one
+// of the ErrorCodes, such as INSUFFICIENT_SPACE. CLIENT sets the name
+// the connection's reservations count against for quotas. Without it,
+// the client is identified by its IP address. If the service has
+// tokens, clients must send AUTH before anything but PING and QUIT,
+// and are identified by their token's name. Clients that connect over
+// TLS with a verified certificate are identified by its subject,
+// unless they send AUTH.
+
+// ServeLineProtocol serves the line protocol on port, on the same host
+// as the HTTP interface. If releaseOnClose is true, the reservations
+// made on each connection are released when the connection closes, so
+// a client that dies can't tie up space. Serve must also be running,
+// to reap expired leases. If the service has a TLS config (see
+// UseTLS), clients must connect over TLS. ServeLineProtocol returns
+// only if the listener fails.
+func (service *VolumeService) ServeLineProtocol(port int, releaseOnClose bool) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", service.host, port))
+	if err != nil {
+		return err
+	}
+	if service.tlsConfig != nil {
+		listener = tls.NewListener(listener, service.tlsConfig)
+	}
+	return service.ServeLineListener(listener, releaseOnClose)
+}
+
+// ServeLineListener is like ServeLineProtocol, but serves connections
+// from listener. When the listener is closed, ServeLineListener closes
+// the connections it has open, and returns once they're cleaned up.
+func (service *VolumeService) ServeLineListener(listener net.Listener, releaseOnClose bool) error {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	open := make(map[net.Conn]bool)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			mutex.Lock()
+			for conn := range open {
+				conn.Close()
+			}
+			mutex.Unlock()
+			wg.Wait()
+			return err
+		}
+		mutex.Lock()
+		open[conn] = true
+		mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			service.serveLineConn(conn, releaseOnClose)
+			mutex.Lock()
+			delete(open, conn)
+			mutex.Unlock()
+		}()
+	}
+}
+
+// lineConn is the state of one line protocol connection.
+type lineConn struct {
+	// ctx holds the token the client authenticated with, if any.
+	ctx context.Context
+	// cert is the subject of the client's verified TLS certificate.
+	cert   string
+	client string
+	// remote is the client's address, for the audit log.
+	remote string
+	// ids are the reservations made on this connection that haven't
+	// been released. It's nil unless the service releases them when
+	// the connection closes.
+	ids map[string]bool
+}
+
+// name returns the client's identity: the name of its token, if it
+// authenticated, or else the subject of its TLS certificate, or else
+// the name it gave with CLIENT, or else its IP address.
+func (state *lineConn) name() string {
+	if token := callerToken(state.ctx); token != nil {
+		return token.Name
+	}
+	if state.cert != "" {
+		return state.cert
+	}
+	return state.client
+}
+
+// aclName returns the identity the ACL knows the client by: the name
+// of its token, or else the subject of its TLS certificate, or else
+// AnyClient. Anyone can send CLIENT, so it proves nothing.
+func (state *lineConn) aclName() string {
+	if token := callerToken(state.ctx); token != nil {
+		return token.Name
+	}
+	if state.cert != "" {
+		return state.cert
+	}
+	return AnyClient
+}
+
+func (service *VolumeService) serveLineConn(conn net.Conn, releaseOnClose bool) {
+	defer conn.Close()
+	state := &lineConn{ctx: context.Background(), client: conn.RemoteAddr().String()}
+	if host, _, err := net.SplitHostPort(state.client); err == nil {
+		state.client = host
+	}
+	remote := conn.RemoteAddr().String()
+	state.remote = remote
+	if releaseOnClose {
+		state.ids = make(map[string]bool)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			service.logger.Warningf("[%s] TLS handshake failed: %v", remote, err)
+			return
+		}
+		connState := tlsConn.ConnectionState()
+		state.cert = certName(&connState)
+	}
+	service.logger.Infof("[%s] Line protocol connection opened", remote)
+	scanner := bufio.NewScanner(conn)
+	writer := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		start := time.Now()
+		command, quit := service.handleLine(state, scanner.Text(), writer)
+		if command != "" {
+			service.metrics.observe("line_"+command, time.Since(start))
+		}
+		if err := writer.Flush(); err != nil || quit {
+			break
+		}
+	}
+	for id := range state.ids {
+		volume, r, ok := service.findReservation(id)
+		if ok && service.ReleaseID(id) {
+			service.auditRelease(state.name(), remote, volume, id, "", []Reservation{r}, nil)
+			service.logger.Infof("[%s] Connection closed: released %s", state.name(), id)
+		}
+	}
+	service.logger.Infof("[%s] Line protocol connection closed", remote)
+}
+
+// handleLine handles one request, writing the response to w. It
+// returns the name of the command, for metrics, or "" if there was
+// none, and whether the client asked to close the connection.
+func (service *VolumeService) handleLine(state *lineConn, line string, w io.Writer) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", false
+	}
+	fields := strings.Fields(line)
+	command := strings.ToLower(fields[0])
+	arg := strings.TrimSpace(line[len(fields[0]):])
+	switch command {
+	case "ping":
+		fmt.Fprintln(w, "OK")
+	case "quit":
+		fmt.Fprintln(w, "OK")
+		return command, true
+	case "auth":
+		ctx, err := service.authenticate(state.ctx, arg)
+		if err == nil && callerToken(ctx) == nil {
+			err = paramError("usage: AUTH <token>")
+		}
+		if err != nil {
+			service.logger.Warningf("[%s] Denied AUTH: %v", state.name(), err)
+			writeLineError(w, err)
+			break
+		}
+		state.ctx = ctx
+		fmt.Fprintln(w, "OK")
+	case "client":
+		if arg == "" {
+			writeLineError(w, paramError("usage: CLIENT <name>"))
+			break
+		}
+		state.client = arg
+		fmt.Fprintln(w, "OK")
+	case "reserve":
+		if err := service.authorize(state.ctx, RoleReserver); err != nil {
+			writeLineError(w, err)
+			break
+		}
+		service.lineReserve(state, arg, w)
+	case "release":
+		if err := service.authorize(state.ctx, RoleReserver); err != nil {
+			writeLineError(w, err)
+			break
+		}
+		if arg == "" {
+			writeLineError(w, paramError("usage: RELEASE <path>"))
+			break
+		}
+		volume, released, err := service.releaseAs(state.ctx, state.aclName(), "", arg)
+		service.auditRelease(state.name(), state.remote, volume, "", arg, released, err)
+		if err != nil {
+			service.logger.Warningf("[%s] Could not release %s: %v", state.name(), arg, err)
+			writeLineError(w, err)
+			break
+		}
+		for _, r := range released {
+			delete(state.ids, r.ID)
+		}
+		service.logger.Infof("[%s] Released %s", state.name(), arg)
+		fmt.Fprintln(w, "OK")
+	case "report":
+		if err := service.authorize(state.ctx, RoleReader); err != nil {
+			writeLineError(w, err)
+			break
+		}
+		if arg == "" {
+			writeLineError(w, paramError("usage: REPORT <path>"))
+			break
+		}
+		if err := service.checkACL(state.aclName(), OpReport, arg); err != nil {
+			writeLineError(w, err)
+			break
+		}
+		reservations := service.visibleReservations(state.aclName(), service.ReservationList(arg))
+		fmt.Fprintf(w, "OK %d\n", len(reservations))
+		for _, r := range reservations {
+			fmt.Fprintf(w, "%s %d %s\n", r.ID, r.Bytes, r.Path)
+		}
+	default:
+		writeLineError(w, paramError(fmt.Sprintf("unknown command '%s'", fields[0])))
+		return "unknown", false
+	}
+	return command, false
+}
+
+// lineReserve handles RESERVE <path> <bytes>. The byte count comes
+// last, so the path can contain spaces.
+func (service *VolumeService) lineReserve(state *lineConn, arg string, w io.Writer) {
+	split := strings.LastIndexAny(arg, " \t")
+	if split < 0 {
+		writeLineError(w, paramError("usage: RESERVE <path> <bytes>"))
+		return
+	}
+	path := strings.TrimSpace(arg[:split])
+	bytes, err := strconv.ParseUint(arg[split+1:], 10, 64)
+	if err != nil || bytes < 1 {
+		writeLineError(w, paramError("bytes must be an integer greater than zero"))
+		return
+	}
+	volume := service.getVolume(path)
+	if err := service.checkACL(state.aclName(), OpReserve, path); err != nil {
+		service.auditReserve(state.name(), state.remote, volume, path, bytes, "", err)
+		writeLineError(w, err)
+		return
+	}
+	id, err := service.reserve(nil, state.name(), nil, volume, path, bytes, 0, false)
+	service.auditReserve(state.name(), state.remote, volume, path, bytes, id, err)
+	if err != nil {
+		service.logger.Warningf("[%s] Could not reserve %d bytes for file '%s': %v",
+			state.name(), bytes, path, err)
+		writeLineError(w, err)
+		return
+	}
+	if state.ids != nil {
+		state.ids[id] = true
+	}
+	service.logger.Infof("[%s] Reserved %d bytes for %s (%s)", state.name(), bytes, path, id)
+	fmt.Fprintf(w, "OK %s\n", id)
+}
+
+// writeLineError writes err as "ERR <code> <message>", on one line.
+func writeLineError(w io.Writer, err error) {
+	message := strings.ReplaceAll(err.Error(), "\n", " ")
+	fmt.Fprintf(w, "ERR %s %s\n", errorCode(err), message)
+}
@@ -0,0 +1,137 @@
+package core_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lineClient is a connection to the line protocol.
+type lineClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// serveLines serves service's line protocol on a random port and
+// returns its address. It shuts the listener down when the test ends,
+// so no connection outlives the test.
+func serveLines(t *testing.T, service *core.VolumeService, releaseOnClose bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		service.ServeLineListener(listener, releaseOnClose)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+func dialLines(t *testing.T, addr string) *lineClient {
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &lineClient{conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+// send sends line and returns the first line of the response.
+func (c *lineClient) send(t *testing.T, line string) string {
+	_, err := fmt.Fprintln(c.conn, line)
+	require.Nil(t, err)
+	return c.read(t)
+}
+
+func (c *lineClient) read(t *testing.T) string {
+	require.Nil(t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.True(t, c.scanner.Scan(), "no response: %v", c.scanner.Err())
+	return c.scanner.Text()
+}
+
+func TestLineProtocol(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	client := dialLines(t, serveLines(t, service, false))
+	path := filepath.Join(os.TempDir(), "line file")
+
+	assert.Equal(t, "OK", client.send(t, "PING"))
+	assert.Equal(t, "OK", client.send(t, "client line_test"))
+
+	response := client.send(t, fmt.Sprintf("RESERVE %s 3000", path))
+	require.True(t, strings.HasPrefix(response, "OK "), response)
+	id := strings.TrimPrefix(response, "OK ")
+	reservations := service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, id, reservations[0].ID)
+	assert.Equal(t, "line_test", reservations[0].Client)
+	assert.EqualValues(t, 3000, reservations[0].Bytes)
+
+	assert.Equal(t, "OK 1", client.send(t, "REPORT "+path))
+	assert.Equal(t, fmt.Sprintf("%s 3000 %s", id, path), client.read(t))
+
+	response = client.send(t, fmt.Sprintf("RESERVE %s 20000", path))
+	assert.True(t, strings.HasPrefix(response, "ERR INSUFFICIENT_SPACE "), response)
+
+	assert.Equal(t, "OK", client.send(t, "RELEASE "+path))
+	assert.Empty(t, service.ReservationList(path))
+	assert.Equal(t, "OK 0", client.send(t, "REPORT "+path))
+
+	for _, line := range []string{
+		"RESERVE " + path,
+		"RESERVE " + path + " lots",
+		"RESERVE " + path + " 0",
+		"RELEASE",
+		"REPORT",
+		"CLIENT",
+		"FROB " + path,
+	} {
+		response = client.send(t, line)
+		assert.True(t, strings.HasPrefix(response, "ERR INVALID_PARAM "), "%s: %s", line, response)
+	}
+
+	assert.Equal(t, "OK", client.send(t, "QUIT"))
+	assert.False(t, client.scanner.Scan())
+}
+
+func TestLineProtocolReleaseOnClose(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	addr := serveLines(t, service, true)
+	path := filepath.Join(os.TempDir(), "line_release_on_close")
+
+	first := dialLines(t, addr)
+	second := dialLines(t, addr)
+	require.True(t, strings.HasPrefix(first.send(t, fmt.Sprintf("RESERVE %s 1000", path)), "OK "))
+	require.True(t, strings.HasPrefix(second.send(t, fmt.Sprintf("RESERVE %s 2000", path)), "OK "))
+	require.Len(t, service.ReservationList(path), 2)
+
+	// Only the reservation made on the closed connection goes away.
+	first.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(service.ReservationList(path)) != 1 {
+		require.True(t, time.Now().Before(deadline), "reservation never released")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(t, 2000, service.ReservationList(path)[0].Bytes)
+
+	// Closing releases whatever the client didn't release itself.
+	other := path + "_other"
+	require.True(t, strings.HasPrefix(second.send(t, fmt.Sprintf("RESERVE %s 500", other)), "OK "))
+	require.Equal(t, "OK", second.send(t, "RELEASE "+path))
+	require.True(t, strings.HasPrefix(second.send(t, fmt.Sprintf("RESERVE %s 700", path)), "OK "))
+	second.conn.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for len(service.ReservationList(path))+len(service.ReservationList(other)) != 0 {
+		require.True(t, time.Now().Before(deadline), "reservations never released")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
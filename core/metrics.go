@@ -0,0 +1,235 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets in
+// the request latency histograms. Requests that wait in the queue can
+// take a long time, so the buckets go up to ten minutes.
+var LatencyBuckets = []float64{
+	0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+	1, 2.5, 5, 10, 30, 60, 300, 600,
+}
+
+// metrics holds the counters and histograms the VolumeService exports
+// at /metrics. Gauges, such as free and claimed space, are read from
+// the volumes themselves at scrape time, so they're never stale.
+type metrics struct {
+	mutex    sync.Mutex
+	grants   map[string]uint64
+	denials  map[string]uint64
+	releases map[string]uint64
+	latency  map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		grants:   make(map[string]uint64),
+		denials:  make(map[string]uint64),
+		releases: make(map[string]uint64),
+		latency:  make(map[string]*histogram),
+	}
+}
+
+func (m *metrics) granted(volume string) {
+	m.mutex.Lock()
+	m.grants[volume]++
+	m.mutex.Unlock()
+}
+
+func (m *metrics) denied(volume string) {
+	m.mutex.Lock()
+	m.denials[volume]++
+	m.mutex.Unlock()
+}
+
+func (m *metrics) released(volume string) {
+	m.mutex.Lock()
+	m.releases[volume]++
+	m.mutex.Unlock()
+}
+
+// observe records the time it took to handle a request to handler.
+func (m *metrics) observe(handler string, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := m.latency[handler]
+	if !ok {
+		h = newHistogram(LatencyBuckets)
+		m.latency[handler] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// histogram is a Prometheus-style histogram. counts[i] is the number
+// of observations less than or equal to bounds[i], but greater than
+// bounds[i-1]. The cumulative counts Prometheus wants are computed
+// when the histogram is written.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// volumeGauges is a snapshot of one volume's current state.
+type volumeGauges struct {
+	volume       string
+	stats        VolumeStats
+	statsErr     error
+	claimed      uint64
+	reservations int
+	queueLength  int
+	rate         float64
+	rateOK       bool
+}
+
+// WriteMetrics writes the service's metrics to w in the Prometheus
+// text exposition format.
+func (service *VolumeService) WriteMetrics(w io.Writer) error {
+	gauges := make([]volumeGauges, 0)
+	for _, volume := range service.allVolumes() {
+		stats, err := volume.Stats()
+		rate, rateOK := volume.backgroundRate()
+		gauges = append(gauges, volumeGauges{
+			volume:       volume.MountPoint(),
+			stats:        stats,
+			statsErr:     err,
+			claimed:      volume.ClaimedSpace(),
+			reservations: volume.reservationCount(),
+			queueLength:  volume.QueueLength(),
+			rate:         rate,
+			rateOK:       rateOK,
+		})
+	}
+	sort.Slice(gauges, func(i, j int) bool { return gauges[i].volume < gauges[j].volume })
+
+	buf := bufio.NewWriter(w)
+	gauge := func(name, help string, value func(volumeGauges) (uint64, bool)) {
+		writeHeader(buf, name, "gauge", help)
+		for _, g := range gauges {
+			if v, ok := value(g); ok {
+				fmt.Fprintf(buf, "%s{volume=%s} %d\n", name, quoteLabel(g.volume), v)
+			}
+		}
+	}
+	gauge("vreserve_volume_total_bytes", "Size of the volume.",
+		func(g volumeGauges) (uint64, bool) { return g.stats.TotalBytes, g.statsErr == nil })
+	gauge("vreserve_volume_free_bytes", "Bytes available to unprivileged users on the volume, not counting reservations.",
+		func(g volumeGauges) (uint64, bool) { return g.stats.AvailableBytes, g.statsErr == nil })
+	gauge("vreserve_volume_claimed_bytes", "Bytes reserved on the volume.",
+		func(g volumeGauges) (uint64, bool) { return g.claimed, true })
+	gauge("vreserve_volume_reservations", "Number of reservations on the volume.",
+		func(g volumeGauges) (uint64, bool) { return uint64(g.reservations), true })
+	gauge("vreserve_volume_queue_length", "Number of requests waiting for space on the volume.",
+		func(g volumeGauges) (uint64, bool) { return uint64(g.queueLength), true })
+	floatGauge := func(name, help string, value func(volumeGauges) (float64, bool)) {
+		writeHeader(buf, name, "gauge", help)
+		for _, g := range gauges {
+			if v, ok := value(g); ok {
+				fmt.Fprintf(buf, "%s{volume=%s} %s\n", name, quoteLabel(g.volume), formatFloat(v))
+			}
+		}
+	}
+	floatGauge("vreserve_volume_background_bytes_per_second",
+		"Estimated rate at which processes that don't reserve space are filling the volume.",
+		func(g volumeGauges) (float64, bool) { return g.rate, g.rateOK })
+	floatGauge("vreserve_volume_seconds_to_full",
+		"Projected time until background consumption uses up the unreserved space on the volume.",
+		func(g volumeGauges) (float64, bool) {
+			if !g.rateOK || g.statsErr != nil {
+				return 0, false
+			}
+			available := subSaturating(g.stats.AvailableBytes, g.claimed)
+			ttf, filling := timeToFull(available, g.rate)
+			return ttf.Seconds(), filling
+		})
+
+	m := service.metrics
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	writeCounter(buf, "vreserve_reservations_granted_total",
+		"Reservations granted, including those granted from the queue.", m.grants)
+	writeCounter(buf, "vreserve_reservations_denied_total",
+		"Reservations refused for lack of space, or abandoned while waiting in the queue.", m.denials)
+	writeCounter(buf, "vreserve_reservations_released_total",
+		"Reservations released, including those whose leases expired.", m.releases)
+
+	name := "vreserve_request_duration_seconds"
+	writeHeader(buf, name, "histogram", "Time taken to handle HTTP requests, by handler.")
+	for _, handler := range sortedKeys(m.latency) {
+		h := m.latency[handler]
+		label := quoteLabel(handler)
+		cumulative := uint64(0)
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "%s_bucket{handler=%s,le=\"%s\"} %d\n",
+				name, label, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{handler=%s,le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(buf, "%s_sum{handler=%s} %s\n", name, label, formatFloat(h.sum))
+		fmt.Fprintf(buf, "%s_count{handler=%s} %d\n", name, label, h.count)
+	}
+	return buf.Flush()
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeCounter(w io.Writer, name, help string, values map[string]uint64) {
+	writeHeader(w, name, "counter", help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, volume := range keys {
+		fmt.Fprintf(w, "%s{volume=%s} %d\n", name, quoteLabel(volume), values[volume])
+	}
+}
+
+func sortedKeys(histograms map[string]*histogram) []string {
+	keys := make([]string, 0, len(histograms))
+	for key := range histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelEscaper escapes label values as the exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,151 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	provider.Consume("", 4000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	dir := os.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	mountPoint, err := core.GetMountPointFromPath(dir)
+	require.Nil(t, err)
+
+	require.Nil(t, service.Reserve(path("metrics_1"), 1000))
+	require.Nil(t, service.Reserve(path("metrics_2"), 2000))
+	require.NotNil(t, service.Reserve(path("metrics_3"), 5000))
+	service.Release(path("metrics_1"))
+	service.Release(path("never_reserved"))
+
+	// Give up waiting for space.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, _, err = service.ReserveWait(ctx, "", path("metrics_4"), 5000, 0)
+	require.NotNil(t, err)
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, service.WriteMetrics(buf))
+	output := buf.String()
+
+	label := fmt.Sprintf(`{volume="%s"}`, mountPoint)
+	expected := []string{
+		"# TYPE vreserve_volume_free_bytes gauge",
+		"vreserve_volume_total_bytes" + label + " 10000",
+		"vreserve_volume_free_bytes" + label + " 6000",
+		"vreserve_volume_claimed_bytes" + label + " 2000",
+		"vreserve_volume_reservations" + label + " 1",
+		"vreserve_volume_queue_length" + label + " 0",
+		"# TYPE vreserve_reservations_granted_total counter",
+		"vreserve_reservations_granted_total" + label + " 2",
+		"vreserve_reservations_denied_total" + label + " 2",
+		"vreserve_reservations_released_total" + label + " 1",
+		"# TYPE vreserve_request_duration_seconds histogram",
+	}
+	for _, line := range expected {
+		assert.Contains(t, output, line+"\n")
+	}
+
+	// If we can't stat the volume, we leave out the stats, but not
+	// the rest.
+	provider.SetError(fmt.Errorf("disk on fire"))
+	buf.Reset()
+	require.Nil(t, service.WriteMetrics(buf))
+	assert.NotContains(t, buf.String(), "vreserve_volume_free_bytes"+label)
+	assert.Contains(t, buf.String(), "vreserve_volume_claimed_bytes"+label+" 2000\n")
+}
+
+func TestWriteMetricsReservationIDs(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	dir := os.TempDir()
+	path := filepath.Join(dir, "metrics_ids")
+	mountPoint, err := core.GetMountPointFromPath(dir)
+	require.Nil(t, err)
+
+	// Two reservations for one path are two reservations.
+	_, err = service.AddReservation("ingest", path, 100, 0)
+	require.Nil(t, err)
+	_, err = service.AddReservation("restore", path, 200, 0)
+	require.Nil(t, err)
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, service.WriteMetrics(buf))
+	label := fmt.Sprintf(`{volume="%s"}`, mountPoint)
+	assert.Contains(t, buf.String(), "vreserve_volume_reservations"+label+" 2\n")
+	assert.Equal(t, 2, service.Volumes()[0].Reservations)
+}
+
+func TestWriteMetricsReleases(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	dir := os.TempDir()
+	path := filepath.Join(dir, "metrics_releases")
+	mountPoint, err := core.GetMountPointFromPath(dir)
+	require.Nil(t, err)
+
+	// Releasing a path releases each of its reservations, and so does
+	// replacing them.
+	for i := 0; i < 2; i++ {
+		_, err = service.AddReservation("ingest", path, 100, 0)
+		require.Nil(t, err)
+	}
+	service.Release(path)
+	for i := 0; i < 2; i++ {
+		_, err = service.AddReservation("ingest", path, 100, 0)
+		require.Nil(t, err)
+	}
+	require.Nil(t, service.Reserve(path, 100))
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, service.WriteMetrics(buf))
+	label := fmt.Sprintf(`{volume="%s"}`, mountPoint)
+	assert.Contains(t, buf.String(), "vreserve_reservations_released_total"+label+" 4\n")
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	runService(t)
+
+	resp, err := http.Get(fmt.Sprintf("%s/ping/", serviceUrl))
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(fmt.Sprintf("%s/metrics", serviceUrl))
+	require.Nil(t, err)
+	data, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+
+	output := string(data)
+	assert.Contains(t, output, `vreserve_request_duration_seconds_bucket{handler="ping",le="+Inf"}`)
+	assert.Contains(t, output, `vreserve_request_duration_seconds_sum{handler="ping"}`)
+	assert.Contains(t, output, `vreserve_request_duration_seconds_count{handler="ping"}`)
+
+	// Buckets are cumulative, so each is at least as big as the last.
+	last := -1
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.HasPrefix(line, `vreserve_request_duration_seconds_bucket{handler="ping"`) {
+			continue
+		}
+		var count int
+		_, err := fmt.Sscanf(line[strings.LastIndex(line, " ")+1:], "%d", &count)
+		require.Nil(t, err)
+		assert.True(t, count >= last, line)
+		last = count
+	}
+	assert.True(t, last > 0)
+}
@@ -0,0 +1,272 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MountInfo describes a mounted filesystem, as listed in one line of
+// /proc/self/mountinfo. See proc(5) for details. Root is the directory
+// within the filesystem that is mounted at MountPoint. It's "/" unless
+// this is a bind mount of a subdirectory.
+type MountInfo struct {
+	ID           int
+	ParentID     int
+	Major        int
+	Minor        int
+	Root         string
+	MountPoint   string
+	Options      string
+	FsType       string
+	Source       string
+	SuperOptions string
+}
+
+// MountTable is a list of mounts, in the order they were mounted.
+type MountTable []MountInfo
+
+// ParseMountInfo parses the contents of /proc/self/mountinfo.
+func ParseMountInfo(reader io.Reader) (MountTable, error) {
+	table := make(MountTable, 0)
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		mount, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("mountinfo line %d: %v", lineNum, err)
+		}
+		table = append(table, mount)
+	}
+	return table, scanner.Err()
+}
+
+// parseMountInfoLine parses a line like this one:
+//
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// Between the mount options and the "-" separator are zero or more
+// optional fields, which we ignore.
+func parseMountInfoLine(line string) (MountInfo, error) {
+	mount := MountInfo{}
+	fields := strings.Fields(line)
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator < 0 || len(fields) < separator+3 {
+		return mount, fmt.Errorf("expected at least 10 fields: %q", line)
+	}
+	var err error
+	if mount.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return mount, fmt.Errorf("bad mount id %q", fields[0])
+	}
+	if mount.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return mount, fmt.Errorf("bad parent id %q", fields[1])
+	}
+	device := strings.SplitN(fields[2], ":", 2)
+	if len(device) != 2 {
+		return mount, fmt.Errorf("bad device %q", fields[2])
+	}
+	if mount.Major, err = strconv.Atoi(device[0]); err != nil {
+		return mount, fmt.Errorf("bad device %q", fields[2])
+	}
+	if mount.Minor, err = strconv.Atoi(device[1]); err != nil {
+		return mount, fmt.Errorf("bad device %q", fields[2])
+	}
+	mount.Root = unescapeMountPath(fields[3])
+	mount.MountPoint = unescapeMountPath(fields[4])
+	mount.Options = fields[5]
+	mount.FsType = fields[separator+1]
+	mount.Source = unescapeMountPath(fields[separator+2])
+	if len(fields) > separator+3 {
+		mount.SuperOptions = fields[separator+3]
+	}
+	return mount, nil
+}
+
+// unescapeMountPath decodes the octal escapes the kernel uses for
+// space, tab, newline and backslash in mountinfo paths. For example,
+// "/mnt/my\040disk" becomes "/mnt/my disk".
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var builder strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) && isOctal(path[i+1:i+4]) {
+			value, _ := strconv.ParseUint(path[i+1:i+4], 8, 8)
+			builder.WriteByte(byte(value))
+			i += 3
+		} else {
+			builder.WriteByte(path[i])
+		}
+	}
+	return builder.String()
+}
+
+func isOctal(digits string) bool {
+	for _, c := range digits {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return len(digits) == 3 && digits[0] <= '3'
+}
+
+// dfLine matches a line of POSIX "df -P" output. The mountpoint is
+// everything after the capacity column, so it may contain spaces.
+var dfLine = regexp.MustCompile(`^(.+?)\s+\d+\s+\d+\s+\d+\s+\d+%\s+(/.*)$`)
+
+// ParseDfOutput parses the output of "df -P" into a MountTable. This is
+// for systems without /proc/self/mountinfo. The resulting entries
+// include only Source and MountPoint.
+func ParseDfOutput(reader io.Reader) (MountTable, error) {
+	table := make(MountTable, 0)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		match := dfLine.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			// Header, or something we don't understand.
+			continue
+		}
+		table = append(table, MountInfo{
+			Root:       "/",
+			Source:     match[1],
+			MountPoint: match[2],
+		})
+	}
+	return table, scanner.Err()
+}
+
+// Lookup returns the mount containing path, which should be absolute.
+// The mount whose mountpoint is the longest whole-component prefix of
+// path wins, so "/mnt/data2/file" is on "/mnt/data2", not "/mnt/data".
+// If something is mounted more than once at the same mountpoint, the
+// last mount hides the earlier ones, as it does in the kernel.
+func (table MountTable) Lookup(path string) (MountInfo, bool) {
+	path = filepath.Clean(path)
+	best := -1
+	bestLen := -1
+	for i, mount := range table {
+		if !pathIsUnder(path, mount.MountPoint) {
+			continue
+		}
+		if len(mount.MountPoint) >= bestLen {
+			best = i
+			bestLen = len(mount.MountPoint)
+		}
+	}
+	if best < 0 {
+		return MountInfo{}, false
+	}
+	return table[best], true
+}
+
+// Aliases returns the mountpoints of every mount in the table that is
+// on the same filesystem as mount, including mount itself. Bind mounts
+// show up here as aliases of the filesystem they're bound from.
+func (table MountTable) Aliases(mount MountInfo) []string {
+	aliases := []string{mount.MountPoint}
+	for _, other := range table {
+		if other.MountPoint != mount.MountPoint && other.sameFilesystem(mount) {
+			aliases = append(aliases, other.MountPoint)
+		}
+	}
+	return aliases
+}
+
+// sameFilesystem returns true if both mounts are on the same device.
+// Mounts from mountinfo carry a device number. Mounts from df don't,
+// so we compare their sources instead.
+func (mount MountInfo) sameFilesystem(other MountInfo) bool {
+	if mount.ID != 0 && other.ID != 0 {
+		return mount.Major == other.Major && mount.Minor == other.Minor
+	}
+	return mount.Source != "" && mount.Source == other.Source
+}
+
+// DeviceID returns the ID of the device containing path, which must
+// exist. This is st_dev from stat(2). Every mountpoint of a filesystem
+// has the same device ID.
+func DeviceID(path string) (uint64, error) {
+	stat := &syscall.Stat_t{}
+	err := syscall.Stat(path, stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Dev), nil
+}
+
+// pathIsUnder returns true if path is dir or is inside dir.
+// Both should be clean, absolute paths.
+func pathIsUnder(path, dir string) bool {
+	if dir == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// ReadMountTable returns the current process's mount table. On Linux,
+// this comes from /proc/self/mountinfo. Elsewhere, it comes from df.
+func ReadMountTable() (MountTable, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("windows is not supported :(")
+	}
+	return readMountTable()
+}
+
+// GetMountPointFromPath returns the mountpoint of the filesystem
+// containing path. Symlinks in the part of path that exists are
+// resolved first, so a path under a symlink to another volume is
+// reported on that volume.
+func GetMountPointFromPath(path string) (string, error) {
+	table, err := ReadMountTable()
+	if err != nil {
+		return "", err
+	}
+	mount, ok := table.Lookup(resolvePath(path))
+	if !ok {
+		return "", fmt.Errorf("no mountpoint contains '%s'", path)
+	}
+	return mount.MountPoint, nil
+}
+
+// resolvePath returns the absolute form of path with symlinks resolved
+// in its longest existing prefix. The part of path that doesn't exist
+// yet (the file the caller is reserving space for, say) is left as is.
+func resolvePath(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	path = absPath
+	missing := ""
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+				return filepath.Join(resolved, missing)
+			}
+			return path
+		}
+		if dir == filepath.Dir(dir) {
+			return path
+		}
+		missing = filepath.Join(filepath.Base(dir), missing)
+	}
+}
@@ -0,0 +1,17 @@
+package core
+
+import (
+	"os"
+)
+
+// MountInfoFile is where Linux lists the current process's mounts.
+const MountInfoFile = "/proc/self/mountinfo"
+
+func readMountTable() (MountTable, error) {
+	file, err := os.Open(MountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMountInfo(file)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"bytes"
+	"os/exec"
+)
+
+// Without /proc/self/mountinfo, we fall back to df. This uses df in a
+// safe way (without passing through any user-supplied input). The -P
+// flag gives us one line per filesystem in a predictable format.
+func readMountTable() (MountTable, error) {
+	out, err := exec.Command("df", "-P").Output()
+	if err != nil {
+		return nil, err
+	}
+	return ParseDfOutput(bytes.NewReader(out))
+}
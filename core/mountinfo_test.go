@@ -0,0 +1,160 @@
+package core_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadMountTable(t *testing.T, fixture string) core.MountTable {
+	file, err := os.Open(filepath.Join("testdata", "mountinfo", fixture))
+	require.Nil(t, err)
+	defer file.Close()
+	var table core.MountTable
+	if fixture == "df.txt" {
+		table, err = core.ParseDfOutput(file)
+	} else {
+		table, err = core.ParseMountInfo(file)
+	}
+	require.Nil(t, err)
+	return table
+}
+
+func TestParseMountInfo(t *testing.T) {
+	table := loadMountTable(t, "host.txt")
+	require.Len(t, table, 8)
+	expected := core.MountInfo{
+		ID:           31,
+		ParentID:     28,
+		Major:        8,
+		Minor:        17,
+		Root:         "/",
+		MountPoint:   "/mnt/data",
+		Options:      "rw,relatime",
+		FsType:       "xfs",
+		Source:       "/dev/sdb1",
+		SuperOptions: "rw,attr2,inode64,noquota",
+	}
+	assert.Equal(t, expected, table[5])
+
+	// Bind mount of a subdirectory, with several optional fields.
+	table = loadMountTable(t, "escaped.txt")
+	require.Len(t, table, 4)
+	assert.Equal(t, "/sub dir", table[3].Root)
+	assert.Equal(t, "/mnt/bind of sub", table[3].MountPoint)
+	assert.Equal(t, "ext4", table[3].FsType)
+	assert.Equal(t, "/dev/sdd1", table[3].Source)
+}
+
+func TestParseMountInfoErrors(t *testing.T) {
+	badLines := []string{
+		"36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 ext3 /dev/root rw",
+		"36 35 98:0 /mnt1 /mnt2 rw,noatime -",
+		"x 35 98:0 /mnt1 /mnt2 rw,noatime - ext3 /dev/root rw",
+		"36 35 98 /mnt1 /mnt2 rw,noatime - ext3 /dev/root rw",
+	}
+	for _, line := range badLines {
+		_, err := core.ParseMountInfo(bytes.NewBufferString(line))
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestMountTableLookup(t *testing.T) {
+	testCases := []struct {
+		fixture    string
+		path       string
+		mountPoint string
+		major      int
+		minor      int
+	}{
+		{"host.txt", "/", "/", 8, 2},
+		{"host.txt", "/etc/hosts", "/", 8, 2},
+		{"host.txt", "/mnt/data", "/mnt/data", 8, 17},
+		{"host.txt", "/mnt/data/", "/mnt/data", 8, 17},
+		{"host.txt", "/mnt/data/bag/file.tar", "/mnt/data", 8, 17},
+		{"host.txt", "/mnt/data2/bag/file.tar", "/mnt/data2", 8, 33},
+		{"host.txt", "/mnt/data3/file.tar", "/", 8, 2},
+		{"host.txt", "/mnt/data/../data2/x", "/mnt/data2", 8, 33},
+		{"host.txt", "/tmp/some_file", "/tmp", 0, 26},
+		{"host.txt", "/tmpfile", "/", 8, 2},
+		{"container.txt", "/var/tmp/x", "/", 0, 52},
+		{"container.txt", "/data/ingest/bag.tar", "/data/ingest", 8, 17},
+		{"container.txt", "/staging/bag.tar", "/staging", 8, 17},
+		{"container.txt", "/data/restore/bag.tar", "/data/restore", 8, 17},
+		{"container.txt", "/data/other/bag.tar", "/", 0, 52},
+		{"container.txt", "/etc/hosts", "/etc/hosts", 8, 2},
+		{"escaped.txt", "/mnt/my disk/file", "/mnt/my disk", 8, 17},
+		{"escaped.txt", "/mnt/my/file", "/", 8, 2},
+		{"escaped.txt", "/mnt/tab\tand\\backslash/file", "/mnt/tab\tand\\backslash", 8, 33},
+		{"escaped.txt", "/mnt/bind of sub/x", "/mnt/bind of sub", 8, 49},
+		{"overmount.txt", "/mnt/data/file", "/mnt/data", 8, 33},
+		{"df.txt", "/Users/me/file", "/", 0, 0},
+		{"df.txt", "/Volumes/My Backup/file", "/Volumes/My Backup", 0, 0},
+		{"df.txt", "/Volumes/Data2/file", "/Volumes/Data2", 0, 0},
+		{"df.txt", "/Volumes/Data/file", "/Volumes/Data", 0, 0},
+		{"df.txt", "/Volumes/Dat/file", "/", 0, 0},
+	}
+	for _, tc := range testCases {
+		table := loadMountTable(t, tc.fixture)
+		mount, ok := table.Lookup(tc.path)
+		require.True(t, ok, "%s: %s", tc.fixture, tc.path)
+		assert.Equal(t, tc.mountPoint, mount.MountPoint, "%s: %s", tc.fixture, tc.path)
+		assert.Equal(t, tc.major, mount.Major, "%s: %s", tc.fixture, tc.path)
+		assert.Equal(t, tc.minor, mount.Minor, "%s: %s", tc.fixture, tc.path)
+	}
+}
+
+func TestMountTableLookupEmpty(t *testing.T) {
+	_, ok := core.MountTable{}.Lookup("/mnt/data")
+	assert.False(t, ok)
+}
+
+func TestGetMountPointFromPath(t *testing.T) {
+	mountpoint, err := core.GetMountPointFromPath("/")
+	require.Nil(t, err)
+	assert.Equal(t, "/", mountpoint)
+
+	// Works for files that don't exist yet.
+	dir := t.TempDir()
+	expected, err := core.GetMountPointFromPath(dir)
+	require.Nil(t, err)
+	mountpoint, err = core.GetMountPointFromPath(filepath.Join(dir, "not", "yet", "created"))
+	require.Nil(t, err)
+	assert.Equal(t, expected, mountpoint)
+}
+
+func TestMountTableAliases(t *testing.T) {
+	table := loadMountTable(t, "container.txt")
+	mount, ok := table.Lookup("/staging/bag.tar")
+	require.True(t, ok)
+	expected := []string{"/staging", "/data/ingest", "/data/restore"}
+	assert.Equal(t, expected, table.Aliases(mount))
+
+	mount, ok = table.Lookup("/var/tmp")
+	require.True(t, ok)
+	assert.Equal(t, []string{"/"}, table.Aliases(mount))
+
+	// df output has no device numbers, so we go by source.
+	table = loadMountTable(t, "df.txt")
+	mount, ok = table.Lookup("/Volumes/Data")
+	require.True(t, ok)
+	assert.Equal(t, []string{"/Volumes/Data"}, table.Aliases(mount))
+}
+
+func TestDeviceID(t *testing.T) {
+	dir := t.TempDir()
+	parent, err := core.DeviceID(dir)
+	require.Nil(t, err)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "child"), 0755))
+	child, err := core.DeviceID(filepath.Join(dir, "child"))
+	require.Nil(t, err)
+	assert.Equal(t, parent, child)
+
+	_, err = core.DeviceID(filepath.Join(dir, "does_not_exist"))
+	assert.NotNil(t, err)
+}
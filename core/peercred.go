@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// PeerCred identifies the local process on the other end of a Unix
+// socket connection, as reported by the kernel (SO_PEERCRED on Linux).
+// Unlike the ClientHeader, the client can't forge it.
+type PeerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// uidPrefix starts the identity of a client that connected over a
+// Unix socket, as in "uid:1000". Only the kernel can vouch for these,
+// so no token or certificate may claim one.
+const uidPrefix = "uid:"
+
+// uidName returns the identity of the client with credentials cred.
+func uidName(cred *PeerCred) string {
+	return fmt.Sprintf("%s%d", uidPrefix, cred.UID)
+}
+
+func (cred *PeerCred) String() string {
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", cred.UID, cred.GID, cred.PID)
+}
+
+// peerCredKey is the context key under which the connection context
+// of a Unix socket connection holds the peer's *PeerCred.
+type peerCredKey struct{}
+
+// withPeerCred adds the credentials of the process on the other end
+// of conn to ctx, if conn is a Unix socket connection. It's meant to
+// be an http.Server's ConnContext.
+func withPeerCred(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := getPeerCred(unixConn)
+	if err != nil || cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// peerCredFrom returns the peer credentials withPeerCred stored in
+// ctx, or nil if there are none.
+func peerCredFrom(ctx context.Context) *PeerCred {
+	cred, _ := ctx.Value(peerCredKey{}).(*PeerCred)
+	return cred
+}
+
+// listenUnix creates a Unix socket at path with the specified file
+// mode, replacing any socket left over from an earlier run. The socket
+// is created in a private directory next to path and renamed into
+// place once it has the right mode, so nobody can connect to it while
+// it still has the permissions the umask gave it.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".vreserve-sock-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Chmod(dir, 0700); err != nil {
+		return nil, err
+	}
+	tmpPath := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would unlink tmpPath on close, which is gone by
+	// then, so unixListener removes the socket at path instead.
+	listener.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmpPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener is a Unix socket listener that removes its socket file
+// when it's closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener *unixListener) Close() error {
+	err := listener.UnixListener.Close()
+	os.Remove(listener.path)
+	return err
+}
@@ -0,0 +1,27 @@
+package core
+
+import (
+	"net"
+	"syscall"
+)
+
+// getPeerCred returns the credentials of the process on the other end
+// of conn, using SO_PEERCRED.
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &PeerCred{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}, nil
+}
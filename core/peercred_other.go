@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package core
+
+import (
+	"net"
+)
+
+// getPeerCred returns nil, because SO_PEERCRED is Linux-only. Clients
+// connecting over a Unix socket on other systems are identified by the
+// ClientHeader alone.
+func getPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, nil
+}
@@ -0,0 +1,123 @@
+package core_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveUnix serves service on a Unix socket in a temp directory and
+// returns the socket's path once it's accepting connections.
+func serveUnix(t *testing.T, service *core.VolumeService) string {
+	socketPath := filepath.Join(t.TempDir(), "vreserve.sock")
+	go service.ServeUnix(socketPath, 0600)
+	client := core.NewVolumeClient("unix://" + socketPath)
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Ping(100) != nil {
+		require.True(t, time.Now().Before(deadline), "socket never came up")
+		time.Sleep(10 * time.Millisecond)
+	}
+	return socketPath
+}
+
+func TestUnixSocket(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	socketPath := serveUnix(t, service)
+
+	info, err := os.Stat(socketPath)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.NotZero(t, info.Mode()&os.ModeSocket)
+
+	client := core.NewVolumeClient("unix://" + socketPath)
+	assert.Equal(t, "unix://"+socketPath, client.BaseURL())
+	path := filepath.Join(os.TempDir(), "unix_socket_file")
+	id, err := client.AddReservation(path, 1000, 0)
+	require.Nil(t, err)
+
+	reservations, err := client.Reservations(path)
+	require.Nil(t, err)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, id, reservations[0].ID)
+	if runtime.GOOS != "linux" {
+		assert.Nil(t, reservations[0].Peer)
+		return
+	}
+	// The service knows who we are without our saying so.
+	peer := reservations[0].Peer
+	require.NotNil(t, peer)
+	assert.EqualValues(t, os.Getuid(), peer.UID)
+	assert.EqualValues(t, os.Getgid(), peer.GID)
+	assert.EqualValues(t, os.Getpid(), peer.PID)
+	assert.Equal(t, fmt.Sprintf("uid:%d", os.Getuid()), reservations[0].Client)
+
+	// A client that names itself still has its credentials recorded.
+	named := core.NewVolumeClient("unix://"+socketPath, core.WithClientName("named"))
+	id, err = named.AddReservation(path, 500, 0)
+	require.Nil(t, err)
+	found := false
+	for _, r := range service.ReservationList(path) {
+		if r.ID == id {
+			found = true
+			assert.Equal(t, "named", r.Client)
+			assert.Equal(t, peer, r.Peer)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestUnixSocketReplacesStaleSocket(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	socketPath := serveUnix(t, service)
+
+	// A second service takes over the socket, as it would after a
+	// crash left the old one behind.
+	other := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	require.Nil(t, os.Chmod(socketPath, 0600))
+	go other.ServeUnix(socketPath, 0660)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := os.Stat(socketPath)
+		if err == nil && info.Mode().Perm() == 0660 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "socket never replaced")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// But it won't clobber a regular file.
+	filePath := filepath.Join(t.TempDir(), "not_a_socket")
+	require.Nil(t, os.WriteFile(filePath, []byte("data"), 0644))
+	assert.NotNil(t, other.ServeUnix(filePath, 0660))
+}
+
+func TestListenUnixMode(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "vreserve.sock")
+	listener, err := core.ListenUnix(socketPath, 0600)
+	require.Nil(t, err)
+
+	// The socket has its final mode as soon as it's at socketPath, and
+	// the private directory it was made in is gone.
+	info, err := os.Stat(socketPath)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.NotZero(t, info.Mode()&os.ModeSocket)
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "vreserve.sock", entries[0].Name())
+
+	// Closing the listener removes the socket.
+	require.Nil(t, listener.Close())
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AnyClient is the client name for a default quota, which applies to
+// each client that has no quota of its own.
+const AnyClient = "*"
+
+// Quota limits the number of bytes a client can hold in reservations.
+// If Volume is empty, the limit applies to the client's reservations
+// on all volumes combined. Otherwise, it applies only to reservations
+// on the volume mounted at Volume. A client can have both kinds of
+// quota, and a request must fit within both.
+//
+// Client is the client's identity, which HTTP clients send in the
+// X-Vreserve-Client header. A Client of AnyClient ("*") sets a default
+// for clients that don't have a quota of their own. Each client gets
+// the full default; clients don't share it.
+type Quota struct {
+	Client string `json:"client"`
+	Volume string `json:"volume,omitempty"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// QuotaUsage describes how much of a quota a client is using. Used
+// includes bytes the client is waiting for in the queue.
+type QuotaUsage struct {
+	Client string
+	Volume string `json:",omitempty"`
+	Bytes  uint64
+	Used   uint64
+}
+
+// QuotaError is the error returned when a request would put a client
+// over its quota. The request may well have fit on the disk.
+type QuotaError struct {
+	Quota     Quota
+	Used      uint64
+	Requested uint64
+}
+
+func (err *QuotaError) Error() string {
+	scope := "on all volumes"
+	if err.Quota.Volume != "" {
+		scope = fmt.Sprintf("on %s", err.Quota.Volume)
+	}
+	return fmt.Sprintf("client '%s' requested %d bytes, but has already "+
+		"reserved %d of its %d byte quota %s", err.Quota.Client,
+		err.Requested, err.Used, err.Quota.Bytes, scope)
+}
+
+// quotaKey identifies a quota. Volume is empty for quotas that apply
+// to all volumes.
+type quotaKey struct {
+	client string
+	volume string
+}
+
+// quotaTable is a set of quotas, indexed for lookup.
+type quotaTable map[quotaKey]uint64
+
+// newQuotaTable indexes quotas, and checks that no client has more
+// than one quota for the same volume.
+func newQuotaTable(quotas []Quota) (quotaTable, error) {
+	table := make(quotaTable, len(quotas))
+	for _, quota := range quotas {
+		if quota.Client == "" {
+			return nil, fmt.Errorf("quota for %d bytes has no client", quota.Bytes)
+		}
+		key := quotaKey{quota.Client, quota.Volume}
+		if _, exists := table[key]; exists {
+			return nil, fmt.Errorf("client '%s' has more than one quota for volume '%s'",
+				quota.Client, quota.Volume)
+		}
+		table[key] = quota.Bytes
+	}
+	return table, nil
+}
+
+// lookup returns the quota for client on the volume with the specified
+// mountpoints, or on all volumes if mountPoints is empty. If the client
+// has no quota of its own, this returns the default quota, if there
+// is one.
+func (table quotaTable) lookup(client string, mountPoints []string) (Quota, bool) {
+	for _, name := range []string{client, AnyClient} {
+		if len(mountPoints) == 0 {
+			if bytes, ok := table[quotaKey{name, ""}]; ok {
+				return Quota{Client: client, Bytes: bytes}, true
+			}
+			continue
+		}
+		for _, mountPoint := range mountPoints {
+			if bytes, ok := table[quotaKey{name, mountPoint}]; ok {
+				return Quota{Client: client, Volume: mountPoint, Bytes: bytes}, true
+			}
+		}
+	}
+	return Quota{}, false
+}
+
+// clients returns the names of the clients that have quotas of their
+// own, sorted.
+func (table quotaTable) clients() []string {
+	seen := make(map[string]bool)
+	for key := range table {
+		if key.client != AnyClient {
+			seen[key.client] = true
+		}
+	}
+	clients := make([]string, 0, len(seen))
+	for client := range seen {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	return clients
+}
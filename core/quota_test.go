@@ -0,0 +1,153 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotas(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	dir := os.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	mountPoint, err := core.GetMountPointFromPath(dir)
+	require.Nil(t, err)
+	require.Nil(t, service.SetQuotas([]core.Quota{
+		{Client: "alice", Bytes: 1000},
+		{Client: "alice", Volume: mountPoint, Bytes: 600},
+		{Client: "*", Bytes: 300},
+	}))
+
+	// Alice's volume quota is the tighter one.
+	_, err = service.AddReservation("alice", path("a1"), 500, 0)
+	require.Nil(t, err)
+	_, err = service.AddReservation("alice", path("a2"), 200, 0)
+	var quotaErr *core.QuotaError
+	require.True(t, errors.As(err, &quotaErr), "expected QuotaError, got %v", err)
+	assert.Equal(t, "alice", quotaErr.Quota.Client)
+	assert.Equal(t, mountPoint, quotaErr.Quota.Volume)
+	assert.EqualValues(t, 500, quotaErr.Used)
+	assert.EqualValues(t, 200, quotaErr.Requested)
+	_, err = service.AddReservation("alice", path("a2"), 100, 0)
+	require.Nil(t, err)
+
+	// Everyone else gets the default, each to their own.
+	_, err = service.AddReservation("bob", path("b1"), 300, 0)
+	require.Nil(t, err)
+	_, err = service.AddReservation("bob", path("b2"), 1, 0)
+	assert.True(t, errors.As(err, &quotaErr))
+	_, err = service.AddReservation("carol", path("c1"), 300, 0)
+	require.Nil(t, err)
+
+	// The legacy Reserve replaces, so the old reservation's bytes
+	// don't count against the new one. Quotas can change on the fly.
+	require.Nil(t, service.SetQuotas([]core.Quota{{Client: "*", Bytes: 300}}))
+	require.Nil(t, service.Reserve(path("anon"), 300))
+	require.Nil(t, service.Reserve(path("anon"), 250))
+	assert.NotNil(t, service.Reserve(path("anon_2"), 100))
+
+	usage := service.QuotaUsage(dir)
+	expected := []core.QuotaUsage{
+		{Client: "", Bytes: 300, Used: 250},
+		{Client: "alice", Bytes: 300, Used: 600},
+		{Client: "bob", Bytes: 300, Used: 300},
+		{Client: "carol", Bytes: 300, Used: 300},
+	}
+	assert.Equal(t, expected, usage)
+
+	require.Nil(t, service.SetQuotas(nil))
+	assert.Nil(t, service.QuotaUsage(dir))
+	_, err = service.AddReservation("bob", path("b2"), 1, 0)
+	assert.Nil(t, err)
+}
+
+func TestQuotaCountsQueuedBytes(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	dir := os.TempDir()
+	path := filepath.Join(dir, "queued")
+	require.Nil(t, service.SetQuotas([]core.Quota{{Client: "dave", Bytes: 300}}))
+
+	// The disk is full, so dave's request waits in line.
+	provider.Consume("", 1000000)
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan error, 1)
+	go func() {
+		_, _, err := service.ReserveWait(ctx, "dave", path, 200, 0)
+		results <- err
+	}()
+	waitForQueueLength(t, service, dir, 1)
+
+	// The bytes dave is waiting for count toward his quota.
+	_, _, err := service.ReserveWait(ctx, "dave", path, 200, 0)
+	var quotaErr *core.QuotaError
+	assert.True(t, errors.As(err, &quotaErr), "expected QuotaError, got %v", err)
+	assert.EqualValues(t, 200, quotaErr.Used)
+	usage := service.QuotaUsage(dir)
+	require.Len(t, usage, 1)
+	assert.EqualValues(t, 200, usage[0].Used)
+
+	cancel()
+	assert.True(t, errors.Is(<-results, context.Canceled))
+	assert.EqualValues(t, 0, service.QuotaUsage(dir)[0].Used)
+}
+
+func TestQuotaHTTP(t *testing.T) {
+	runService(t)
+	require.Nil(t, volumeService.SetQuotas([]core.Quota{{Client: "greedy", Bytes: 1000}}))
+	defer volumeService.SetQuotas(nil)
+
+	client := core.NewVolumeClient(serviceUrl, core.WithClientName("greedy"))
+	path := "/tmp/greedy_file"
+	id, err := client.AddReservation(path, 800, time.Minute)
+	require.Nil(t, err)
+	defer client.ReleaseID(id)
+	_, err = client.AddReservation(path, 800, 0)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "quota")
+
+	// Going over quota is a 403, not a 500. A v1 reserve replaces the
+	// reservation at path, so it only goes over with more than 1000.
+	params := url.Values{
+		"path":  {path},
+		"bytes": {"1200"},
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/reserve/", serviceUrl),
+		nil)
+	require.Nil(t, err)
+	req.URL.RawQuery = params.Encode()
+	req.Header.Set(core.ClientHeader, "greedy")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Usage shows up in the report.
+	quotas, err := client.Quotas(path)
+	require.Nil(t, err)
+	assert.Contains(t, quotas, core.QuotaUsage{Client: "greedy", Bytes: 1000, Used: 800})
+
+	reservations, err := client.Reservations(path)
+	require.Nil(t, err)
+	found := false
+	for _, r := range reservations {
+		if r.ID == id {
+			found = true
+			assert.Equal(t, "greedy", r.Client)
+		}
+	}
+	assert.True(t, found)
+}
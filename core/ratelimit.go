@@ -0,0 +1,254 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnyEndpoint is the endpoint name for a default rate limit, which
+// applies to each endpoint that has no limit of its own.
+const AnyEndpoint = "*"
+
+// v2Endpoint is the endpoint name for the v2 API's default rate limit,
+// which applies to each v2 endpoint that has no limit of its own, and
+// to v2 requests that don't match any route.
+const v2Endpoint = "v2"
+
+// rateLimitEndpoints are the names of the endpoints a RateLimit can
+// apply to, which are also the handler names in the latency metrics.
+var rateLimitEndpoints = map[string]bool{
+	AnyEndpoint:       true,
+	"reserve":         true,
+	"release":         true,
+	"renew":           true,
+	"report":          true,
+	"volumes":         true,
+	"audit":           true,
+	"history":         true,
+	"ping":            true,
+	v2Endpoint:        true,
+	"v2.reserve":      true,
+	"v2.reservations": true,
+	"v2.release":      true,
+	"v2.renew":        true,
+	"v2.volumes":      true,
+	"events":          true,
+	"metrics":         true,
+}
+
+// pruneInterval is how often the rate limiter forgets clients whose
+// buckets have refilled.
+const pruneInterval = time.Minute
+
+// RateLimit limits how often each client may call an HTTP endpoint,
+// such as "reserve" or "v2.reserve", or any endpoint without a limit of
+// its own, if Endpoint is AnyEndpoint ("*"). A "v2" limit applies to
+// each v2 endpoint without a limit of its own. Each client gets a bucket of
+// Burst tokens, which refills at Rate tokens per second, and each
+// request takes a token. If Burst is zero, it's Rate, rounded up.
+type RateLimit struct {
+	Endpoint string  `json:"endpoint"`
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst,omitempty"`
+}
+
+// bucketKey identifies a client's bucket for an endpoint.
+type bucketKey struct {
+	endpoint string
+	client   string
+}
+
+// tokenBucket is a client's bucket for an endpoint. Limited is true
+// once the client has been refused, until it's let through again, so
+// the service can log each run of refusals once.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limited bool
+}
+
+// rateLimiter holds the rate limits and each client's buckets.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	limits  map[string]RateLimit
+	buckets map[bucketKey]*tokenBucket
+	now     func() time.Time
+	pruned  time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		limits:  make(map[string]RateLimit),
+		buckets: make(map[bucketKey]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// newRateLimitTable validates limits and returns them by endpoint,
+// with Burst filled in.
+func newRateLimitTable(limits []RateLimit) (map[string]RateLimit, error) {
+	table := make(map[string]RateLimit, len(limits))
+	for _, limit := range limits {
+		if !rateLimitEndpoints[limit.Endpoint] {
+			return nil, fmt.Errorf("rate limit for unknown endpoint '%s'", limit.Endpoint)
+		}
+		if _, ok := table[limit.Endpoint]; ok {
+			return nil, fmt.Errorf("endpoint '%s' has more than one rate limit", limit.Endpoint)
+		}
+		if limit.Rate <= 0 || math.IsInf(limit.Rate, 0) {
+			return nil, fmt.Errorf("rate limit for '%s' must be a positive number of requests per second",
+				limit.Endpoint)
+		}
+		if limit.Burst < 0 {
+			return nil, fmt.Errorf("rate limit for '%s' cannot have a negative burst", limit.Endpoint)
+		}
+		if limit.Burst == 0 {
+			limit.Burst = int(math.Ceil(limit.Rate))
+		}
+		table[limit.Endpoint] = limit
+	}
+	return table, nil
+}
+
+// SetRateLimits replaces the service's rate limits, and forgets every
+// client's bucket. Clients are identified by token name, certificate
+// subject or UID, or else by IP address, never by the ClientHeader,
+// which a client could change with every request to get a fresh
+// bucket. Endpoints without a limit, when there's no AnyEndpoint
+// limit, aren't limited. Pass nil to remove all limits.
+func (service *VolumeService) SetRateLimits(limits []RateLimit) error {
+	table, err := newRateLimitTable(limits)
+	if err != nil {
+		return err
+	}
+	limiter := service.limiter
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.limits = table
+	limiter.buckets = make(map[bucketKey]*tokenBucket)
+	service.auditConfig("set %d rate limits", len(limits))
+	return nil
+}
+
+// allow takes a token from client's bucket for endpoint. If the bucket
+// is empty, allow returns false, along with how long until it has a
+// token, and whether this is the first refusal since the client was
+// last let through.
+func (limiter *rateLimiter) allow(endpoint, client string) (bool, time.Duration, bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limit, ok := limiter.limit(endpoint)
+	if !ok {
+		return true, 0, false
+	}
+	now := limiter.now()
+	if now.Sub(limiter.pruned) > pruneInterval {
+		limiter.prune(now)
+	}
+	key := bucketKey{endpoint, client}
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		limiter.buckets[key] = bucket
+	}
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+elapsed*limit.Rate)
+		bucket.updated = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.limited = false
+		return true, 0, false
+	}
+	wait := time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	first := !bucket.limited
+	bucket.limited = true
+	return false, wait, first
+}
+
+// limit returns the limit for endpoint: its own, or else the "v2"
+// limit for a v2 endpoint, or else the AnyEndpoint limit. It returns
+// false if none of those is set. Caller must hold the mutex.
+func (limiter *rateLimiter) limit(endpoint string) (RateLimit, bool) {
+	if limit, ok := limiter.limits[endpoint]; ok {
+		return limit, true
+	}
+	if strings.HasPrefix(endpoint, v2Endpoint+".") {
+		if limit, ok := limiter.limits[v2Endpoint]; ok {
+			return limit, true
+		}
+	}
+	limit, ok := limiter.limits[AnyEndpoint]
+	return limit, ok
+}
+
+// prune forgets the buckets that would be full by now, since a new
+// bucket would be the same, so idle clients don't take up memory.
+// Caller must hold the mutex.
+func (limiter *rateLimiter) prune(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		limit, _ := limiter.limit(key.endpoint)
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.pruned = now
+}
+
+// rateLimited wraps the handler for endpoint so clients that call it
+// too often get a 429 with a Retry-After header, in the v2 error format
+// for the v2 endpoints and the VolumeResponse format for the others.
+func (service *VolumeService) rateLimited(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := service.rateLimitName(r)
+		ok, wait, first := service.limiter.allow(endpoint, client)
+		if ok {
+			handler(w, r)
+			return
+		}
+		seconds := int(math.Ceil(wait.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		if first {
+			service.logger.Warningf("[%s] Rate limited on %s", client, endpoint)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		message := fmt.Sprintf("Too many requests to %s. Retry after %d seconds.", endpoint, seconds)
+		if endpoint == v2Endpoint || strings.HasPrefix(endpoint, v2Endpoint+".") {
+			writeErrorV2(w, CodeRateLimited, message)
+			return
+		}
+		writeResponse(w, &VolumeResponse{
+			ErrorMessage: message,
+			ErrorCode:    CodeRateLimited,
+		})
+	}
+}
+
+// rateLimitName returns the identity the rate limiter knows the client
+// that sent r by: the name of its token, if it sent a valid one, or
+// else the identity the ACL knows it by, or else its IP address. Limits
+// apply before authorize checks the token, so an invalid one counts as
+// none.
+func (service *VolumeService) rateLimitName(r *http.Request) string {
+	ctx, err := service.authenticate(r.Context(), bearerToken(r.Header.Get("Authorization")))
+	if token := callerToken(ctx); err == nil && token != nil {
+		return token.Name
+	}
+	if name := aclName(r); name != AnyClient {
+		return name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
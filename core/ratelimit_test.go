@@ -0,0 +1,166 @@
+package core_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimits(t *testing.T) {
+	service := newTokenService(t)
+	require.Nil(t, service.SetRateLimits([]core.RateLimit{
+		{Endpoint: "reserve", Rate: 0.5, Burst: 2},
+		{Endpoint: "v2", Rate: 0.5, Burst: 1},
+	}))
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := func(name string) *core.VolumeClient {
+		return core.NewVolumeClient(server.URL, core.WithToken(name+"-secret"), core.WithRateLimitRetries(0))
+	}
+	path := filepath.Join(os.TempDir(), "rate_limit_file")
+
+	_, err := client("ingest").AddReservation(path, 1, 0)
+	require.Nil(t, err)
+	_, err = client("ingest").AddReservation(path, 1, 0)
+	require.Nil(t, err)
+	_, err = client("ingest").AddReservation(path, 1, 0)
+	assert.True(t, errors.Is(err, core.ErrRateLimited), "got %v", err)
+	var serviceErr *core.ServiceError
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, http.StatusTooManyRequests, serviceErr.StatusCode)
+	assert.Equal(t, 2*time.Second, serviceErr.RetryAfter)
+	assert.Len(t, service.ReservationList(path), 2)
+
+	// Each client has its own bucket, and other endpoints aren't limited.
+	_, err = client("restore").AddReservation(path, 1, 0)
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = client("ingest").Reservations(path)
+		assert.Nil(t, err)
+	}
+
+	// The v2 API reports the limit in its own format.
+	post := func() *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v2/reservations",
+			strings.NewReader(fmt.Sprintf(`{"path": %q, "bytes": 1}`, path)))
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer ingest-secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusCreated, post().StatusCode)
+	resp := post()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	errResp := core.ErrorResponseV2{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, core.CodeRateLimited, errResp.Error.Code)
+
+	// Each v2 route has its own bucket, so a client that's used up its
+	// reserves can still list volumes and release what it holds.
+	get := func(resource string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+resource, nil)
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer ingest-secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	assert.Equal(t, http.StatusOK, get("/v2/volumes").StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, get("/v2/volumes").StatusCode)
+	assert.Equal(t, http.StatusOK, get("/v2/reservations").StatusCode)
+
+	// A route's own limit overrides the v2 limit.
+	require.Nil(t, service.SetRateLimits([]core.RateLimit{
+		{Endpoint: "v2", Rate: 0.5, Burst: 1},
+		{Endpoint: "v2.volumes", Rate: 0.5, Burst: 3},
+	}))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, get("/v2/volumes").StatusCode)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, get("/v2/volumes").StatusCode)
+	assert.Equal(t, http.StatusCreated, post().StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, post().StatusCode)
+
+	// Buckets refill at the rate.
+	require.Nil(t, service.SetRateLimits([]core.RateLimit{{Endpoint: core.AnyEndpoint, Rate: 10, Burst: 1}}))
+	assert.Nil(t, client("ingest").Ping(1000))
+	assert.NotNil(t, client("ingest").ReleaseID("no-such-id"))
+	err = client("ingest").ReleaseID("no-such-id")
+	assert.True(t, errors.Is(err, core.ErrRateLimited), "got %v", err)
+	time.Sleep(150 * time.Millisecond)
+	err = client("ingest").ReleaseID("no-such-id")
+	assert.True(t, errors.Is(err, core.ErrNotFound), "got %v", err)
+}
+
+func TestRateLimitsIgnoreDeclaredNames(t *testing.T) {
+	// A client can't get a fresh bucket by calling itself something
+	// else, since without a token it's known by its IP address.
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	require.Nil(t, service.SetRateLimits([]core.RateLimit{{Endpoint: "reserve", Rate: 0.5, Burst: 1}}))
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	client := func(name string) *core.VolumeClient {
+		return core.NewVolumeClient(server.URL, core.WithClientName(name), core.WithRateLimitRetries(0))
+	}
+	path := filepath.Join(os.TempDir(), "rate_limit_declared_file")
+
+	_, err := client("first").AddReservation(path, 1, 0)
+	require.Nil(t, err)
+	_, err = client("second").AddReservation(path, 1, 0)
+	assert.True(t, errors.Is(err, core.ErrRateLimited), "got %v", err)
+}
+
+func TestClientHonorsRetryAfter(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"ErrorCode":"RATE_LIMITED","ErrorMessage":"slow down"}`)
+			return
+		}
+		// The retried request still has its params.
+		assert.Equal(t, "retried_file", r.FormValue("path"))
+		fmt.Fprint(w, `{"Succeeded":true,"ID":"abc"}`)
+	}))
+	defer server.Close()
+
+	id, err := core.NewVolumeClient(server.URL).AddReservation("retried_file", 100, 0)
+	require.Nil(t, err)
+	assert.Equal(t, "abc", id)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&attempts))
+
+	atomic.StoreInt32(&attempts, 0)
+	_, err = core.NewVolumeClient(server.URL, core.WithRateLimitRetries(1)).AddReservation("retried_file", 100, 0)
+	assert.True(t, errors.Is(err, core.ErrRateLimited), "got %v", err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&attempts))
+}
+
+func TestSetRateLimits(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	assert.NotNil(t, service.SetRateLimits([]core.RateLimit{{Endpoint: "nope", Rate: 1}}))
+	assert.NotNil(t, service.SetRateLimits([]core.RateLimit{{Endpoint: "reserve", Rate: -1}}))
+	assert.NotNil(t, service.SetRateLimits([]core.RateLimit{{Endpoint: "reserve", Rate: 1, Burst: -1}}))
+	assert.NotNil(t, service.SetRateLimits([]core.RateLimit{
+		{Endpoint: "reserve", Rate: 1},
+		{Endpoint: "reserve", Rate: 2},
+	}))
+	assert.Nil(t, service.SetRateLimits([]core.RateLimit{{Endpoint: "*", Rate: 0.1}}))
+	assert.Nil(t, service.SetRateLimits(nil))
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"syscall"
+)
+
+// VolumeStats describes the capacity of a filesystem. FreeBytes
+// includes space reserved for the superuser. AvailableBytes does not,
+// so it's what matters to ordinary processes, and it's what the Volume
+// uses to decide whether a reservation fits.
+type VolumeStats struct {
+	TotalBytes     uint64
+	FreeBytes      uint64
+	AvailableBytes uint64
+	TotalInodes    uint64
+	FreeInodes     uint64
+}
+
+// StatProvider measures the capacity of the filesystem mounted at a
+// path. StatfsProvider asks the operating system. FakeStatProvider
+// lets tests simulate disks in any state they like.
+type StatProvider interface {
+	Stat(path string) (VolumeStats, error)
+}
+
+// StatfsProvider gets volume stats from the statfs system call.
+type StatfsProvider struct{}
+
+// Stat returns the stats for the filesystem containing path.
+func (StatfsProvider) Stat(path string) (VolumeStats, error) {
+	stat := &syscall.Statfs_t{}
+	err := syscall.Statfs(path, stat)
+	if err != nil {
+		return VolumeStats{}, err
+	}
+	blockSize := uint64(stat.Bsize)
+	return VolumeStats{
+		TotalBytes:     blockSize * uint64(stat.Blocks),
+		FreeBytes:      blockSize * uint64(stat.Bfree),
+		AvailableBytes: blockSize * uint64(stat.Bavail),
+		TotalInodes:    uint64(stat.Files),
+		FreeInodes:     uint64(stat.Ffree),
+	}, nil
+}
@@ -0,0 +1,100 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatfsProvider(t *testing.T) {
+	stats, err := core.StatfsProvider{}.Stat(os.TempDir())
+	require.Nil(t, err)
+	assert.True(t, stats.TotalBytes > 0)
+	assert.True(t, stats.FreeBytes <= stats.TotalBytes)
+	assert.True(t, stats.AvailableBytes <= stats.FreeBytes)
+
+	_, err = core.StatfsProvider{}.Stat("/this/path/does/not/exist")
+	assert.NotNil(t, err)
+}
+
+func TestFakeStatProvider(t *testing.T) {
+	provider := core.NewFakeStatProvider(1000)
+	stats, err := provider.Stat("/mnt/data")
+	require.Nil(t, err)
+	assert.EqualValues(t, 1000, stats.TotalBytes)
+	assert.EqualValues(t, 1000, stats.AvailableBytes)
+
+	// Consuming space on one disk doesn't affect the others.
+	provider.Consume("/mnt/data", 400)
+	stats, _ = provider.Stat("/mnt/data")
+	assert.EqualValues(t, 600, stats.FreeBytes)
+	assert.EqualValues(t, 600, stats.AvailableBytes)
+	stats, _ = provider.Stat("/mnt/other")
+	assert.EqualValues(t, 1000, stats.AvailableBytes)
+
+	// Free space can't go below zero or above the size of the disk.
+	provider.Consume("/mnt/data", 5000)
+	stats, _ = provider.Stat("/mnt/data")
+	assert.EqualValues(t, 0, stats.AvailableBytes)
+	provider.Reclaim("/mnt/data", 5000)
+	stats, _ = provider.Stat("/mnt/data")
+	assert.EqualValues(t, 1000, stats.AvailableBytes)
+
+	provider.SetError(errors.New("disk on fire"))
+	_, err = provider.Stat("/mnt/data")
+	assert.NotNil(t, err)
+	provider.SetError(nil)
+	_, err = provider.Stat("/mnt/data")
+	assert.Nil(t, err)
+}
+
+func TestVolumeAlmostFull(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	volume := core.NewVolume("/mnt/data", provider)
+	require.Nil(t, volume.Reserve("/mnt/data/file_1", 4000))
+
+	// Another process fills up most of the disk.
+	provider.Consume("/mnt/data", 5000)
+	available, err := volume.AvailableSpace()
+	require.Nil(t, err)
+	assert.EqualValues(t, 1000, available)
+	assert.NotNil(t, volume.Reserve("/mnt/data/file_2", 2000))
+	assert.Nil(t, volume.Reserve("/mnt/data/file_2", 999))
+
+	// The other process writes past our reservations.
+	provider.Consume("/mnt/data", 3000)
+	available, err = volume.AvailableSpace()
+	require.Nil(t, err)
+	assert.EqualValues(t, 0, available)
+
+	provider.SetError(errors.New("I/O error"))
+	_, err = volume.AvailableSpace()
+	assert.NotNil(t, err)
+	assert.NotNil(t, volume.Reserve("/mnt/data/file_3", 1))
+}
+
+func TestServiceAlmostFull(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), provider)
+	dir := os.TempDir()
+	path := filepath.Join(dir, "almost_full")
+	provider.Consume("", 9500)
+
+	results := reserveWait(context.Background(), service, path, 2000)
+	waitForQueueLength(t, service, dir, 1)
+
+	// Someone else cleans up. The waiter gets its space on the
+	// next pass of the reaper.
+	provider.Reclaim("", 5000)
+	service.ReapExpired()
+	result := <-results
+	assert.Nil(t, result.err)
+	assert.Equal(t, 1, result.position)
+	assert.EqualValues(t, 2000, service.Reservations(dir)[path])
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadTLSConfig returns a TLS config for the service, with the
+// certificate and key in the PEM files certFile and keyFile. If
+// clientCAFile isn't empty, clients must present a certificate signed
+// by one of the CAs in it, and the service identifies each client by
+// its certificate's subject. See UseTLS.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// UseTLS makes Serve, ServeGRPC and ServeLineProtocol serve over TLS
+// with config, which usually comes from LoadTLSConfig. Clients with
+// verified certificates are identified by the certificate's subject
+// (its common name, if it has one), in place of the ClientHeader.
+// Call this before serving. The Unix socket is local, so it doesn't
+// use TLS.
+func (service *VolumeService) UseTLS(config *tls.Config) {
+	service.tlsConfig = config
+}
+
+// loadCertPool returns a pool of the certificates in the PEM file at
+// path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA file %s has no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// certName returns the identity in the client certificate of a TLS
+// connection: its subject's common name, or the whole subject if it
+// has none. It returns "" unless the certificate was verified, or if
+// the identity is one reserved for Unix socket clients.
+func certName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	subject := state.VerifiedChains[0][0].Subject
+	name := subject.CommonName
+	if name == "" {
+		name = subject.String()
+	}
+	if strings.HasPrefix(name, uidPrefix) {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,261 @@
+package core_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diamondap/vreserve/core"
+	"github.com/diamondap/vreserve/rpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testPKI is a CA and the PEM files of certificates it signed, in a
+// temp dir.
+type testPKI struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+// newTestPKI creates a CA, a certificate for the service on 127.0.0.1
+// ("server"), a client certificate for "ingest" and, from another CA,
+// a client certificate for "stranger".
+func newTestPKI(t *testing.T) *testPKI {
+	pki := &testPKI{dir: t.TempDir()}
+	pki.ca, pki.caKey = pki.issue(t, "ca", "vreserve test CA", nil)
+	pki.issue(t, "server", "vreserve", []net.IP{net.ParseIP("127.0.0.1")})
+	pki.issue(t, "ingest", "ingest", nil)
+	other := &testPKI{dir: t.TempDir()}
+	other.ca, other.caKey = other.issue(t, "ca", "another CA", nil)
+	cert, key := other.issue(t, "stranger", "stranger", nil)
+	pki.write(t, "stranger", cert, key)
+	return pki
+}
+
+// issue creates a certificate with the specified common name, signed
+// by the CA (or self-signed, if the PKI has no CA yet), and writes it
+// and its key to <name>.pem and <name>-key.pem.
+func (pki *testPKI) issue(t *testing.T, name, commonName string, ips []net.IP) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	pki.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(pki.serial),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"vreserve"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  ips,
+	}
+	parent, signer := template, key
+	if pki.ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = pki.ca, pki.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	pki.write(t, name, cert, key)
+	return cert, key
+}
+
+// write writes cert and key to <name>.pem and <name>-key.pem.
+func (pki *testPKI) write(t *testing.T, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(pki.file(name),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600))
+	require.Nil(t, os.WriteFile(pki.file(name+"-key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+// file returns the path of the PEM file <name>.pem.
+func (pki *testPKI) file(name string) string {
+	return filepath.Join(pki.dir, name+".pem")
+}
+
+// newTLSService returns a service that serves TLS with the PKI's
+// server certificate, and requires client certificates if
+// verifyClients is true, along with its TLS config.
+func newTLSService(t *testing.T, pki *testPKI, verifyClients bool) (*core.VolumeService, *tls.Config) {
+	caFile := ""
+	if verifyClients {
+		caFile = pki.file("ca")
+	}
+	config, err := core.LoadTLSConfig(pki.file("server"), pki.file("server-key"), caFile)
+	require.Nil(t, err)
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	service.UseTLS(config)
+	return service, config
+}
+
+// clientTLS returns a TLS config that trusts the PKI's CA and presents
+// the client certificate <name>.pem.
+func (pki *testPKI) clientTLS(t *testing.T, name string) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(pki.ca)
+	cert, err := tls.LoadX509KeyPair(pki.file(name), pki.file(name+"-key"))
+	require.Nil(t, err)
+	return &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}
+}
+
+// serveTLS serves service's HTTP interface over TLS on a random port
+// and returns its URL.
+func serveTLS(t *testing.T, service *core.VolumeService, config *tls.Config) string {
+	server := httptest.NewUnstartedServer(service.Handler())
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.TLS = config
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	service, config := newTLSService(t, pki, false)
+	url := serveTLS(t, service, config)
+	path := filepath.Join(os.TempDir(), "tls_file")
+
+	client := core.NewVolumeClient(url, core.WithCAFile(pki.file("ca")), core.WithClientName("tls"))
+	assert.Nil(t, client.Ping(1000))
+	_, err := client.AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	assert.Equal(t, "tls", service.ReservationList(path)[0].Client)
+
+	// Clients that don't trust the CA can't connect.
+	_, err = core.NewVolumeClient(url).Reservations(path)
+	assert.NotNil(t, err)
+
+	// Errors from options are returned by every call.
+	client = core.NewVolumeClient(url, core.WithCAFile(pki.file("missing")))
+	_, err = client.Reservations(path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot read CA file")
+	assert.NotNil(t, client.Ping(1000))
+	client = core.NewVolumeClient(url, core.WithClientCert(pki.file("ingest"), pki.file("server-key")))
+	_, err = client.Reservations(path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot load client certificate")
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	service, config := newTLSService(t, pki, true)
+	url := serveTLS(t, service, config)
+	path := filepath.Join(os.TempDir(), "mtls_file")
+	client := func(name string) *core.VolumeClient {
+		return core.NewVolumeClient(url, core.WithCAFile(pki.file("ca")),
+			core.WithClientCert(pki.file(name), pki.file(name+"-key")), core.WithClientName("spoof"))
+	}
+
+	// The certificate, not the header, says who the client is.
+	_, err := client("ingest").AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	reservations := service.ReservationList(path)
+	require.Len(t, reservations, 1)
+	assert.Equal(t, "ingest", reservations[0].Client)
+
+	// A certificate can't claim the identity of a Unix socket client,
+	// so the client falls back on the name it declares.
+	pki.issue(t, "impostor", "uid:0", nil)
+	_, err = client("impostor").AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	clients := make([]string, 0)
+	for _, r := range service.ReservationList(path) {
+		clients = append(clients, r.Client)
+	}
+	assert.ElementsMatch(t, []string{"ingest", "spoof"}, clients)
+
+	// Clients without a certificate from the CA can't connect.
+	_, err = client("stranger").Reservations(path)
+	assert.NotNil(t, err)
+	_, err = core.NewVolumeClient(url, core.WithCAFile(pki.file("ca"))).Reservations(path)
+	assert.NotNil(t, err)
+
+	// Tokens still take precedence, and still decide what clients may do.
+	require.Nil(t, service.SetTokens(testTokens))
+	_, err = client("ingest").Reservations(path)
+	assert.ErrorIs(t, err, core.ErrUnauthorized)
+	_, err = core.NewVolumeClient(url, core.WithCAFile(pki.file("ca")),
+		core.WithClientCert(pki.file("ingest"), pki.file("ingest-key")),
+		core.WithToken("restore-secret")).AddReservation(path, 100, 0)
+	require.Nil(t, err)
+	clients = make([]string, 0)
+	for _, r := range service.ReservationList(path) {
+		clients = append(clients, r.Client)
+	}
+	assert.ElementsMatch(t, []string{"ingest", "spoof", "restore"}, clients)
+}
+
+func TestMutualTLSGRPC(t *testing.T) {
+	pki := newTestPKI(t)
+	service, _ := newTLSService(t, pki, true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := service.NewGRPCServer()
+	go server.Serve(listener)
+	t.Cleanup(server.GracefulStop)
+
+	creds := credentials.NewTLS(pki.clientTLS(t, "ingest"))
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(creds))
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	path := filepath.Join(os.TempDir(), "mtls_grpc_file")
+	resp, err := rpc.NewVolumeServiceClient(conn).Reserve(context.Background(),
+		&rpc.ReserveRequest{Path: path, Bytes: 100})
+	require.Nil(t, err)
+	assert.Equal(t, "ingest", resp.Reservation.Client)
+}
+
+func TestMutualTLSLineProtocol(t *testing.T) {
+	pki := newTestPKI(t)
+	service, config := newTLSService(t, pki, true)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		service.ServeLineListener(tls.NewListener(listener, config), false)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), pki.clientTLS(t, "ingest"))
+	require.Nil(t, err)
+	defer conn.Close()
+	lines := &lineClient{conn: conn, scanner: bufio.NewScanner(conn)}
+
+	path := filepath.Join(os.TempDir(), "mtls_line_file")
+	assert.Equal(t, "OK", lines.send(t, "CLIENT spoof"))
+	assert.True(t, strings.HasPrefix(lines.send(t, "RESERVE "+path+" 100"), "OK "))
+	assert.Equal(t, "ingest", service.ReservationList(path)[0].Client)
+}
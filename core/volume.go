@@ -1,22 +1,102 @@
 package core
 
 import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"math"
+	"sort"
 	"sync"
-	"syscall"
+	"time"
 )
 
-// TODO: Use https://godoc.org/github.com/minio/minio/pkg/disk#GetInfo
+// TODO: Write a StatProvider that uses
+// https://godoc.org/github.com/minio/minio/pkg/disk#GetInfo
 // https://github.com/minio/minio/blob/master/pkg/disk/disk.go
 // https://github.com/minio/minio/blob/master/pkg/disk/stat_linux.go#L27
-// To get disk stats. Our current implementation is POSIX-only.
+// To get disk stats. Our StatfsProvider is POSIX-only.
 // Minio's is more robust.
 
 // VolumeResponse contains response data returned by the VolumeService.
+// ID is the ID of a newly granted reservation. Reservations lists the
+// reservations on a volume, and Quotas the quota usage of clients on
+// the volume, for reports. Volumes summarizes every volume the service
+// is tracking.
 type VolumeResponse struct {
 	Succeeded    bool
 	ErrorMessage string
+	ErrorCode    ErrorCode `json:",omitempty"`
 	Data         map[string]uint64
+	MountPoints  []string       `json:",omitempty"`
+	ID           string         `json:",omitempty"`
+	Reservations []Reservation  `json:",omitempty"`
+	Quotas       []QuotaUsage   `json:",omitempty"`
+	Volumes      []VolumeInfo   `json:",omitempty"`
+	AuditEntries []AuditEntry   `json:",omitempty"`
+	History      *VolumeHistory `json:",omitempty"`
+}
+
+// Reservation describes a block of space reserved on a volume. Each
+// reservation has a unique ID, so a single path can hold any number of
+// independent reservations. Expires is nil if the reservation has no
+// lease. Client identifies the client that made the reservation. Peer
+// identifies the process that made it, if it connected over a Unix
+// socket.
+type Reservation struct {
+	ID      string
+	Path    string
+	Bytes   uint64
+	Expires *time.Time `json:",omitempty"`
+	Client  string     `json:",omitempty"`
+	Peer    *PeerCred  `json:",omitempty"`
+}
+
+// SpaceError is the error returned when a volume doesn't have enough
+// space for a reservation, or when earlier requests are waiting for
+// space. Waiting is the number of requests in line.
+type SpaceError struct {
+	Requested uint64
+	Available uint64
+	Waiting   int
+}
+
+func (err *SpaceError) Error() string {
+	if err.Waiting > 0 {
+		return fmt.Sprintf("%d earlier requests are waiting for space "+
+			"on this volume", err.Waiting)
+	}
+	return fmt.Sprintf("requested %d bytes on volume, "+
+		"but only %d are available", err.Requested, err.Available)
+}
+
+// VolumeInfo summarizes a volume, for the /volumes/ report. FreeBytes
+// is the space available according to the operating system, and
+// AvailableBytes is what's left of that after subtracting ClaimedBytes,
+// the space reserved for pending operations. Error is set if the
+// volume's free space can't be measured.
+type VolumeInfo struct {
+	MountPoint     string
+	MountPoints    []string `json:",omitempty"`
+	Device         uint64
+	FsType         string `json:",omitempty"`
+	TotalBytes     uint64
+	FreeBytes      uint64
+	ClaimedBytes   uint64
+	AvailableBytes uint64
+	Reservations   int
+	QueueLength    int
+	Error          string `json:",omitempty"`
+	// BackgroundBytesPerSecond estimates how fast processes that don't
+	// reserve space are filling the volume, and TimeToFull is how long
+	// they'd take to use up AvailableBytes at that rate. They're zero
+	// until the VolumeService has enough samples (see SampleVolumes),
+	// and TimeToFull is zero if the volume isn't filling. Full is true
+	// if the volume is filling and has no unreserved space left, in
+	// which case TimeToFull is zero too.
+	BackgroundBytesPerSecond float64  `json:",omitempty"`
+	TimeToFull               Duration `json:",omitempty"`
+	Full                     bool     `json:",omitempty"`
 }
 
 // Volume tracks the amount of available space on a volume (disk),
@@ -28,26 +108,63 @@ type VolumeResponse struct {
 // we don't have enough space to process them.
 type Volume struct {
 	mountPoint   string
+	mountPoints  []string
+	device       uint64
+	fsType       string
+	stats        StatProvider
 	mutex        *sync.Mutex
 	claimed      uint64
-	reservations map[string]uint64
+	reservations map[string]*reservation
+	made         uint64
+	queue        *list.List
+	consumption  consumptionEstimator
+}
+
+// reservation is a Volume's record of a Reservation. The volume's map
+// of reservations is keyed by ID.
+type reservation struct {
+	client   string
+	peer     *PeerCred
+	path     string
+	numBytes uint64
+	lease    Lease
+	// written is how much of numBytes the holder has written, as far
+	// as the consumption estimator can tell.
+	written uint64
+	// seq orders reservations by when the volume recorded them.
+	seq uint64
+}
+
+// Lease describes how long a reservation lasts before it expires.
+// The holder of a reservation extends the lease by renewing it before
+// it expires. Reservations that were made without a lease never expire.
+type Lease struct {
+	Duration time.Duration
+	Expires  time.Time
 }
 
 // Creates a new Volume object to track free and used space on
 // a volume (disk). Param mountPoint is the point at which the
 // volume is mounted. The volume itself can be a physical disk
-// or a logical partition.
+// or a logical partition. Param stats measures the volume's free
+// space. If it's nil, the volume uses a StatfsProvider.
 //
 // On Mac and *nix systems, use posix.GetMountPointFromPath to
 // get the mountpoint. If you're on Windows, Mr. T pities you,
 // fool! This volume manager won't work for you. Upgrade to a
 // more sensible OS.
-func NewVolume(mountPoint string) *Volume {
+func NewVolume(mountPoint string, stats StatProvider) *Volume {
+	if stats == nil {
+		stats = StatfsProvider{}
+	}
 	volume := &Volume{}
 	volume.mountPoint = mountPoint
+	volume.stats = stats
+	volume.mountPoints = []string{mountPoint}
 	volume.claimed = uint64(0)
 	volume.mutex = &sync.Mutex{}
-	volume.reservations = make(map[string]uint64)
+	volume.reservations = make(map[string]*reservation)
+	volume.queue = list.New()
 	return volume
 }
 
@@ -56,37 +173,148 @@ func (volume *Volume) MountPoint() string {
 	return volume.mountPoint
 }
 
+// MountPoints returns all of the known mountpoints of the volume's
+// filesystem. The first is the same as MountPoint(). The others are
+// aliases, such as bind mounts.
+func (volume *Volume) MountPoints() []string {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	return append([]string{}, volume.mountPoints...)
+}
+
+// Device returns the ID of the device the volume is on, as reported
+// by stat(2). The VolumeService sets this. It's zero for Volumes
+// created directly with NewVolume.
+func (volume *Volume) Device() uint64 {
+	return volume.device
+}
+
+// FsType returns the type of the volume's filesystem, such as "ext4",
+// from the mount table. The VolumeService sets this. It's empty for
+// Volumes created directly with NewVolume.
+func (volume *Volume) FsType() string {
+	return volume.fsType
+}
+
+// Info returns a summary of the volume's capacity and reservations.
+// If the volume's StatProvider fails, Error says why, and TotalBytes,
+// FreeBytes and AvailableBytes are zero.
+func (volume *Volume) Info() VolumeInfo {
+	info := VolumeInfo{
+		MountPoint:  volume.MountPoint(),
+		MountPoints: volume.MountPoints(),
+		Device:      volume.Device(),
+		FsType:      volume.FsType(),
+		QueueLength: volume.QueueLength(),
+	}
+	stats, err := volume.Stats()
+	volume.mutex.Lock()
+	info.ClaimedBytes = volume.claimed
+	info.Reservations = len(volume.reservations)
+	rate, rateOK := volume.consumption.rate()
+	volume.mutex.Unlock()
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.TotalBytes = stats.TotalBytes
+	info.FreeBytes = stats.AvailableBytes
+	info.AvailableBytes = subSaturating(stats.AvailableBytes, info.ClaimedBytes)
+	if rateOK {
+		info.BackgroundBytesPerSecond = rate
+		ttf, filling := timeToFull(info.AvailableBytes, rate)
+		info.TimeToFull = Duration(ttf)
+		info.Full = filling && ttf == 0
+	}
+	return info
+}
+
+// recordConsumption adds a sample of the volume's free bytes to its
+// estimate of background consumption.
+func (volume *Volume) recordConsumption(when time.Time, free uint64) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	holders := make([]*reservation, 0, len(volume.reservations))
+	for _, id := range volume.sortedIDs() {
+		holders = append(holders, volume.reservations[id])
+	}
+	volume.consumption.add(when, free, holders, ConsumptionWindow)
+}
+
+// backgroundRate returns the volume's estimated background consumption
+// in bytes per second, or false if it doesn't have enough samples yet.
+func (volume *Volume) backgroundRate() (float64, bool) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	return volume.consumption.rate()
+}
+
+// setMountPoints records the volume's mountpoints, keeping
+// volume.mountPoint first.
+func (volume *Volume) setMountPoints(mountPoints []string) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	volume.mountPoints = []string{volume.mountPoint}
+	for _, mountPoint := range mountPoints {
+		if mountPoint != volume.mountPoint {
+			volume.mountPoints = append(volume.mountPoints, mountPoint)
+		}
+	}
+}
+
 // Returns the number of bytes claimed but not yet written to disk.
 func (volume *Volume) ClaimedSpace() uint64 {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
 	return volume.claimed
 }
 
+// reservationCount returns the number of reservations on the volume.
+// A path with several reservations counts once for each.
+func (volume *Volume) reservationCount() int {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	return len(volume.reservations)
+}
+
+// Stats returns the capacity of the underlying volume, as reported by
+// the volume's StatProvider. These numbers do not take into account
+// the number of bytes reserved for pending operations.
+func (volume *Volume) Stats() (VolumeStats, error) {
+	stats, err := volume.stats.Stat(volume.mountPoint)
+	if err != nil {
+		return stats, &VolumeUnavailableError{MountPoint: volume.mountPoint, Err: err}
+	}
+	return stats, nil
+}
+
 // currentFreeSpace returns the number of bytes currently available
 // to unprivileged users on the underlying volume. This number comes
-// directly from the operating system's statfs call, and does not
-// take into account the number of bytes reserved for pending operations.
+// directly from the StatProvider (usually the operating system's statfs
+// call), and does not take into account the number of bytes reserved
+// for pending operations.
 func (volume *Volume) currentFreeSpace() (numBytes uint64, err error) {
-	stat := &syscall.Statfs_t{}
-	err = syscall.Statfs(volume.mountPoint, stat)
+	stats, err := volume.Stats()
 	if err != nil {
 		return 0, err
 	}
-	freeBytes := uint64(stat.Bsize) * uint64(stat.Bavail)
-	return freeBytes, nil
+	return stats.AvailableBytes, nil
 }
 
 // AvailableSpace returns an approximate number of free bytes currently
 // available to unprivileged users on the underlying volume, minus the
 // number of bytes reserved for pending processes. The value returned
 // will never be 100% accurate, because other processes may be writing
-// to the volume.
+// to the volume. If more space is claimed than is free, this returns
+// zero.
 func (volume *Volume) AvailableSpace() (uint64, error) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
 	available, err := volume.currentFreeSpace()
 	if err != nil {
 		return uint64(0), err
 	}
-	numBytes := available - volume.claimed
-	return numBytes, nil
+	return subSaturating(available, volume.claimed), nil
 }
 
 // Reserve requests that a number of bytes on disk be reserved for an
@@ -94,39 +322,531 @@ func (volume *Volume) AvailableSpace() (uint64, error) {
 // Reserving space does not have any effect on the file system. It
 // simply allows the Volume struct to maintain some internal bookkeeping.
 // Reserve will return an error if there is not enough free disk space to
-// accommodate the requested number of bytes.
+// accommodate the requested number of bytes, or if other requests are
+// already queued waiting for space on this volume. (Those requests were
+// here first.)
+//
+// Reserving a path that is already reserved replaces all of the old
+// reservations for that path. The space they held counts toward the
+// new one. Use AddReservation if more than one process needs space
+// at the same path.
 func (volume *Volume) Reserve(path string, numBytes uint64) error {
-	available, err := volume.AvailableSpace()
+	return volume.ReserveWithLease(path, numBytes, Lease{})
+}
+
+// ReserveWithLease is like Reserve, but the reservation expires at
+// lease.Expires unless it is renewed. A zero lease never expires.
+func (volume *Volume) ReserveWithLease(path string, numBytes uint64, lease Lease) error {
+	_, err := volume.reserve("", nil, path, numBytes, lease, true)
+	return err
+}
+
+// AddReservation reserves numBytes for path, alongside any existing
+// reservations for path, and returns the new reservation's ID. Pass
+// the ID to ReleaseID and RenewID to release or renew this reservation
+// without affecting others at the same path.
+func (volume *Volume) AddReservation(path string, numBytes uint64, lease Lease) (string, error) {
+	return volume.reserve("", nil, path, numBytes, lease, false)
+}
+
+// reserve grants a new reservation for client if there's space for it
+// and no one is waiting in line. If replace is true, the new reservation
+// replaces all existing reservations for path.
+func (volume *Volume) reserve(client string, peer *PeerCred, path string, numBytes uint64, lease Lease, replace bool) (string, error) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	if waiting := volume.queue.Len(); waiting > 0 {
+		return "", &SpaceError{Requested: numBytes, Waiting: waiting}
+	}
+	available, ok, err := volume.fits(path, numBytes, replace)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if numBytes >= available {
-		err = fmt.Errorf("requested %d bytes on volume, "+
-			"but only %d are available", numBytes, available)
-	} else {
-		volume.mutex.Lock()
-		volume.reservations[path] = numBytes
-		volume.claimed += numBytes
-		volume.mutex.Unlock()
+	if !ok {
+		return "", &SpaceError{Requested: numBytes, Available: available}
 	}
-	return err
+	id := newReservationID()
+	volume.commit(id, reservation{
+		client:   client,
+		peer:     peer,
+		path:     path,
+		numBytes: numBytes,
+		lease:    lease,
+	}, replace)
+	return id, nil
+}
+
+// fits returns true if numBytes can be reserved for path, along with
+// the number of bytes available to path. If replace is true, the
+// existing reservations for path count as available, since the new one
+// will replace them. Checking and committing must happen under a single
+// hold of the mutex, or two requests could both pass the check and
+// together claim more space than there is. Caller must hold the mutex.
+func (volume *Volume) fits(path string, numBytes uint64, replace bool) (uint64, bool, error) {
+	free, err := volume.currentFreeSpace()
+	if err != nil {
+		return 0, false, err
+	}
+	claimedByOthers := volume.claimed
+	if replace {
+		claimedByOthers = subSaturating(claimedByOthers, volume.bytesAt(path))
+	}
+	available := subSaturating(free, claimedByOthers)
+	return available, numBytes < available, nil
+}
+
+// commit records reservation r under id. If replace is true, it first
+// removes all existing reservations for r's path, and r takes over what
+// was written into them, since it's for the same data. Caller must
+// hold the mutex.
+func (volume *Volume) commit(id string, r reservation, replace bool) {
+	if replace {
+		written := uint64(0)
+		for oldID, old := range volume.reservations {
+			if old.path == r.path {
+				written = addSaturating(written, old.written)
+				volume.claimed = subSaturating(volume.claimed, old.numBytes)
+				delete(volume.reservations, oldID)
+			}
+		}
+		r.written = min(written, r.numBytes)
+		volume.consumption.release(written-r.written, 0)
+	}
+	volume.releaseID(id)
+	volume.made++
+	r.seq = volume.made
+	volume.claimed = addSaturating(volume.claimed, r.numBytes)
+	volume.reservations[id] = &r
 }
 
 // Release tells the Volume that the bytes no longer need to be
 // reserved. This could be because they have already been written
 // (and hence will show up in volume.currentFreeSpace()) or because
-// the bytes will not be written at all.
-func (volume *Volume) Release(path string) {
+// the bytes will not be written at all. This releases every
+// reservation for path. It returns false if nothing was reserved
+// for path.
+func (volume *Volume) Release(path string) bool {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	return volume.releasePath(path) > 0
+}
+
+// ReleaseID releases the reservation with the specified ID. It returns
+// false if there is no such reservation.
+func (volume *Volume) ReleaseID(id string) bool {
 	volume.mutex.Lock()
-	numBytes, ok := volume.reservations[path]
+	defer volume.mutex.Unlock()
+	return volume.releaseID(id)
+}
+
+// releasePath releases every reservation for path and returns the
+// number released. Caller must hold the mutex.
+func (volume *Volume) releasePath(path string) int {
+	count := 0
+	for id, r := range volume.reservations {
+		if r.path == path {
+			volume.releaseID(id)
+			count++
+		}
+	}
+	return count
+}
+
+// releaseID releases the reservation with the specified ID. Caller
+// must hold the mutex.
+func (volume *Volume) releaseID(id string) bool {
+	r, ok := volume.reservations[id]
 	if ok {
-		volume.claimed -= numBytes
+		volume.claimed = subSaturating(volume.claimed, r.numBytes)
+		volume.consumption.release(r.written, r.numBytes-r.written)
+		delete(volume.reservations, id)
 	}
-	delete(volume.reservations, path)
-	volume.mutex.Unlock()
+	return ok
+}
+
+// bytesAt returns the total bytes reserved for path. Caller must
+// hold the mutex.
+func (volume *Volume) bytesAt(path string) uint64 {
+	total := uint64(0)
+	for _, r := range volume.reservations {
+		if r.path == path {
+			total = addSaturating(total, r.numBytes)
+		}
+	}
+	return total
+}
+
+// Lease returns the lease on a reservation for path. The second return
+// value is false if there is no such reservation, or if none of the
+// reservations for path has a lease.
+func (volume *Volume) Lease(path string) (Lease, bool) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	for _, id := range volume.sortedIDs() {
+		r := volume.reservations[id]
+		if r.path == path && !r.lease.Expires.IsZero() {
+			return r.lease, true
+		}
+	}
+	return Lease{}, false
+}
+
+// LeaseID returns the lease on the reservation with the specified ID.
+// The second return value is false if there is no such reservation,
+// or if the reservation has no lease.
+func (volume *Volume) LeaseID(id string) (Lease, bool) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	r, ok := volume.reservations[id]
+	if !ok || r.lease.Expires.IsZero() {
+		return Lease{}, false
+	}
+	return r.lease, true
+}
+
+// leasedIDs returns the IDs of the reservations for path that have
+// leases, in the order they were made.
+func (volume *Volume) leasedIDs(path string) []string {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	ids := make([]string, 0)
+	for _, id := range volume.sortedIDs() {
+		r := volume.reservations[id]
+		if r.path == path && !r.lease.Expires.IsZero() {
+			ids = append(ids, id)
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return volume.reservations[ids[i]].seq < volume.reservations[ids[j]].seq
+	})
+	return ids
+}
+
+// Renew replaces the lease on every reservation for path that has a
+// lease. Reservations without leases never expire, and renewing
+// doesn't change that. It returns an error if none of the reservations
+// for path has a lease.
+func (volume *Volume) Renew(path string, lease Lease) error {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	found := false
+	for _, r := range volume.reservations {
+		if r.path == path && !r.lease.Expires.IsZero() {
+			r.lease = lease
+			found = true
+		}
+	}
+	if !found {
+		return notFoundError(fmt.Sprintf("no leased space is reserved for '%s'", path))
+	}
+	return nil
+}
+
+// RenewID replaces the lease on the reservation with the specified ID.
+// It returns an error if there is no such reservation.
+func (volume *Volume) RenewID(id string, lease Lease) error {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	r, ok := volume.reservations[id]
+	if !ok {
+		return notFoundError(fmt.Sprintf("no reservation has ID '%s'", id))
+	}
+	r.lease = lease
+	return nil
+}
+
+// Expired returns the IDs of all reservations whose leases expired
+// at or before now. It does not release them.
+func (volume *Volume) Expired(now time.Time) []string {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	expired := make([]string, 0)
+	for _, id := range volume.sortedIDs() {
+		lease := volume.reservations[id].lease
+		if !lease.Expires.IsZero() && !lease.Expires.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// QueueLength returns the number of requests waiting for space
+// on this volume.
+func (volume *Volume) QueueLength() int {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	return volume.queue.Len()
 }
 
-// This is for reporting and debugging.
+// waiter is a reserve request waiting in a volume's queue for space
+// to become available. The VolumeService closes the ready channel once
+// the request is granted and journaled, or when it's denied because it
+// reached the front of the line and may not replace the reservations
+// for its path, or because its grant couldn't be journaled, in which
+// case err says why.
+type waiter struct {
+	id            string
+	client        string
+	peer          *PeerCred
+	path          string
+	numBytes      uint64
+	leaseDuration time.Duration
+	// replace is true if the request replaces the reservations for
+	// path when it's granted, and replaced holds the reservations it
+	// replaced. Caller is the token of the client that made the
+	// request, which must own them, unless it's nil or an admin's.
+	replace  bool
+	replaced []Reservation
+	caller   *Token
+	err      error
+	ready    chan struct{}
+	element  *list.Element
+}
+
+// enqueue adds a request to the end of the queue and returns it, along
+// with its position in the queue, where 1 is first in line. If replace
+// is true, the request replaces the reservations for path when it's
+// granted, as long as caller may replace them.
+func (volume *Volume) enqueue(caller *Token, client string, peer *PeerCred, path string, numBytes uint64, leaseDuration time.Duration, replace bool) (*waiter, int) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	w := &waiter{
+		id:            newReservationID(),
+		client:        client,
+		peer:          peer,
+		path:          path,
+		numBytes:      numBytes,
+		leaseDuration: leaseDuration,
+		replace:       replace,
+		caller:        caller,
+		ready:         make(chan struct{}),
+	}
+	w.element = volume.queue.PushBack(w)
+	return w, volume.queue.Len()
+}
+
+// dequeue removes w from the queue, returning its position at the
+// time it was removed. It returns zero if w is no longer in the queue
+// because it has already been granted.
+func (volume *Volume) dequeue(w *waiter) int {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	position := 1
+	for e := volume.queue.Front(); e != nil; e = e.Next() {
+		if e == w.element {
+			volume.queue.Remove(e)
+			return position
+		}
+		position++
+	}
+	return 0
+}
+
+// grantNext grants the request at the head of the queue, if there
+// is enough space for it, and returns it. Requests are granted
+// strictly in order: if the first request in line doesn't fit,
+// nobody behind it gets space either. This keeps a stream of small
+// requests from starving a large one. Param newLease returns the lease
+// for a reservation granted now.
+//
+// If the request would replace reservations for its path that its
+// caller doesn't own, grantNext removes it from the queue without
+// granting it, sets its err, and returns it. Either way, the caller
+// must close the request's ready channel.
+func (volume *Volume) grantNext(newLease func(time.Duration) Lease) (*waiter, error) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	front := volume.queue.Front()
+	if front == nil {
+		return nil, nil
+	}
+	w := front.Value.(*waiter)
+	_, ok, err := volume.fits(w.path, w.numBytes, w.replace)
+	if err != nil || !ok {
+		return nil, err
+	}
+	volume.queue.Remove(front)
+	if w.replace {
+		w.replaced = volume.pathReservations(w.path)
+		for _, r := range w.replaced {
+			if w.err = checkOwner(w.caller, r, "replace"); w.err != nil {
+				w.replaced = nil
+				return w, nil
+			}
+		}
+	}
+	volume.commit(w.id, reservation{
+		client:   w.client,
+		peer:     w.peer,
+		path:     w.path,
+		numBytes: w.numBytes,
+		lease:    newLease(w.leaseDuration),
+	}, w.replace)
+	return w, nil
+}
+
+// Reservations returns the total number of bytes reserved for each
+// path on the volume. This is for reporting and debugging. See
+// ReservationList for the individual reservations.
 func (volume *Volume) Reservations() map[string]uint64 {
-	return volume.reservations
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	reservations := make(map[string]uint64, len(volume.reservations))
+	for _, r := range volume.reservations {
+		reservations[r.path] = addSaturating(reservations[r.path], r.numBytes)
+	}
+	return reservations
+}
+
+// ReservationList returns all of the reservations on the volume,
+// sorted by path and then by ID.
+func (volume *Volume) ReservationList() []Reservation {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	list := make([]Reservation, 0, len(volume.reservations))
+	for id, r := range volume.reservations {
+		list = append(list, r.export(id))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Path != list[j].Path {
+			return list[i].Path < list[j].Path
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// reservationsAt returns the reservations for path, sorted by ID.
+func (volume *Volume) reservationsAt(path string) []Reservation {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	return volume.pathReservations(path)
+}
+
+// pathReservations is reservationsAt for callers that already hold
+// the mutex.
+func (volume *Volume) pathReservations(path string) []Reservation {
+	list := make([]Reservation, 0)
+	for _, id := range volume.sortedIDs() {
+		if r := volume.reservations[id]; r.path == path {
+			list = append(list, r.export(id))
+		}
+	}
+	return list
+}
+
+// Reservation returns the reservation with the specified ID. The
+// second return value is false if there is no such reservation.
+func (volume *Volume) Reservation(id string) (Reservation, bool) {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	r, ok := volume.reservations[id]
+	if !ok {
+		return Reservation{}, false
+	}
+	return r.export(id), true
+}
+
+// export converts r to a Reservation.
+func (r *reservation) export(id string) Reservation {
+	exported := Reservation{ID: id, Path: r.path, Bytes: r.numBytes, Client: r.client, Peer: r.peer}
+	if !r.lease.Expires.IsZero() {
+		expires := r.lease.Expires
+		exported.Expires = &expires
+	}
+	return exported
+}
+
+// sortedIDs returns the IDs of the volume's reservations in order, so
+// that iterating over them is deterministic. Caller must hold the
+// mutex.
+func (volume *Volume) sortedIDs() []string {
+	ids := make([]string, 0, len(volume.reservations))
+	for id := range volume.reservations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// restore records a reservation without checking for available space.
+// The VolumeService uses this to rebuild its ledger from the journal
+// on startup, when the reservation was already granted in a previous
+// run. If replace is true, the reservation replaces all existing
+// reservations for path. Journals written before reservations had IDs
+// have no ID, so we make one up.
+func (volume *Volume) restore(id string, r reservation, replace bool) {
+	if id == "" {
+		id = newReservationID()
+		replace = true
+	}
+	volume.mutex.Lock()
+	volume.commit(id, r, replace)
+	volume.mutex.Unlock()
+}
+
+// usage returns the number of bytes client has reserved on the volume,
+// plus the bytes it's waiting for in the queue. If replacing is true,
+// bytes reserved for path aren't counted, because a new reservation is
+// about to replace them.
+func (volume *Volume) usage(client, path string, replacing bool) uint64 {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	used := uint64(0)
+	for _, r := range volume.reservations {
+		if r.client == client && !(replacing && r.path == path) {
+			used = addSaturating(used, r.numBytes)
+		}
+	}
+	for e := volume.queue.Front(); e != nil; e = e.Next() {
+		if w := e.Value.(*waiter); w.client == client {
+			used = addSaturating(used, w.numBytes)
+		}
+	}
+	return used
+}
+
+// clients returns the names of the clients with reservations or
+// waiting requests on the volume, sorted.
+func (volume *Volume) clients() []string {
+	volume.mutex.Lock()
+	defer volume.mutex.Unlock()
+	seen := make(map[string]bool)
+	for _, r := range volume.reservations {
+		seen[r.client] = true
+	}
+	for e := volume.queue.Front(); e != nil; e = e.Next() {
+		seen[e.Value.(*waiter).client] = true
+	}
+	clients := make([]string, 0, len(seen))
+	for client := range seen {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// newReservationID returns a random, 16-character hex ID.
+func newReservationID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("cannot generate reservation ID: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
+
+// addSaturating returns a + b, or the largest uint64 if that overflows.
+func addSaturating(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// subSaturating returns a - b, or zero if b is greater than a.
+func subSaturating(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
 }
@@ -1,12 +1,19 @@
 package core
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,15 +25,153 @@ import (
 // to fail due to "no space left on device" error.
 type VolumeClient struct {
 	serviceUrl string
+	httpUrl    string
+	httpClient *http.Client
+	name       string
+	token      string
+	tlsConfig  *tls.Config
+	// retries is how many times to retry a rate-limited request.
+	retries int
+	// err is the error from an option that couldn't be applied, which
+	// every call returns.
+	err error
 }
 
+// ClientOption configures a VolumeClient.
+type ClientOption func(*VolumeClient)
+
+// WithClientName sets the name the client sends to the VolumeService
+// to identify itself. The service applies quotas by name. Without a
+// name, the service identifies the client by its IP address.
+func WithClientName(name string) ClientOption {
+	return func(client *VolumeClient) {
+		client.name = name
+	}
+}
+
+// WithToken sets the bearer token the client sends to the
+// VolumeService. The service requires one if it has tokens in its
+// config, and then identifies the client by the token's name.
+func WithToken(token string) ClientOption {
+	return func(client *VolumeClient) {
+		client.token = token
+	}
+}
+
+// WithRateLimitRetries sets how many times the client retries a request
+// the service refuses with a 429 (Too Many Requests), after waiting as
+// long as the service's Retry-After header says. The default is
+// DefaultRateLimitRetries. Zero turns retries off.
+func WithRateLimitRetries(retries int) ClientOption {
+	return func(client *VolumeClient) {
+		client.retries = retries
+	}
+}
+
+// WithTLSConfig sets the TLS config the client uses to connect to a
+// VolumeService that serves HTTPS. WithCAFile and WithClientCert
+// cover the usual cases.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(client *VolumeClient) {
+		client.tlsConfig = config
+	}
+}
+
+// WithCAFile makes the client trust only the CA certificates in the
+// PEM file at path when it connects to the VolumeService over HTTPS.
+// Use this when the service's certificate is signed by a private CA.
+func WithCAFile(path string) ClientOption {
+	return func(client *VolumeClient) {
+		pool, err := loadCertPool(path)
+		if err != nil {
+			client.setErr(err)
+			return
+		}
+		client.clientTLS().RootCAs = pool
+	}
+}
+
+// WithClientCert sets the certificate and key, in the PEM files
+// certFile and keyFile, that the client presents to a VolumeService
+// that requires client certificates. The service identifies the
+// client by the certificate's subject.
+func WithClientCert(certFile, keyFile string) ClientOption {
+	return func(client *VolumeClient) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			client.setErr(fmt.Errorf("cannot load client certificate: %v", err))
+			return
+		}
+		client.clientTLS().Certificates = []tls.Certificate{cert}
+	}
+}
+
+// clientTLS returns the client's TLS config, creating it if need be.
+func (client *VolumeClient) clientTLS() *tls.Config {
+	if client.tlsConfig == nil {
+		client.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return client.tlsConfig
+}
+
+// setErr records the first error from an option.
+func (client *VolumeClient) setErr(err error) {
+	if client.err == nil {
+		client.err = err
+	}
+}
+
+// unixScheme is the scheme of service URLs that point to a Unix socket.
+const unixScheme = "unix://"
+
+// DefaultRateLimitRetries is how many times a VolumeClient retries a
+// rate-limited request, unless you say otherwise with
+// WithRateLimitRetries.
+const DefaultRateLimitRetries = 3
+
+// MaxRetryAfter is the longest a VolumeClient waits to retry a
+// rate-limited request. If the service says to wait longer, the client
+// returns a *ServiceError with the RetryAfter instead.
+var MaxRetryAfter = time.Minute
+
+// maxWait is how long ReserveWait asks the service to wait for space
+// when the caller's context has no deadline.
+const maxWait = 24 * time.Hour
+
 // NewVolumeClient returns a new VolumeClient. Param serviceUrl
 // is the URL of the volume service you want to connect to.
-// Default is http://127.0.0.1:8188
-func NewVolumeClient(serviceUrl string) *VolumeClient {
-	return &VolumeClient{
+// Default is http://127.0.0.1:8188. To connect to the service's Unix
+// socket, use a URL like unix:///var/run/vreserve.sock. If an option
+// can't be applied, such as WithCAFile with a file that doesn't exist,
+// every call returns its error.
+func NewVolumeClient(serviceUrl string, opts ...ClientOption) *VolumeClient {
+	client := &VolumeClient{
 		serviceUrl: serviceUrl,
+		httpUrl:    serviceUrl,
+		httpClient: http.DefaultClient,
+		retries:    DefaultRateLimitRetries,
 	}
+	if strings.HasPrefix(serviceUrl, unixScheme) {
+		socketPath := strings.TrimPrefix(serviceUrl, unixScheme)
+		dialer := &net.Dialer{}
+		client.httpUrl = "http://unix"
+		client.httpClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	if client.tlsConfig != nil && !strings.HasPrefix(serviceUrl, unixScheme) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = client.tlsConfig
+		client.httpClient = &http.Client{Transport: transport}
+	}
+	return client
 }
 
 // BaseURL returns the base URL of the VolumeService, which should
@@ -41,10 +186,14 @@ func (client *VolumeClient) BaseURL() string {
 // in the immortal words of Judge Spaulding Smails,
 // "You'll get nothing and like it."
 func (client *VolumeClient) Ping(msTimeout int) error {
-	pingUrl := fmt.Sprintf("%s/ping/", client.serviceUrl)
+	if client.err != nil {
+		return client.err
+	}
+	pingUrl := fmt.Sprintf("%s/ping/", client.httpUrl)
 	timeout := time.Duration(time.Duration(msTimeout) * time.Millisecond)
 	httpClient := http.Client{
-		Timeout: timeout,
+		Transport: client.httpClient.Transport,
+		Timeout:   timeout,
 	}
 	_, err := httpClient.Get(pingUrl)
 	return err
@@ -54,53 +203,205 @@ func (client *VolumeClient) Ping(msTimeout int) error {
 // local staging volume. Param path is the file path you're reserving space
 // for, and bytes is the number of bytes you want to reserve.
 func (client *VolumeClient) Reserve(path string, bytes uint64) (bool, error) {
+	return client.ReserveWithLease(path, bytes, 0)
+}
+
+// ReserveWithLease is like Reserve, but the VolumeService releases the
+// reservation automatically if you don't renew it within lease. This
+// keeps space from being tied up forever if your process dies before
+// it can call Release. Call Renew or KeepAlive to renew the lease.
+// A lease of zero never expires.
+func (client *VolumeClient) ReserveWithLease(path string, bytes uint64, lease time.Duration) (bool, error) {
+	if path == "" {
+		return false, paramError("path cannot be empty")
+	}
+	if bytes < uint64(1) {
+		return false, paramError("you must request at least one byte of storage")
+	}
+	reserveUrl := fmt.Sprintf("%s/reserve/", client.httpUrl)
+	params := url.Values{
+		"path":  {path},
+		"bytes": {strconv.FormatUint(bytes, 10)},
+	}
+	if lease > 0 {
+		params.Set("lease", lease.String())
+	}
+	return client.doRequest(context.Background(), reserveUrl, params)
+}
+
+// AddReservation reserves bytes for path, alongside any reservations
+// other processes hold for the same path, and returns the ID of the new
+// reservation. Use the ID to release or renew this reservation without
+// affecting the others. If lease is greater than zero, the reservation
+// expires unless you renew it within lease.
+func (client *VolumeClient) AddReservation(path string, bytes uint64, lease time.Duration) (string, error) {
 	if path == "" {
-		return false, fmt.Errorf("path cannot be empty")
+		return "", paramError("path cannot be empty")
 	}
 	if bytes < uint64(1) {
-		return false, fmt.Errorf("you must request at least one byte of storage")
+		return "", paramError("you must request at least one byte of storage")
 	}
-	reserveUrl := fmt.Sprintf("%s/reserve/", client.serviceUrl)
+	reserveUrl := fmt.Sprintf("%s/reserve/", client.httpUrl)
 	params := url.Values{
 		"path":  {path},
 		"bytes": {strconv.FormatUint(bytes, 10)},
+		"add":   {"true"},
+	}
+	if lease > 0 {
+		params.Set("lease", lease.String())
+	}
+	volumeResponse, err := client.call(context.Background(), reserveUrl, params)
+	if err != nil {
+		return "", err
+	}
+	return volumeResponse.ID, nil
+}
+
+// ReserveWait is like Reserve, but if the space isn't available right
+// away, it waits in line until it is, or until ctx is cancelled or its
+// deadline passes. Requests for space on each volume are granted in the
+// order they arrive, so a large request won't be starved by a stream of
+// smaller ones.
+//
+// On success, ReserveWait returns the new reservation's ID and the
+// request's position in the queue when it arrived, or zero if the space
+// was granted without waiting. If ReserveWait gives up, it returns a
+// *ServiceError, along with the request's position in the queue when it
+// gave up.
+func (client *VolumeClient) ReserveWait(ctx context.Context, path string, bytes uint64) (string, int, error) {
+	if path == "" {
+		return "", 0, paramError("path cannot be empty")
+	}
+	if bytes < uint64(1) {
+		return "", 0, paramError("you must request at least one byte of storage")
+	}
+	// Ask the service to give up a little before our deadline, so it
+	// can tell us where we were in line.
+	wait := maxWait
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = time.Until(deadline)
+		if wait <= 0 {
+			return "", 0, ctx.Err()
+		}
+		wait -= wait / 10
+	}
+	reserveUrl := fmt.Sprintf("%s/reserve/", client.httpUrl)
+	params := url.Values{
+		"path":  {path},
+		"bytes": {strconv.FormatUint(bytes, 10)},
+		"wait":  {wait.String()},
+	}
+	volumeResponse, err := client.call(ctx, reserveUrl, params)
+	if err != nil {
+		var serviceErr *ServiceError
+		if errors.As(err, &serviceErr) {
+			return "", serviceErr.QueuePosition, err
+		}
+		return "", 0, err
+	}
+	return volumeResponse.ID, int(volumeResponse.Data["queue_position"]), nil
+}
+
+// Renew renews the lease on the space you reserved for the file at path,
+// for the same duration you originally requested.
+func (client *VolumeClient) Renew(path string) error {
+	renewUrl := fmt.Sprintf("%s/renew/", client.httpUrl)
+	if path == "" {
+		return paramError("path cannot be empty")
+	}
+	params := url.Values{
+		"path": {path},
+	}
+	_, err := client.doRequest(context.Background(), renewUrl, params)
+	return err
+}
+
+// RenewID renews the lease on the reservation with the specified ID,
+// for the same duration you originally requested.
+func (client *VolumeClient) RenewID(id string) error {
+	renewUrl := fmt.Sprintf("%s/renew/", client.httpUrl)
+	if id == "" {
+		return paramError("id cannot be empty")
+	}
+	params := url.Values{
+		"id": {id},
+	}
+	_, err := client.doRequest(context.Background(), renewUrl, params)
+	return err
+}
+
+// KeepAlive renews the lease on path every interval until ctx is
+// cancelled or a renewal fails. It's meant to run in its own goroutine
+// while you work on the file at path. The interval should be comfortably
+// shorter than the lease. KeepAlive returns ctx.Err() after ctx is
+// cancelled, or the error from the failed renewal.
+func (client *VolumeClient) KeepAlive(ctx context.Context, path string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := client.Renew(path); err != nil {
+				return err
+			}
+		}
 	}
-	return client.doRequest(reserveUrl, params)
 }
 
 // Release tells the VolumeService that you're done with whatever disk space
-// you reserved for the file at path.
+// you reserved for the file at path. This releases every reservation for
+// path, including those made by other processes. Use ReleaseID to release
+// just one.
 func (client *VolumeClient) Release(path string) error {
-	releaseUrl := fmt.Sprintf("%s/release/", client.serviceUrl)
+	releaseUrl := fmt.Sprintf("%s/release/", client.httpUrl)
 	if path == "" {
-		return fmt.Errorf("path cannot be empty")
+		return paramError("path cannot be empty")
 	}
 	params := url.Values{
 		"path": {path},
 	}
-	_, err := client.doRequest(releaseUrl, params)
+	_, err := client.doRequest(context.Background(), releaseUrl, params)
 	return err
 }
 
-func (client *VolumeClient) doRequest(url string, params url.Values) (bool, error) {
-	resp, err := http.PostForm(url, params)
-	if err != nil {
-		return false, err
+// ReleaseID tells the VolumeService that you're done with the
+// reservation with the specified ID, which AddReservation returned.
+func (client *VolumeClient) ReleaseID(id string) error {
+	releaseUrl := fmt.Sprintf("%s/release/", client.httpUrl)
+	if id == "" {
+		return paramError("id cannot be empty")
 	}
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
+	params := url.Values{
+		"id": {id},
+	}
+	_, err := client.doRequest(context.Background(), releaseUrl, params)
+	return err
+}
+
+func (client *VolumeClient) doRequest(ctx context.Context, url string, params url.Values) (bool, error) {
+	volumeResponse, err := client.call(ctx, url, params)
 	if err != nil {
 		return false, err
 	}
-	volumeResponse := &VolumeResponse{}
-	err = json.Unmarshal(data, volumeResponse)
+	return volumeResponse.Succeeded, nil
+}
+
+// call posts params to url and returns the service's response.
+func (client *VolumeClient) call(ctx context.Context, url string, params url.Values) (*VolumeResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url,
+		strings.NewReader(params.Encode()))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	if volumeResponse.ErrorMessage != "" {
-		return false, fmt.Errorf(volumeResponse.ErrorMessage)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client.setHeaders(req)
+	resp, err := client.do(req)
+	if err != nil {
+		return nil, err
 	}
-	return volumeResponse.Succeeded, nil
+	return readResponse(resp)
 }
 
 // Report returns information about all current disk space reservations
@@ -108,14 +409,268 @@ func (client *VolumeClient) doRequest(url string, params url.Values) (bool, erro
 // file paths, and the values are the number of bytes reserved for those
 // file paths.
 func (client *VolumeClient) Report(path string) (map[string]uint64, error) {
+	volumeResponse, err := client.report(path)
+	if err != nil {
+		return nil, err
+	}
+	return volumeResponse.Data, nil
+}
+
+// Quotas returns the quota usage of clients with reservations on the
+// volume containing path, and of clients with quotas of their own.
+// It returns nothing if the service has no quotas.
+func (client *VolumeClient) Quotas(path string) ([]QuotaUsage, error) {
+	volumeResponse, err := client.report(path)
+	if err != nil {
+		return nil, err
+	}
+	return volumeResponse.Quotas, nil
+}
+
+// Reservations returns the individual reservations on the volume
+// containing path, each with its ID and path.
+func (client *VolumeClient) Reservations(path string) ([]Reservation, error) {
+	volumeResponse, err := client.report(path)
+	if err != nil {
+		return nil, err
+	}
+	return volumeResponse.Reservations, nil
+}
+
+// Volumes returns a summary of every volume the VolumeService is
+// tracking: its capacity, free space, and reservations.
+func (client *VolumeClient) Volumes() ([]VolumeInfo, error) {
+	volumesUrl := fmt.Sprintf("%s/volumes/", client.httpUrl)
+	volumeResponse, err := client.get(volumesUrl)
+	if err != nil {
+		return nil, err
+	}
+	return volumeResponse.Volumes, nil
+}
+
+// Audit returns one page of the entries in the service's audit log
+// that query selects. To get the next page, set query.After to the
+// page's Next, if it isn't zero. This requires an admin token, if the
+// service has tokens.
+func (client *VolumeClient) Audit(query AuditQuery) (*AuditPage, error) {
+	auditUrl := fmt.Sprintf("%s/audit/?%s", client.httpUrl, query.values().Encode())
+	volumeResponse, err := client.get(auditUrl)
+	if err != nil {
+		return nil, err
+	}
+	page := &AuditPage{Entries: volumeResponse.AuditEntries, Next: volumeResponse.Data["next"]}
+	if page.Entries == nil {
+		page.Entries = make([]AuditEntry, 0)
+	}
+	return page, nil
+}
+
+// WatchOption limits the events Watch returns, or says where to start.
+type WatchOption func(url.Values)
+
+// WatchVolume limits Watch to events on the volume containing path.
+func WatchVolume(path string) WatchOption {
+	return func(params url.Values) {
+		params.Set("volume", path)
+	}
+}
+
+// WatchPath limits Watch to events for prefix and paths under it.
+// Threshold events have no path, so they're left out.
+func WatchPath(prefix string) WatchOption {
+	return func(params url.Values) {
+		params.Set("path", prefix)
+	}
+}
+
+// WatchAfter starts Watch with the events after the one with the
+// specified ID, as far back as the service remembers, rather than
+// with new events.
+func WatchAfter(id uint64) WatchOption {
+	return func(params url.Values) {
+		params.Set("last_event_id", strconv.FormatUint(id, 10))
+	}
+}
+
+// watchRetry is how long Watch waits before reconnecting to the
+// VolumeService after the event stream breaks.
+const watchRetry = time.Second
+
+// Watch streams events from the VolumeService as they happen: grants,
+// releases, expired leases, denials, and volumes crossing free space
+// thresholds. It returns an error if it can't connect. Otherwise, it
+// returns a channel of events, which it closes when ctx is done. If the
+// connection breaks, Watch reconnects and resumes after the last event
+// it received, so nothing is lost unless the service restarts or the
+// outage outlasts its memory.
+func (client *VolumeClient) Watch(ctx context.Context, opts ...WatchOption) (<-chan Event, error) {
+	params := url.Values{}
+	for _, opt := range opts {
+		opt(params)
+	}
+	body, err := client.openEvents(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for {
+			lastID := readEvents(ctx, body, events)
+			body.Close()
+			if lastID > 0 {
+				WatchAfter(lastID)(params)
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchRetry):
+				}
+				body, err = client.openEvents(ctx, params)
+				if err == nil {
+					break
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// openEvents connects to the service's event stream.
+func (client *VolumeClient) openEvents(ctx context.Context, params url.Values) (io.ReadCloser, error) {
+	eventsUrl := fmt.Sprintf("%s/events/?%s", client.httpUrl, params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, eventsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	client.setHeaders(req)
+	resp, err := client.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if _, err = readResponse(resp); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cannot watch events: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// readEvents sends the events in a Server-Sent Events stream to out,
+// until the stream ends or ctx is done. It returns the ID of the last
+// event it sent, or zero if it sent none.
+func readEvents(ctx context.Context, stream io.Reader, out chan<- Event) uint64 {
+	lastID := uint64(0)
+	data := ""
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			continue
+		}
+		if line != "" || data == "" {
+			// Comments, ids and event names. The data has them all.
+			continue
+		}
+		event := Event{}
+		err := json.Unmarshal([]byte(data), &event)
+		data = ""
+		if err != nil {
+			continue
+		}
+		select {
+		case out <- event:
+			lastID = event.ID
+		case <-ctx.Done():
+			return lastID
+		}
+	}
+	return lastID
+}
+
+func (client *VolumeClient) report(path string) (*VolumeResponse, error) {
 	if path == "" {
-		return nil, fmt.Errorf("path cannot be empty")
+		return nil, paramError("path cannot be empty")
+	}
+	reportUrl := fmt.Sprintf("%s/report/?path=%s", client.httpUrl, url.QueryEscape(path))
+	return client.get(reportUrl)
+}
+
+// do sends req, unless an option failed. If the service says the
+// client is making too many requests, do waits as long as it says to,
+// and tries again, up to the client's limit.
+func (client *VolumeClient) do(req *http.Request) (*http.Response, error) {
+	if client.err != nil {
+		return nil, client.err
 	}
-	reportUrl := fmt.Sprintf("%s/report/?path=%s", client.serviceUrl, path)
-	resp, err := http.Get(reportUrl)
+	for attempt := 0; ; attempt++ {
+		resp, err := client.httpClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= client.retries {
+			return resp, err
+		}
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok || wait > MaxRetryAfter || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		resp.Body.Close()
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// parseRetryAfter returns how long a Retry-After header, which may be
+// a number of seconds or an HTTP date, says to wait.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	when, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if wait := when.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// get sends a GET request to url and returns the service's response.
+func (client *VolumeClient) get(url string) (*VolumeResponse, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client.setHeaders(req)
+	resp, err := client.do(req)
 	if err != nil {
 		return nil, err
 	}
+	return readResponse(resp)
+}
+
+// readResponse decodes the service's response. If the service rejected
+// the request, it returns a *ServiceError.
+func readResponse(resp *http.Response) (*VolumeResponse, error) {
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -126,8 +681,28 @@ func (client *VolumeClient) Report(path string) (map[string]uint64, error) {
 	if err != nil {
 		return nil, err
 	}
-	if volumeResponse.ErrorMessage != "" {
-		return nil, fmt.Errorf(volumeResponse.ErrorMessage)
+	if volumeResponse.ErrorMessage == "" {
+		return volumeResponse, nil
+	}
+	serviceErr := &ServiceError{
+		Code:          volumeResponse.ErrorCode,
+		Message:       volumeResponse.ErrorMessage,
+		StatusCode:    resp.StatusCode,
+		QueuePosition: int(volumeResponse.Data["queue_position"]),
+	}
+	serviceErr.RetryAfter, _ = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if serviceErr.Code == "" {
+		serviceErr.Code = statusCode(resp.StatusCode)
+	}
+	return nil, serviceErr
+}
+
+// setHeaders adds the client's identity and token to req.
+func (client *VolumeClient) setHeaders(req *http.Request) {
+	if client.name != "" {
+		req.Header.Set(ClientHeader, client.name)
+	}
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
 	}
-	return volumeResponse.Data, nil
 }
@@ -1,8 +1,10 @@
 package core_test
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/diamondap/vreserve/core"
 	"github.com/stretchr/testify/assert"
@@ -59,3 +61,133 @@ func TestVolumeReport(t *testing.T) {
 	assert.NotNil(t, err) // path required
 	assert.Nil(t, data)
 }
+
+func TestVolumeRenew(t *testing.T) {
+	runService(t)
+	client := core.NewVolumeClient(serviceUrl)
+	require.NotNil(t, client)
+
+	ok, err := client.ReserveWithLease("/tmp/some_leased_file", uint64(800), time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	err = client.Renew("/tmp/some_leased_file")
+	assert.Nil(t, err)
+
+	err = client.Renew("/tmp/never_reserved_this")
+	assert.NotNil(t, err)
+
+	err = client.Renew("")
+	assert.NotNil(t, err) // path required
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = client.KeepAlive(ctx, "/tmp/some_leased_file", 10*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	require.Nil(t, client.Release("/tmp/some_leased_file"))
+	err = client.KeepAlive(context.Background(), "/tmp/some_leased_file", 10*time.Millisecond)
+	assert.NotNil(t, err)
+}
+
+func TestVolumeReserveWait(t *testing.T) {
+	runService(t)
+	client := core.NewVolumeClient(serviceUrl)
+	require.NotNil(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, position, err := client.ReserveWait(ctx, "/tmp/some_waiting_file", uint64(800))
+	assert.Nil(t, err)
+	assert.Len(t, id, 16)
+	assert.Equal(t, 0, position)
+	require.Nil(t, client.ReleaseID(id))
+
+	// Nobody has this much space.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	id, position, err = client.ReserveWait(ctx, "/tmp/some_waiting_file", uint64(1)<<62)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "position 1")
+	assert.Empty(t, id)
+	assert.Equal(t, 1, position)
+
+	_, _, err = client.ReserveWait(context.Background(), "", uint64(800))
+	assert.NotNil(t, err) // path required
+}
+
+func TestVolumeReservationIDs(t *testing.T) {
+	runService(t)
+	client := core.NewVolumeClient(serviceUrl)
+	require.NotNil(t, client)
+
+	path := "/tmp/some_shared_dir"
+	id1, err := client.AddReservation(path, uint64(800), time.Minute)
+	require.Nil(t, err)
+	id2, err := client.AddReservation(path, uint64(1600), 0)
+	require.Nil(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	data, err := client.Report(path)
+	require.Nil(t, err)
+	assert.EqualValues(t, 2400, data[path])
+
+	reservations, err := client.Reservations(path)
+	require.Nil(t, err)
+	byID := make(map[string]core.Reservation)
+	for _, r := range reservations {
+		byID[r.ID] = r
+	}
+	assert.EqualValues(t, 800, byID[id1].Bytes)
+	assert.NotNil(t, byID[id1].Expires)
+	assert.EqualValues(t, 1600, byID[id2].Bytes)
+	assert.Nil(t, byID[id2].Expires)
+
+	assert.Nil(t, client.RenewID(id1))
+	assert.NotNil(t, client.RenewID(id2)) // no lease
+	assert.NotNil(t, client.RenewID(""))
+
+	// Releasing one job's reservation leaves the other's alone.
+	require.Nil(t, client.ReleaseID(id1))
+	assert.NotNil(t, client.ReleaseID(id1))
+	assert.NotNil(t, client.ReleaseID(""))
+	data, err = client.Report(path)
+	require.Nil(t, err)
+	assert.EqualValues(t, 1600, data[path])
+
+	require.Nil(t, client.ReleaseID(id2))
+	data, err = client.Report(path)
+	require.Nil(t, err)
+	assert.NotContains(t, data, path)
+
+	_, err = client.AddReservation("", uint64(800), 0)
+	assert.NotNil(t, err) // path required
+}
+
+func TestVolumeVolumes(t *testing.T) {
+	runService(t)
+	client := core.NewVolumeClient(serviceUrl)
+	path := "/tmp/volumes_file"
+	id, err := client.AddReservation(path, 1200, 0)
+	require.Nil(t, err)
+	defer client.ReleaseID(id)
+	mountPoint, err := core.GetMountPointFromPath("/tmp")
+	require.Nil(t, err)
+
+	volumes, err := client.Volumes()
+	require.Nil(t, err)
+	var info *core.VolumeInfo
+	for i := range volumes {
+		if volumes[i].MountPoint == mountPoint {
+			info = &volumes[i]
+		}
+	}
+	require.NotNil(t, info, "volume %s not listed", mountPoint)
+	assert.Empty(t, info.Error)
+	assert.NotEmpty(t, info.FsType)
+	assert.NotZero(t, info.Device)
+	assert.True(t, info.TotalBytes >= info.FreeBytes)
+	assert.True(t, info.ClaimedBytes >= 1200)
+	assert.True(t, info.Reservations >= 1)
+	assert.Equal(t, info.FreeBytes-info.ClaimedBytes, info.AvailableBytes)
+}
@@ -1,99 +1,1081 @@
 package core
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os/exec"
-	"runtime"
+	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/op/go-logging"
 )
 
 // VolumeService keeps track of the space available to workers
 // processing APTrust bags.
+//
+// The volumesMutex guards the volumes map. The ledgerMutex serializes
+// changes to the ledger, so they're written to the journal in the same
+// order they're applied, and so quota checks see every reservation
+// granted before them. It also guards the quotas, free space
+// thresholds and fill alerts. Each Volume has its own lock, so reading
+// a volume's reservations doesn't require either of these. The
+// authMutex guards the tokens and ACL rules, which every request reads.
 type VolumeService struct {
-	host    string
-	port    int
-	volumes map[string]*Volume
-	logger  *logging.Logger
+	host           string
+	port           int
+	volumes        map[volumeKey]*Volume
+	stats          StatProvider
+	logger         *logging.Logger
+	volumesMutex   sync.RWMutex
+	journal        *Journal
+	auditLog       *AuditLog
+	history        *History
+	ledgerMutex    sync.Mutex
+	quotas         quotaTable
+	now            func() time.Time
+	readMountTable func() (MountTable, error)
+	metrics        *metrics
+	events         *eventBus
+	// thresholds are the free space thresholds, highest first, and
+	// thresholdLevels is how many of them each volume is below.
+	thresholds      []int
+	thresholdLevels map[string]int
+	// fillAlerts are the fill alert horizons, longest first, and
+	// fillLevels is how many of them each volume is below.
+	fillAlerts  []time.Duration
+	fillLevels  map[string]int
+	authMutex   sync.RWMutex
+	tokens      tokenTable
+	acl         aclTable
+	limiter     *rateLimiter
+	tlsConfig   *tls.Config
+	handler     http.Handler
+	handlerOnce sync.Once
+	// stop tells the goroutines Serve starts to return, and background
+	// tracks them, so Close can wait for them.
+	stop       chan struct{}
+	stopOnce   sync.Once
+	background sync.WaitGroup
 }
 
+// volumeKey identifies a volume in the VolumeService's volumes map: by
+// device ID, or by mountpoint if the mountpoint can't be stat'ed.
+type volumeKey struct {
+	device     uint64
+	mountPoint string
+}
+
+// ClientHeader is the HTTP header in which clients identify themselves,
+// for quotas. Requests without it are identified by their IP address.
+const ClientHeader = "X-Vreserve-Client"
+
+// ReapInterval is how often the VolumeService checks for and releases
+// reservations whose leases have expired.
+var ReapInterval = time.Second
+
+// SampleInterval is how often the VolumeService samples each volume's
+// free and claimed bytes, to estimate background consumption and for
+// its History.
+var SampleInterval = time.Minute
+
 // NewVolumeService creates a new VolumeService object to track the
 // amount of available space and claimed space on locally mounted
-// volumes.
-func NewVolumeService(host string, port int, logger *logging.Logger) *VolumeService {
+// volumes. Param stats measures free space on those volumes. If it's
+// nil, the service uses a StatfsProvider.
+func NewVolumeService(host string, port int, logger *logging.Logger, stats StatProvider) *VolumeService {
+	if stats == nil {
+		stats = StatfsProvider{}
+	}
 	return &VolumeService{
-		host:    host,
-		port:    port,
-		volumes: make(map[string]*Volume),
-		logger:  logger,
+		host:           host,
+		port:           port,
+		volumes:        make(map[volumeKey]*Volume),
+		stats:          stats,
+		logger:         logger,
+		now:            time.Now,
+		readMountTable: ReadMountTable,
+		metrics:        newMetrics(),
+		events:         newEventBus(),
+		limiter:        newRateLimiter(),
+		stop:           make(chan struct{}),
 	}
 }
 
 // Serve starts an HTTP server, so the VolumeService can respond to
 // requests from the VolumeClient(s). See the VolumeClient for available
-// calls.
+// calls. If the service has a TLS config (see UseTLS), it serves HTTPS.
 func (service *VolumeService) Serve() {
-	http.HandleFunc("/reserve/", service.makeReserveHandler())
-	http.HandleFunc("/release/", service.makeReleaseHandler())
-	http.HandleFunc("/report/", service.makeReportHandler())
-	http.HandleFunc("/ping/", service.makePingHandler())
-	listenAddr := fmt.Sprintf("%s:%d", service.host, service.port)
-	http.ListenAndServe(listenAddr, nil)
+	service.background.Add(2)
+	go service.reap(ReapInterval)
+	go service.sample(SampleInterval)
+	server := &http.Server{
+		Addr:      fmt.Sprintf("%s:%d", service.host, service.port),
+		Handler:   service.Handler(),
+		TLSConfig: service.tlsConfig,
+	}
+	var err error
+	if service.tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	service.logger.Errorf("HTTP server stopped: %v", err)
+}
+
+// ServeUnix serves the same HTTP interface as Serve on a Unix socket
+// at path, which it creates with the specified file mode, so you can
+// limit which local users can connect. On Linux, the service records
+// the UID, GID and PID of the process that made each reservation over
+// the socket. Serve must also be running, to reap expired leases.
+// ServeUnix returns only if the server fails.
+func (service *VolumeService) ServeUnix(path string, mode os.FileMode) error {
+	listener, err := listenUnix(path, mode)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:     service.Handler(),
+		ConnContext: withPeerCred,
+	}
+	return server.Serve(listener)
+}
+
+// Handler returns the handler for the service's HTTP interface.
+func (service *VolumeService) Handler() http.Handler {
+	service.handlerOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/reserve/", service.timed("reserve", service.rateLimited("reserve",
+			service.authorized(RoleReserver, service.makeReserveHandler()))))
+		mux.HandleFunc("/release/", service.timed("release", service.rateLimited("release",
+			service.authorized(RoleReserver, service.makeReleaseHandler()))))
+		mux.HandleFunc("/renew/", service.timed("renew", service.rateLimited("renew",
+			service.authorized(RoleReserver, service.makeRenewHandler()))))
+		mux.HandleFunc("/report/", service.timed("report", service.rateLimited("report",
+			service.authorized(RoleReader, service.makeReportHandler()))))
+		mux.HandleFunc("/volumes/", service.timed("volumes", service.rateLimited("volumes",
+			service.authorized(RoleReader, service.makeVolumesHandler()))))
+		mux.HandleFunc("/audit/", service.timed("audit", service.rateLimited("audit",
+			service.authorized(RoleAdmin, service.makeAuditHandler()))))
+		mux.HandleFunc("/history/", service.timed("history", service.rateLimited("history",
+			service.authorized(RoleReader, service.makeHistoryHandler()))))
+		mux.HandleFunc("/ping/", service.timed("ping", service.rateLimited("ping",
+			service.makePingHandler())))
+		v2 := service.makeV2Handler()
+		mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+			endpoint := v2EndpointName(r)
+			service.timed(endpoint, service.rateLimited(endpoint, v2))(w, r)
+		})
+		mux.HandleFunc("/events/", service.rateLimited("events",
+			service.authorized(RoleReader, service.makeEventsHandler())))
+		mux.HandleFunc("/metrics", service.rateLimited("metrics",
+			service.authorized(RoleReader, service.makeMetricsHandler())))
+		service.handler = mux
+	})
+	return service.handler
+}
+
+// UseJournal replays the snapshot and entries in journal to rebuild
+// the ledger, then records every subsequent Reserve and Release in
+// the journal, so the ledger survives restarts and crashes. Call this
+// before Serve.
+func (service *VolumeService) UseJournal(journal *Journal) error {
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	count := 0
+	err := journal.Replay(func(entry JournalEntry) {
+		volume := service.getVolume(entry.Volume)
+		switch {
+		case entry.Op == JournalReserve:
+			volume.restore(entry.ID, reservation{
+				client:   entry.Client,
+				peer:     entry.Peer,
+				path:     entry.Path,
+				numBytes: entry.Bytes,
+				lease:    entryLease(entry),
+			}, entry.Replace)
+		case entry.Op == JournalRenew && entry.ID != "":
+			volume.RenewID(entry.ID, entryLease(entry))
+		case entry.Op == JournalRenew:
+			volume.Renew(entry.Path, entryLease(entry))
+		case entry.Op == JournalRelease && entry.ID != "":
+			volume.ReleaseID(entry.ID)
+		case entry.Op == JournalRelease:
+			volume.Release(entry.Path)
+		}
+		count++
+	})
+	if err != nil {
+		return err
+	}
+	service.journal = journal
+	service.logger.Infof("Replayed %d journal entries from %s", count, journal.Dir())
+	return nil
+}
+
+// SetQuotas replaces the service's quotas. Pass nil to remove them all.
+// Requests that would put a client over any of its quotas are denied
+// with a QuotaError.
+func (service *VolumeService) SetQuotas(quotas []Quota) error {
+	table, err := newQuotaTable(quotas)
+	if err != nil {
+		return err
+	}
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	service.quotas = table
+	service.auditConfig("set %d quotas", len(quotas))
+	return nil
+}
+
+// SetClock replaces the function the service uses to tell time when
+// granting and expiring leases. This is for testing.
+func (service *VolumeService) SetClock(now func() time.Time) {
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	service.now = now
+}
+
+// Close stops the service's background reaping and sampling, then
+// closes its journal, audit log and history, if it has them.
+func (service *VolumeService) Close() error {
+	service.stopOnce.Do(func() { close(service.stop) })
+	service.background.Wait()
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	var err error
+	if service.journal != nil {
+		err = service.journal.Close()
+		service.journal = nil
+	}
+	if service.auditLog != nil {
+		if auditErr := service.auditLog.Close(); err == nil {
+			err = auditErr
+		}
+	}
+	if service.history != nil {
+		if historyErr := service.history.Close(); err == nil {
+			err = historyErr
+		}
+	}
+	return err
+}
+
+// Reserve reserves numBytes on the volume containing path, and
+// records the reservation in the journal, if there is one. Like
+// Volume.Reserve, this replaces any existing reservations for path.
+func (service *VolumeService) Reserve(path string, numBytes uint64) error {
+	return service.ReserveWithLease(path, numBytes, 0)
+}
+
+// ReserveWithLease is like Reserve, but if leaseDuration is greater
+// than zero, the reservation is released automatically unless it is
+// renewed within leaseDuration.
+func (service *VolumeService) ReserveWithLease(path string, numBytes uint64, leaseDuration time.Duration) error {
+	_, err := service.reserve(nil, "", nil, service.getVolume(path), path, numBytes, leaseDuration, true)
+	return err
+}
+
+// AddReservation reserves numBytes for path on behalf of client,
+// alongside any existing reservations for path, and returns the new
+// reservation's ID. If leaseDuration is greater than zero, the
+// reservation is released automatically unless it is renewed within
+// leaseDuration. If the request would put client over its quota,
+// AddReservation returns a *QuotaError.
+func (service *VolumeService) AddReservation(client, path string, numBytes uint64, leaseDuration time.Duration) (string, error) {
+	return service.reserve(nil, client, nil, service.getVolume(path), path, numBytes, leaseDuration, false)
+}
+
+// reserve grants and journals a reservation for path on volume, which
+// must be the volume containing path. If replace is true, it replaces
+// existing reservations for path, which caller, the token the client
+// authenticated with, must own unless it's nil or an admin's. Peer
+// identifies the process that asked for it, if the service knows.
+func (service *VolumeService) reserve(caller *Token, client string, peer *PeerCred, volume *Volume, path string, numBytes uint64, leaseDuration time.Duration, replace bool) (string, error) {
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	err := service.checkQuota(client, volume, path, numBytes, replace)
+	if err == nil && replace {
+		err = checkReplace(caller, volume, path)
+	}
+	if err != nil {
+		service.metrics.denied(volume.MountPoint())
+		service.publishDenial(volume, client, path, numBytes, err)
+		return "", err
+	}
+	var released []Reservation
+	if replace {
+		released = volume.reservationsAt(path)
+	}
+	lease := service.newLease(leaseDuration)
+	id, err := volume.reserve(client, peer, path, numBytes, lease, replace)
+	if err != nil {
+		service.metrics.denied(volume.MountPoint())
+		service.publishDenial(volume, client, path, numBytes, err)
+		return "", err
+	}
+	err = service.record(leaseEntry(JournalEntry{
+		Op:      JournalReserve,
+		ID:      id,
+		Client:  client,
+		Peer:    peer,
+		Volume:  volume.MountPoint(),
+		Path:    path,
+		Bytes:   numBytes,
+		Replace: replace,
+	}, lease))
+	if err != nil {
+		// If we can't make it durable, we can't grant it.
+		volume.ReleaseID(id)
+		service.metrics.denied(volume.MountPoint())
+		err = fmt.Errorf("cannot write journal: %v", err)
+		service.publishDenial(volume, client, path, numBytes, err)
+		return "", err
+	}
+	service.metrics.granted(volume.MountPoint())
+	for _, r := range released {
+		service.metrics.released(volume.MountPoint())
+		service.publishReservation(EventRelease, volume, r)
+		service.auditReleased(client, volume, r, "replaced by "+id)
+	}
+	r, _ := volume.Reservation(id)
+	service.publishReservation(EventReserve, volume, r)
+	service.checkThresholds(volume)
+	return id, nil
+}
+
+// ReserveWait is like AddReservation, but if the space isn't available
+// right away, the request waits in a first-come, first-served queue for
+// the volume until releases free up enough space, or until ctx is done.
+//
+// On success, ReserveWait returns the new reservation's ID and the
+// request's position in the queue when it arrived (1 means it was first
+// in line), or zero if the space was granted without waiting. On
+// failure, it returns the request's position in the queue when it gave
+// up, along with an error wrapping ctx.Err(). Requests that would put
+// client over its quota fail right away with a *QuotaError. Bytes a
+// client is waiting for count toward its quota.
+func (service *VolumeService) ReserveWait(ctx context.Context, client, path string, numBytes uint64, leaseDuration time.Duration) (string, int, error) {
+	return service.reserveWait(ctx, nil, client, nil, service.getVolume(path), path, numBytes, leaseDuration, false)
+}
+
+// reserveWait implements ReserveWait for path on volume, which must be
+// the volume containing path, on behalf of peer, if the service knows
+// who that is. If replace is true, the reservation
+// replaces the existing reservations for path when it's granted, and
+// caller must own them, as for reserve. It checks that both when the
+// request arrives and when it's granted, since others may reserve the
+// path while it waits.
+func (service *VolumeService) reserveWait(ctx context.Context, caller *Token, client string, peer *PeerCred, volume *Volume, path string, numBytes uint64, leaseDuration time.Duration, replace bool) (string, int, error) {
+	service.ledgerMutex.Lock()
+	err := service.checkQuota(client, volume, path, numBytes, replace)
+	if err == nil && replace {
+		err = checkReplace(caller, volume, path)
+	}
+	if err != nil {
+		service.metrics.denied(volume.MountPoint())
+		service.publishDenial(volume, client, path, numBytes, err)
+		service.ledgerMutex.Unlock()
+		return "", 0, err
+	}
+	w, position := volume.enqueue(caller, client, peer, path, numBytes, leaseDuration, replace)
+	service.dispatch(volume)
+	service.ledgerMutex.Unlock()
+
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			return "", 0, w.err
+		}
+		return w.id, 0, nil
+	default:
+	}
+	service.logger.Infof("Request for %d bytes for %s is waiting at position %d",
+		numBytes, path, position)
+
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			return "", position, w.err
+		}
+		return w.id, position, nil
+	case <-ctx.Done():
+	}
+
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	position = volume.dequeue(w)
+	if position == 0 && w.err != nil {
+		return "", 0, w.err
+	}
+	if position == 0 {
+		// Granted while we were giving up. The caller won't know
+		// it has the space, so give it back.
+		if r, ok := volume.Reservation(w.id); ok {
+			service.releaseID(volume, w.id, EventRelease)
+			service.auditReleased(client, volume, r, "granted after the request gave up")
+		}
+		return "", 0, fmt.Errorf("space was granted just as the request gave up "+
+			"waiting, so it was released: %w", ctx.Err())
+	}
+	err = fmt.Errorf("gave up waiting at position %d in the queue: %w",
+		position, ctx.Err())
+	service.metrics.denied(volume.MountPoint())
+	service.publishDenial(volume, client, path, numBytes, err)
+	// The requests behind this one may fit now.
+	service.dispatch(volume)
+	return "", position, err
+}
+
+// Renew extends the leases on all reservations for path that have
+// leases by leaseDuration, starting now. If leaseDuration is zero, each
+// lease is extended by the duration originally granted. Reservations
+// without leases are left alone. It returns a notFoundError if none of
+// the reservations for path has a lease.
+func (service *VolumeService) Renew(path string, leaseDuration time.Duration) error {
+	volume := service.getVolume(path)
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	return service.renew(volume, path, leaseDuration)
 }
 
-// Returns a Volume object with info about the volume at the specified
-// mount point. The mount point should be the path to a disk or partition.
-// For example, "/", "/mnt/data", etc.
+// renew implements Renew. Caller must hold the ledgerMutex.
+func (service *VolumeService) renew(volume *Volume, path string, leaseDuration time.Duration) error {
+	ids := volume.leasedIDs(path)
+	if len(ids) == 0 {
+		return notFoundError(fmt.Sprintf("no leased space is reserved for '%s'", path))
+	}
+	for _, id := range ids {
+		duration := leaseDuration
+		if duration <= 0 {
+			current, _ := volume.LeaseID(id)
+			duration = current.Duration
+		}
+		lease := service.newLease(duration)
+		if err := volume.RenewID(id, lease); err != nil {
+			return err
+		}
+		err := service.record(leaseEntry(JournalEntry{
+			Op:     JournalRenew,
+			ID:     id,
+			Volume: volume.MountPoint(),
+			Path:   path,
+		}, lease))
+		if err != nil {
+			service.logger.Errorf("Cannot write renewal of %s to journal: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// RenewID is like Renew, but it renews only the reservation with the
+// specified ID.
+func (service *VolumeService) RenewID(id string, leaseDuration time.Duration) error {
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	volume, r, ok := service.findReservation(id)
+	if !ok {
+		return notFoundError(fmt.Sprintf("no reservation has ID '%s'", id))
+	}
+	return service.renewID(volume, r, leaseDuration)
+}
+
+// renewID implements RenewID for reservation r on volume. Caller must
+// hold the ledgerMutex.
+func (service *VolumeService) renewID(volume *Volume, r Reservation, leaseDuration time.Duration) error {
+	id := r.ID
+	if leaseDuration <= 0 {
+		current, ok := volume.LeaseID(id)
+		if !ok {
+			return paramError(fmt.Sprintf("reservation '%s' has no lease to renew", id))
+		}
+		leaseDuration = current.Duration
+	}
+	lease := service.newLease(leaseDuration)
+	err := volume.RenewID(id, lease)
+	if err != nil {
+		return err
+	}
+	err = service.record(leaseEntry(JournalEntry{
+		Op:     JournalRenew,
+		ID:     id,
+		Volume: volume.MountPoint(),
+		Path:   r.Path,
+	}, lease))
+	if err != nil {
+		service.logger.Errorf("Cannot write renewal of %s to journal: %v", id, err)
+	}
+	return nil
+}
+
+// Release releases all of the space reserved for path, and records the
+// release in the journal, if there is one.
+func (service *VolumeService) Release(path string) {
+	volume := service.getVolume(path)
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	service.release(volume, path)
+}
+
+// ReleaseID releases the reservation with the specified ID, and records
+// the release in the journal, if there is one. It returns false if
+// there is no such reservation.
+func (service *VolumeService) ReleaseID(id string) bool {
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	volume, _, ok := service.findReservation(id)
+	if !ok {
+		return false
+	}
+	service.releaseID(volume, id, EventRelease)
+	return true
+}
+
+// Reservations returns the total bytes reserved for each path on the
+// volume containing path.
+func (service *VolumeService) Reservations(path string) map[string]uint64 {
+	return service.getVolume(path).Reservations()
+}
+
+// ReservationList returns the individual reservations on the volume
+// containing path.
+func (service *VolumeService) ReservationList(path string) []Reservation {
+	return service.getVolume(path).ReservationList()
+}
+
+// checkQuota returns a *QuotaError if reserving numBytes on volume would
+// put client over its quota for the volume or its quota for all volumes.
+// If replacing is true, the client's existing reservations for path
+// don't count, since the new one replaces them. Caller must hold the
+// ledgerMutex.
+func (service *VolumeService) checkQuota(client string, volume *Volume, path string, numBytes uint64, replacing bool) error {
+	if len(service.quotas) == 0 {
+		return nil
+	}
+	if quota, ok := service.quotas.lookup(client, volume.MountPoints()); ok {
+		used := volume.usage(client, path, replacing)
+		if addSaturating(used, numBytes) > quota.Bytes {
+			return &QuotaError{Quota: quota, Used: used, Requested: numBytes}
+		}
+	}
+	if quota, ok := service.quotas.lookup(client, nil); ok {
+		used := uint64(0)
+		for _, v := range service.allVolumes() {
+			used = addSaturating(used, v.usage(client, path, replacing && v == volume))
+		}
+		if addSaturating(used, numBytes) > quota.Bytes {
+			return &QuotaError{Quota: quota, Used: used, Requested: numBytes}
+		}
+	}
+	return nil
+}
+
+// QuotaUsage returns the usage of every quota that applies on the
+// volume containing path, for each client that has a quota of its own
+// or has reserved space on the volume. It returns nil if the service
+// has no quotas.
+func (service *VolumeService) QuotaUsage(path string) []QuotaUsage {
+	return service.quotaUsage(service.getVolume(path))
+}
+
+// quotaUsage returns the quota usage on volume. See QuotaUsage.
+func (service *VolumeService) quotaUsage(volume *Volume) []QuotaUsage {
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	if len(service.quotas) == 0 {
+		return nil
+	}
+	clients := append(service.quotas.clients(), volume.clients()...)
+	seen := make(map[string]bool)
+	usage := make([]QuotaUsage, 0)
+	for _, client := range clients {
+		if seen[client] {
+			continue
+		}
+		seen[client] = true
+		if quota, ok := service.quotas.lookup(client, volume.MountPoints()); ok {
+			usage = append(usage, QuotaUsage{
+				Client: client,
+				Volume: quota.Volume,
+				Bytes:  quota.Bytes,
+				Used:   volume.usage(client, "", false),
+			})
+		}
+		if quota, ok := service.quotas.lookup(client, nil); ok {
+			used := uint64(0)
+			for _, v := range service.allVolumes() {
+				used = addSaturating(used, v.usage(client, "", false))
+			}
+			usage = append(usage, QuotaUsage{
+				Client: client,
+				Bytes:  quota.Bytes,
+				Used:   used,
+			})
+		}
+	}
+	return usage
+}
+
+// findReservation returns the reservation with the specified ID, and
+// the volume it's on.
+func (service *VolumeService) findReservation(id string) (*Volume, Reservation, bool) {
+	for _, volume := range service.allVolumes() {
+		if r, ok := volume.Reservation(id); ok {
+			return volume, r, true
+		}
+	}
+	return nil, Reservation{}, false
+}
+
+// report fills in response with the reservations on the volume
+// containing path that the ACL lets client see, along with all of that
+// volume's mountpoints and the quota usage of its clients.
+func (service *VolumeService) report(client, path string, response *VolumeResponse) {
+	volume := service.getVolume(path)
+	response.Data = volume.Reservations()
+	response.Reservations = service.visibleReservations(client, volume.ReservationList())
+	if len(service.currentACL()) > 0 {
+		response.Data = make(map[string]uint64)
+		for _, r := range response.Reservations {
+			response.Data[r.Path] += r.Bytes
+		}
+	}
+	response.MountPoints = volume.MountPoints()
+	response.Quotas = service.quotaUsage(volume)
+}
+
+// Volumes summarizes all of the volumes the service is tracking,
+// sorted by mountpoint. The service starts tracking a volume the first
+// time a client asks about a path on it.
+func (service *VolumeService) Volumes() []VolumeInfo {
+	volumes := sortVolumes(service.allVolumes())
+	infos := make([]VolumeInfo, len(volumes))
+	for i, volume := range volumes {
+		infos[i] = volume.Info()
+	}
+	return infos
+}
+
+// QueueLength returns the number of requests waiting for space on the
+// volume containing path.
+func (service *VolumeService) QueueLength(path string) int {
+	return service.getVolume(path).QueueLength()
+}
+
+// ReapExpired releases all reservations whose leases have expired,
+// and returns the paths it released. It also grants queued requests
+// on any volume where space has been freed by means other than Release.
+// Serve calls this periodically.
+func (service *VolumeService) ReapExpired() []string {
+	service.ledgerMutex.Lock()
+	defer service.ledgerMutex.Unlock()
+	now := service.now()
+	released := make([]string, 0)
+	for _, volume := range service.allVolumes() {
+		for _, id := range volume.Expired(now) {
+			r, _ := volume.Reservation(id)
+			service.releaseID(volume, id, EventExpire)
+			service.logger.Warningf("Lease expired: released %d bytes for %s (%s)",
+				r.Bytes, r.Path, id)
+			service.audit(AuditEntry{
+				Action:        AuditExpire,
+				Client:        r.Client,
+				Volume:        volume.MountPoint(),
+				Path:          r.Path,
+				ReservationID: id,
+				Owner:         r.Client,
+				Bytes:         r.Bytes,
+			}, nil)
+			released = append(released, r.Path)
+		}
+		service.dispatch(volume)
+	}
+	return released
+}
+
+// SampleVolumes samples the free and claimed bytes on every volume,
+// updates its estimate of each volume's background consumption, and
+// records the samples in the service's history, if it has one. Then it
+// checks the fill alerts. Volumes whose stats can't be read are
+// skipped. Serve calls this every SampleInterval.
+func (service *VolumeService) SampleVolumes() {
+	service.ledgerMutex.Lock()
+	now := service.now()
+	service.ledgerMutex.Unlock()
+	for _, volume := range service.allVolumes() {
+		info := volume.Info()
+		if info.Error != "" {
+			continue
+		}
+		volume.recordConsumption(now, info.FreeBytes)
+		if service.history != nil {
+			err := service.history.Record(info.MountPoint, now, info.ClaimedBytes, info.FreeBytes)
+			if err != nil {
+				service.logger.Errorf("Cannot record history of %s: %v", info.MountPoint, err)
+			}
+		}
+		service.ledgerMutex.Lock()
+		service.checkFillAlerts(volume)
+		service.ledgerMutex.Unlock()
+	}
+}
+
+// sample calls SampleVolumes every interval, until the service is
+// closed.
+func (service *VolumeService) sample(interval time.Duration) {
+	service.every(interval, service.SampleVolumes)
+}
+
+// reap calls ReapExpired every interval, until the service is closed.
+func (service *VolumeService) reap(interval time.Duration) {
+	service.every(interval, func() { service.ReapExpired() })
+}
+
+// every calls f every interval until the service is closed. It's one
+// of the service's background goroutines.
+func (service *VolumeService) every(interval time.Duration, f func()) {
+	defer service.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-service.stop:
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+// release releases path on volume and records it in the journal.
+// Caller must hold the ledgerMutex.
+func (service *VolumeService) release(volume *Volume, path string) {
+	released := volume.reservationsAt(path)
+	volume.Release(path)
+	for _, r := range released {
+		service.metrics.released(volume.MountPoint())
+		service.publishReservation(EventRelease, volume, r)
+	}
+	err := service.record(JournalEntry{
+		Op:     JournalRelease,
+		Volume: volume.MountPoint(),
+		Path:   path,
+	})
+	if err != nil {
+		service.logger.Errorf("Cannot write release of %s to journal: %v", path, err)
+	}
+	service.dispatch(volume)
+}
+
+// releaseID releases the reservation with the specified ID on volume,
+// records it in the journal, and publishes an event of eventType, which
+// says why it was released. Caller must hold the ledgerMutex.
+func (service *VolumeService) releaseID(volume *Volume, id string, eventType EventType) {
+	r, ok := volume.Reservation(id)
+	if !ok {
+		return
+	}
+	volume.ReleaseID(id)
+	service.metrics.released(volume.MountPoint())
+	service.publishReservation(eventType, volume, r)
+	err := service.record(JournalEntry{
+		Op:     JournalRelease,
+		ID:     id,
+		Volume: volume.MountPoint(),
+		Path:   r.Path,
+	})
+	if err != nil {
+		service.logger.Errorf("Cannot write release of %s to journal: %v", id, err)
+	}
+	service.dispatch(volume)
+}
+
+// dispatch grants as many of the requests waiting in volume's queue as
+// will fit, in order, and records the grants in the journal before
+// telling the requests they have the space. A grant that can't be
+// journaled is rolled back, and its request fails. Then it
+// checks whether the volume has crossed any thresholds, since every
+// change to the ledger ends here or in reserve. Caller must hold the
+// ledgerMutex.
+func (service *VolumeService) dispatch(volume *Volume) {
+	defer service.checkThresholds(volume)
+	for {
+		w, err := volume.grantNext(service.newLease)
+		if err != nil {
+			service.logger.Errorf("Cannot check free space on %s: %v",
+				volume.MountPoint(), err)
+			return
+		}
+		if w == nil {
+			return
+		}
+		if w.err == nil {
+			lease, _ := volume.LeaseID(w.id)
+			err = service.record(leaseEntry(JournalEntry{
+				Op:      JournalReserve,
+				ID:      w.id,
+				Client:  w.client,
+				Peer:    w.peer,
+				Volume:  volume.MountPoint(),
+				Path:    w.path,
+				Bytes:   w.numBytes,
+				Replace: w.replace,
+			}, lease))
+			if err != nil {
+				// If we can't make it durable, we can't grant it.
+				volume.ReleaseID(w.id)
+				w.err = fmt.Errorf("cannot write journal: %v", err)
+			}
+		}
+		if w.err != nil {
+			service.metrics.denied(volume.MountPoint())
+			service.publishDenial(volume, w.client, w.path, w.numBytes, w.err)
+			close(w.ready)
+			continue
+		}
+		service.metrics.granted(volume.MountPoint())
+		for _, r := range w.replaced {
+			service.metrics.released(volume.MountPoint())
+			service.publishReservation(EventRelease, volume, r)
+			service.auditReleased(w.client, volume, r, "replaced by "+w.id)
+		}
+		r, _ := volume.Reservation(w.id)
+		service.publishReservation(EventReserve, volume, r)
+		close(w.ready)
+		service.logger.Infof("Granted %d bytes to queued request for %s",
+			w.numBytes, w.path)
+	}
+}
+
+// newLease returns a lease of the specified duration, starting now,
+// or a zero lease if duration is zero. Caller must hold the ledgerMutex.
+func (service *VolumeService) newLease(duration time.Duration) Lease {
+	if duration <= 0 {
+		return Lease{}
+	}
+	return Lease{
+		Duration: duration,
+		Expires:  service.now().Add(duration),
+	}
+}
+
+// record appends entry to the journal, compacting the journal when
+// it grows large. Caller must hold the ledgerMutex.
+func (service *VolumeService) record(entry JournalEntry) error {
+	if service.journal == nil {
+		return nil
+	}
+	err := service.journal.Append(entry)
+	if err != nil {
+		return err
+	}
+	if service.journal.NeedsCompaction() {
+		snapshot := make([]JournalEntry, 0)
+		for _, volume := range service.allVolumes() {
+			for _, r := range volume.ReservationList() {
+				lease, _ := volume.LeaseID(r.ID)
+				snapshot = append(snapshot, leaseEntry(JournalEntry{
+					Op:     JournalReserve,
+					ID:     r.ID,
+					Client: r.Client,
+					Peer:   r.Peer,
+					Volume: volume.MountPoint(),
+					Path:   r.Path,
+					Bytes:  r.Bytes,
+				}, lease))
+			}
+		}
+		if err = service.journal.Compact(snapshot); err != nil {
+			// The entry itself is safely in the journal.
+			service.logger.Errorf("Cannot compact journal: %v", err)
+		}
+	}
+	return nil
+}
+
+// leaseEntry adds lease to a journal entry.
+func leaseEntry(entry JournalEntry, lease Lease) JournalEntry {
+	if !lease.Expires.IsZero() {
+		expires := lease.Expires
+		entry.Lease = lease.Duration
+		entry.Expires = &expires
+	}
+	return entry
+}
+
+// entryLease returns the lease recorded in a journal entry.
+func entryLease(entry JournalEntry) Lease {
+	if entry.Expires == nil {
+		return Lease{}
+	}
+	return Lease{Duration: entry.Lease, Expires: *entry.Expires}
+}
+
+// Returns a Volume object with info about the volume containing path.
+// Volumes are identified by device ID, so if a filesystem is mounted
+// in more than one place (with bind mounts, for example), all of its
+// mountpoints share a single Volume and a single ledger. Paths whose
+// mountpoint we can't determine are assumed to be on "/". If we can't
+// stat the mountpoint to get its device ID, it gets the Volume we
+// already have for it or, failing that, a Volume of its own, so
+// volumes that can't be stat'ed don't share a ledger.
 func (service *VolumeService) getVolume(path string) *Volume {
-	mountpoint, err := GetMountPointFromPath(path)
+	service.volumesMutex.RLock()
+	readMountTable := service.readMountTable
+	service.volumesMutex.RUnlock()
+	table, err := readMountTable()
+	if err != nil {
+		service.logger.Error("Cannot read mount table: %v", err)
+	}
+	mount, ok := table.Lookup(resolvePath(path))
+	if !ok {
+		service.logger.Error("Cannot determine mountpoint of file '%s'", path)
+		mount = MountInfo{Root: "/", MountPoint: "/"}
+	}
+	device, err := DeviceID(mount.MountPoint)
+	key := volumeKey{device: device}
 	if err != nil {
-		mountpoint = "/"
-		service.logger.Error("Cannot determine mountpoint of file '%s': %v",
-			path, err)
+		service.logger.Error("Cannot stat mountpoint '%s': %v", mount.MountPoint, err)
+		key = volumeKey{mountPoint: mount.MountPoint}
+	}
+	service.volumesMutex.Lock()
+	volume, keyExists := service.volumes[key]
+	if !keyExists && err != nil {
+		volume, keyExists = service.volumeAt(mount.MountPoint)
+	}
+	if !keyExists {
+		volume = NewVolume(mount.MountPoint, service.stats)
+		volume.device = device
+		volume.fsType = mount.FsType
+		service.volumes[key] = volume
+	}
+	service.volumesMutex.Unlock()
+	volume.setMountPoints(table.Aliases(mount))
+	return volume
+}
+
+// volumeAt returns the volume mounted at mountPoint, if the service
+// knows about it. Caller must hold the volumesMutex.
+func (service *VolumeService) volumeAt(mountPoint string) (*Volume, bool) {
+	for _, volume := range service.volumes {
+		for _, mp := range volume.MountPoints() {
+			if mp == mountPoint {
+				return volume, true
+			}
+		}
 	}
-	if _, keyExists := service.volumes[mountpoint]; !keyExists {
-		service.volumes[mountpoint] = NewVolume(mountpoint)
+	return nil, false
+}
+
+// allVolumes returns all of the volumes the service knows about.
+func (service *VolumeService) allVolumes() []*Volume {
+	service.volumesMutex.RLock()
+	defer service.volumesMutex.RUnlock()
+	volumes := make([]*Volume, 0, len(service.volumes))
+	for _, volume := range service.volumes {
+		volumes = append(volumes, volume)
+	}
+	return volumes
+}
+
+// SetMountTableReader replaces the function the service uses to read
+// the system's mount table. This is for testing.
+func (service *VolumeService) SetMountTableReader(reader func() (MountTable, error)) {
+	service.volumesMutex.Lock()
+	defer service.volumesMutex.Unlock()
+	service.readMountTable = reader
+}
+
+// timed wraps handler so the time it takes to handle each request is
+// recorded in the latency histogram for name.
+func (service *VolumeService) timed(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler(w, r)
+		service.metrics.observe(name, time.Since(start))
 	}
-	return service.volumes[mountpoint]
 }
 
 func (service *VolumeService) makeReserveHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := &VolumeResponse{}
-		status := http.StatusOK
+		client := clientName(r)
+		peer := peerCredFrom(r.Context())
 		path := r.FormValue("path")
 		bytes, err := strconv.ParseUint(r.FormValue("bytes"), 10, 64)
+		lease, leaseErr := parseLease(r.FormValue("lease"))
+		wait, waitErr := parseWait(r.FormValue("wait"))
+		add, addErr := parseAdd(r.FormValue("add"))
 		if path == "" {
 			response.Succeeded = false
 			response.ErrorMessage = "Param 'path' is required."
-			status = http.StatusBadRequest
+			response.ErrorCode = CodeInvalidParam
 		} else if err != nil || bytes < 1 {
 			response.Succeeded = false
 			response.ErrorMessage = "Param 'bytes' must be an integer greater than zero."
-			status = http.StatusBadRequest
+			response.ErrorCode = CodeInvalidParam
+		} else if leaseErr != nil {
+			response.Succeeded = false
+			response.ErrorMessage = leaseErr.Error()
+			response.ErrorCode = CodeInvalidParam
+		} else if waitErr != nil {
+			response.Succeeded = false
+			response.ErrorMessage = waitErr.Error()
+			response.ErrorCode = CodeInvalidParam
+		} else if addErr != nil {
+			response.Succeeded = false
+			response.ErrorMessage = addErr.Error()
+			response.ErrorCode = CodeInvalidParam
+		} else if aclErr := service.checkACL(aclName(r), OpReserve, path); aclErr != nil {
+			service.auditReserve(client, remoteAddr(r), service.getVolume(path), path, bytes, "", aclErr)
+			response.Succeeded = false
+			response.ErrorMessage = fmt.Sprintf(
+				"Could not reserve %d bytes for file '%s': %v", bytes, path, aclErr)
+			response.ErrorCode = CodeAccessDenied
+		} else if wait > 0 {
+			volume := service.getVolume(path)
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			id, position, err := service.reserveWait(ctx, callerToken(r.Context()), client, peer,
+				volume, path, bytes, lease, !add)
+			cancel()
+			service.auditReserve(client, remoteAddr(r), volume, path, bytes, id, err)
+			response.ID = id
+			response.Data = map[string]uint64{"queue_position": uint64(position)}
+			if err != nil {
+				response.Succeeded = false
+				response.ErrorMessage = fmt.Sprintf(
+					"Could not reserve %d bytes for file '%s': %v",
+					bytes, path, err)
+				service.logger.Warningf("[%s] %s", client, response.ErrorMessage)
+				response.ErrorCode = errorCode(err)
+			} else {
+				response.Succeeded = true
+				service.logger.Infof("[%s] Reserved %d bytes for %s (%s)", client, bytes, path, id)
+			}
 		} else {
 			volume := service.getVolume(path)
-			err = volume.Reserve(path, bytes)
+			response.ID, err = service.reserve(callerToken(r.Context()), client, peer,
+				volume, path, bytes, lease, !add)
+			service.auditReserve(client, remoteAddr(r), volume, path, bytes, response.ID, err)
 			if err != nil {
 				response.Succeeded = false
 				response.ErrorMessage = fmt.Sprintf(
 					"Could not reserve %d bytes for file '%s': %v",
 					bytes, path, err)
-				service.logger.Error("[%s] %s", r.RemoteAddr, response.ErrorMessage)
-				status = http.StatusInternalServerError
+				service.logger.Error("[%s] %s", client, response.ErrorMessage)
+				response.ErrorCode = errorCode(err)
 			} else {
 				response.Succeeded = true
-				service.logger.Infof("[%s] Reserved %d bytes for %s", r.RemoteAddr, bytes, path)
+				service.logger.Infof("[%s] Reserved %d bytes for %s (%s)",
+					client, bytes, path, response.ID)
 			}
 		}
-		jsonResponse, _ := json.Marshal(response)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(status)
-		w.Write(jsonResponse)
+		writeResponse(w, response)
 	}
 }
 
@@ -101,21 +1083,68 @@ func (service *VolumeService) makeReleaseHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := &VolumeResponse{}
 		path := r.FormValue("path")
-		status := http.StatusOK
-		if path == "" {
+		id := r.FormValue("id")
+		if path == "" && id == "" {
 			response.Succeeded = false
-			response.ErrorMessage = "Param 'path' is required."
-			status = http.StatusBadRequest
+			response.ErrorMessage = "Param 'path' or 'id' is required."
+			response.ErrorCode = CodeInvalidParam
 		} else {
-			volume := service.getVolume(path)
-			volume.Release(path)
-			response.Succeeded = true
-			service.logger.Infof("[%s] Released %s", r.RemoteAddr, path)
+			target := path
+			if id != "" {
+				target = id
+			}
+			volume, released, err := service.releaseAs(r.Context(), aclName(r), id, path)
+			service.auditRelease(clientName(r), remoteAddr(r), volume, id, path, released, err)
+			if errors.Is(err, ErrNotFound) {
+				response.Succeeded = false
+				response.ErrorMessage = fmt.Sprintf("No reservation has ID '%s'.", id)
+				response.ErrorCode = CodeNotFound
+			} else if err != nil {
+				response.Succeeded = false
+				response.ErrorMessage = fmt.Sprintf("Could not release '%s': %v", target, err)
+				response.ErrorCode = errorCode(err)
+				service.logger.Warningf("[%s] %s", clientName(r), response.ErrorMessage)
+			} else {
+				response.Succeeded = true
+				service.logger.Infof("[%s] Released %s", clientName(r), target)
+			}
+		}
+		writeResponse(w, response)
+	}
+}
+
+func (service *VolumeService) makeRenewHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := &VolumeResponse{}
+		path := r.FormValue("path")
+		id := r.FormValue("id")
+		lease, err := parseLease(r.FormValue("lease"))
+		if path == "" && id == "" {
+			response.Succeeded = false
+			response.ErrorMessage = "Param 'path' or 'id' is required."
+			response.ErrorCode = CodeInvalidParam
+		} else if err != nil {
+			response.Succeeded = false
+			response.ErrorMessage = err.Error()
+			response.ErrorCode = CodeInvalidParam
+		} else {
+			target := path
+			if id != "" {
+				target = id
+			}
+			volume, err := service.renewAs(r.Context(), aclName(r), id, path, lease)
+			service.auditRenew(clientName(r), remoteAddr(r), volume, id, path, err)
+			if err != nil {
+				response.Succeeded = false
+				response.ErrorMessage = fmt.Sprintf("Could not renew lease for '%s': %v", target, err)
+				service.logger.Warningf("[%s] %s", r.RemoteAddr, response.ErrorMessage)
+				response.ErrorCode = errorCode(err)
+			} else {
+				response.Succeeded = true
+				service.logger.Debugf("[%s] Renewed lease on %s", r.RemoteAddr, target)
+			}
 		}
-		jsonResponse, _ := json.Marshal(response)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(status)
-		w.Write(jsonResponse)
+		writeResponse(w, response)
 	}
 }
 
@@ -123,21 +1152,30 @@ func (service *VolumeService) makeReportHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := &VolumeResponse{}
 		path := r.FormValue("path")
-		status := http.StatusOK
 		if path == "" {
 			response.Succeeded = false
 			response.ErrorMessage = "Param 'path' is required."
-			status = http.StatusBadRequest
+			response.ErrorCode = CodeInvalidParam
+		} else if err := service.checkACL(aclName(r), OpReport, path); err != nil {
+			response.Succeeded = false
+			response.ErrorMessage = fmt.Sprintf("Could not report on '%s': %v", path, err)
+			response.ErrorCode = CodeAccessDenied
 		} else {
-			volume := service.getVolume(path)
 			response.Succeeded = true
-			response.Data = volume.Reservations()
+			service.report(aclName(r), path, response)
 			service.logger.Infof("[%s] Reservations %s (%d)", r.RemoteAddr, path, len(response.Data))
 		}
-		jsonResponse, _ := json.Marshal(response)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(status)
-		w.Write(jsonResponse)
+		writeResponse(w, response)
+	}
+}
+
+func (service *VolumeService) makeVolumesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := &VolumeResponse{}
+		response.Succeeded = true
+		response.Volumes = service.Volumes()
+		service.logger.Infof("[%s] Volumes (%d)", r.RemoteAddr, len(response.Volumes))
+		writeResponse(w, response)
 	}
 }
 
@@ -145,36 +1183,123 @@ func (service *VolumeService) makePingHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := &VolumeResponse{}
 		response.Succeeded = true
-		status := http.StatusOK
-		jsonResponse, _ := json.Marshal(response)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(status)
-		w.Write(jsonResponse)
+		writeResponse(w, response)
 	}
 }
 
-// On Linux and OSX, this uses df in a safe way (without passing
-// through any user-supplied input) to find the mountpoint of a
-// given file.
-func GetMountPointFromPath(path string) (string, error) {
-	if runtime.GOOS == "windows" {
-		return "", fmt.Errorf("windows is not supported :(")
+func (service *VolumeService) makeMetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := service.WriteMetrics(w)
+		if err != nil {
+			service.logger.Warningf("[%s] Cannot write metrics: %v", r.RemoteAddr, err)
+		}
+	}
+}
+
+// clientName returns the identity of the client that sent r, for
+// quotas: the name of its token if it authenticated with one, or else
+// the subject of its verified TLS client certificate, or else the
+// value of the ClientHeader if there is one, or else the client's UID
+// ("uid:1000") if it connected over a Unix socket, or else the
+// client's IP address.
+func clientName(r *http.Request) string {
+	if token := callerToken(r.Context()); token != nil {
+		return token.Name
+	}
+	if name := certName(r.TLS); name != "" {
+		return name
+	}
+	if name := r.Header.Get(ClientHeader); name != "" {
+		return name
+	}
+	if cred := peerCredFrom(r.Context()); cred != nil {
+		return uidName(cred)
 	}
-	out, err := exec.Command("df").Output()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return "", err
+		return r.RemoteAddr
 	}
-	matchingMountpoint := ""
-	maxPrefixLen := 0
-	lines := strings.Split(string(out), "\n")
-	for i, line := range lines {
-		if i > 0 {
-			words := strings.Split(line, " ")
-			mountpoint := words[len(words)-1]
-			if strings.HasPrefix(path, mountpoint) && len(mountpoint) > maxPrefixLen {
-				matchingMountpoint = mountpoint
-			}
-		}
+	return host
+}
+
+// aclName returns the identity the ACL knows the client that sent r
+// by: the name of its token if it authenticated with one, or else the
+// subject of its verified TLS client certificate, or else its UID
+// ("uid:1000") if it connected over a Unix socket. Any client can send
+// the ClientHeader, so it proves nothing, and a client with none of
+// these gets only the rules for AnyClient.
+func aclName(r *http.Request) string {
+	if token := callerToken(r.Context()); token != nil {
+		return token.Name
+	}
+	if name := certName(r.TLS); name != "" {
+		return name
+	}
+	if cred := peerCredFrom(r.Context()); cred != nil {
+		return uidName(cred)
+	}
+	return AnyClient
+}
+
+// writeResponse writes response as JSON, with the HTTP status for its
+// ErrorCode.
+func writeResponse(w http.ResponseWriter, response *VolumeResponse) {
+	status := http.StatusOK
+	if response.ErrorCode != "" {
+		status = response.ErrorCode.Status()
+	}
+	jsonResponse, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
+
+// parseLease parses the optional lease param, which may be a whole
+// number of seconds ("300") or a Go duration ("5m"). An empty value
+// means no lease.
+func parseLease(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	lease, err := time.ParseDuration(value)
+	if err != nil {
+		var seconds uint64
+		seconds, err = strconv.ParseUint(value, 10, 32)
+		lease = time.Duration(seconds) * time.Second
+	}
+	if err != nil || lease <= 0 {
+		return 0, fmt.Errorf("Param 'lease' must be a number of seconds " +
+			"or a duration such as '90s' or '5m'.")
+	}
+	return lease, nil
+}
+
+// parseWait parses the optional wait param, which tells the reserve
+// handler how long to wait in line for space. It may be a whole number
+// of seconds or a Go duration. An empty value or zero means don't wait.
+func parseWait(value string) (time.Duration, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	wait, err := parseLease(value)
+	if err != nil {
+		return 0, fmt.Errorf("Param 'wait' must be a number of seconds " +
+			"or a duration such as '90s' or '5m'.")
+	}
+	return wait, nil
+}
+
+// parseAdd parses the optional add param, which tells the reserve
+// handler to add a reservation alongside any others for the path,
+// rather than replacing them. An empty value means false.
+func parseAdd(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	add, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Param 'add' must be true or false.")
 	}
-	return matchingMountpoint, nil
+	return add, nil
 }
@@ -1,10 +1,17 @@
 package core_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,7 +28,7 @@ var volumeService *core.VolumeService
 func runService(t *testing.T) {
 	if volumeService == nil {
 		log := core.DiscardLogger()
-		volumeService = core.NewVolumeService(host, port, log)
+		volumeService = core.NewVolumeService(host, port, log, nil)
 		require.NotNil(t, volumeService)
 		go volumeService.Serve()
 		time.Sleep(800 * time.Millisecond)
@@ -48,8 +55,8 @@ func TestReserve(t *testing.T) {
 	assert.Nil(t, err)
 	resp.Body.Close()
 
-	expected := `{"Succeeded":true,"ErrorMessage":"","Data":null}`
-	assert.Equal(t, expected, string(data))
+	expected := `{"Succeeded":true,"ErrorMessage":"","Data":null,"ID":"[0-9a-f]{16}"}`
+	assert.Regexp(t, "^"+expected+"$", string(data))
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 
 	// Bad request: no path
@@ -62,7 +69,7 @@ func TestReserve(t *testing.T) {
 	assert.Nil(t, err)
 	resp.Body.Close()
 
-	expected = `{"Succeeded":false,"ErrorMessage":"Param 'path' is required.","Data":null}`
+	expected = `{"Succeeded":false,"ErrorMessage":"Param 'path' is required.","ErrorCode":"INVALID_PARAM","Data":null}`
 	assert.Equal(t, expected, string(data))
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
@@ -76,11 +83,48 @@ func TestReserve(t *testing.T) {
 	assert.Nil(t, err)
 	resp.Body.Close()
 
-	expected = `{"Succeeded":false,"ErrorMessage":"Param 'bytes' must be an integer greater than zero.","Data":null}`
+	expected = `{"Succeeded":false,"ErrorMessage":"Param 'bytes' must be an integer greater than zero.","ErrorCode":"INVALID_PARAM","Data":null}`
 	assert.Equal(t, expected, string(data))
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
 
+func TestReserveReplacesPath(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(100000))
+	server := httptest.NewServer(service.Handler())
+	defer server.Close()
+	path := filepath.Join(os.TempDir(), "resized_file")
+	reserve := func(params url.Values) int {
+		params.Set("path", path)
+		resp, err := http.PostForm(server.URL+"/reserve/", params)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	claimed := func() uint64 {
+		volumes := service.Volumes()
+		require.Len(t, volumes, 1)
+		return volumes[0].ClaimedBytes
+	}
+
+	// Re-reserving a path resizes its reservation, as it always has.
+	require.Equal(t, http.StatusOK, reserve(url.Values{"bytes": {"1000"}}))
+	require.Equal(t, http.StatusOK, reserve(url.Values{"bytes": {"3000"}}))
+	assert.EqualValues(t, 3000, claimed())
+	assert.Len(t, service.ReservationList(path), 1)
+
+	// With add, it reserves alongside.
+	require.Equal(t, http.StatusOK, reserve(url.Values{"bytes": {"2000"}, "add": {"true"}}))
+	assert.EqualValues(t, 5000, claimed())
+	assert.Len(t, service.ReservationList(path), 2)
+
+	// Requests that wait in line replace, too.
+	require.Equal(t, http.StatusOK, reserve(url.Values{"bytes": {"500"}, "wait": {"1"}}))
+	assert.EqualValues(t, 500, claimed())
+	assert.Len(t, service.ReservationList(path), 1)
+
+	assert.Equal(t, http.StatusBadRequest, reserve(url.Values{"bytes": {"500"}, "add": {"maybe"}}))
+}
+
 func TestRelease(t *testing.T) {
 	runService(t)
 
@@ -110,9 +154,23 @@ func TestRelease(t *testing.T) {
 	assert.Nil(t, err)
 	resp.Body.Close()
 
-	expected = `{"Succeeded":false,"ErrorMessage":"Param 'path' is required.","Data":null}`
+	expected = `{"Succeeded":false,"ErrorMessage":"Param 'path' or 'id' is required.","ErrorCode":"INVALID_PARAM","Data":null}`
 	assert.Equal(t, expected, string(data))
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Not found - no such ID
+	params = url.Values{
+		"id": {"0123456789abcdef"},
+	}
+	resp, err = http.PostForm(reserveUrl, params)
+	require.Nil(t, err)
+	data, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	expected = `{"Succeeded":false,"ErrorMessage":"No reservation has ID '0123456789abcdef'.","ErrorCode":"NOT_FOUND","Data":null}`
+	assert.Equal(t, expected, string(data))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
 }
 
 func TestReport(t *testing.T) {
@@ -150,7 +208,7 @@ func TestReport(t *testing.T) {
 	assert.Nil(t, err)
 	resp.Body.Close()
 
-	expected := `{"Succeeded":false,"ErrorMessage":"Param 'path' is required.","Data":null}`
+	expected := `{"Succeeded":false,"ErrorMessage":"Param 'path' is required.","ErrorCode":"INVALID_PARAM","Data":null}`
 	assert.Equal(t, expected, string(data))
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
@@ -161,9 +219,77 @@ func TestReport(t *testing.T) {
 	assert.Nil(t, err)
 	resp.Body.Close()
 
-	expected = `{"Succeeded":true,"ErrorMessage":"","Data":{"/tmp/some_file":8000,"/tmp/some_other_file":24000}}`
-	assert.Equal(t, expected, string(data))
+	// The report lists every mountpoint of the volume.
+	table, err := core.ReadMountTable()
+	require.Nil(t, err)
+	mount, _ := table.Lookup("/")
+	response := &core.VolumeResponse{}
+	require.Nil(t, json.Unmarshal(data, response))
+	assert.True(t, response.Succeeded)
+	expectedData := map[string]uint64{"/tmp/some_file": 8000, "/tmp/some_other_file": 24000}
+	assert.Equal(t, expectedData, response.Data)
+	assert.Equal(t, table.Aliases(mount), response.MountPoints)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The report also lists reservations individually, by ID.
+	require.Len(t, response.Reservations, 2)
+	for i, path := range []string{"/tmp/some_file", "/tmp/some_other_file"} {
+		assert.Len(t, response.Reservations[i].ID, 16)
+		assert.Equal(t, path, response.Reservations[i].Path)
+		assert.Equal(t, expectedData[path], response.Reservations[i].Bytes)
+		assert.Nil(t, response.Reservations[i].Expires)
+	}
+}
+
+func TestBindMountsShareLedger(t *testing.T) {
+	// Pretend dirs a and b are bind mounts of the same filesystem.
+	// They really are on the same device, which is what counts.
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	require.Nil(t, os.Mkdir(a, 0755))
+	require.Nil(t, os.Mkdir(b, 0755))
+	table := core.MountTable{
+		{ID: 1, Major: 8, Minor: 1, Root: "/", MountPoint: "/", Source: "/dev/sda1"},
+		{ID: 2, Major: 8, Minor: 17, Root: "/ingest", MountPoint: a, Source: "/dev/sdb1"},
+		{ID: 3, Major: 8, Minor: 17, Root: "/ingest", MountPoint: b, Source: "/dev/sdb1"},
+	}
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), nil)
+	service.SetMountTableReader(func() (core.MountTable, error) {
+		return table, nil
+	})
+
+	require.Nil(t, service.Reserve(filepath.Join(a, "file1"), 1000))
+	require.Nil(t, service.Reserve(filepath.Join(b, "file2"), 2000))
+	expected := map[string]uint64{
+		filepath.Join(a, "file1"): 1000,
+		filepath.Join(b, "file2"): 2000,
+	}
+	assert.Equal(t, expected, service.Reservations(a))
+	assert.Equal(t, expected, service.Reservations(b))
+}
+
+func TestUnstattableVolumesDontShareLedger(t *testing.T) {
+	// Neither mountpoint exists, so neither has a device ID.
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "missing_a"), filepath.Join(dir, "missing_b")
+	table := core.MountTable{
+		{ID: 1, Major: 8, Minor: 1, Root: "/", MountPoint: "/", Source: "/dev/sda1"},
+		{ID: 2, Major: 8, Minor: 17, Root: "/", MountPoint: a, Source: "/dev/sdb1"},
+		{ID: 3, Major: 8, Minor: 33, Root: "/", MountPoint: b, Source: "/dev/sdc1"},
+	}
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), core.NewFakeStatProvider(10000))
+	service.SetMountTableReader(func() (core.MountTable, error) {
+		return table, nil
+	})
+
+	require.Nil(t, service.Reserve(filepath.Join(a, "file1"), 1000))
+	require.Nil(t, service.Reserve(filepath.Join(b, "file2"), 2000))
+	assert.Equal(t, map[string]uint64{filepath.Join(a, "file1"): 1000}, service.Reservations(a))
+	assert.Equal(t, map[string]uint64{filepath.Join(b, "file2"): 2000}, service.Reservations(b))
+	volumes := service.Volumes()
+	require.Len(t, volumes, 2)
+	assert.Equal(t, a, volumes[0].MountPoint)
+	assert.Equal(t, b, volumes[1].MountPoint)
 }
 
 func TestPing(t *testing.T) {
@@ -180,3 +306,323 @@ func TestPing(t *testing.T) {
 	assert.Equal(t, expected, string(data))
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+// fakeClock is a time source that only moves when we tell it to.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestReapExpired(t *testing.T) {
+	clock := newFakeClock()
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), nil)
+	service.SetClock(clock.Now)
+
+	require.Nil(t, service.ReserveWithLease("/tmp/short", 100, time.Minute))
+	require.Nil(t, service.ReserveWithLease("/tmp/long", 200, time.Hour))
+	require.Nil(t, service.Reserve("/tmp/forever", 300))
+	assert.Empty(t, service.ReapExpired())
+
+	clock.Advance(59 * time.Second)
+	assert.Empty(t, service.ReapExpired())
+
+	// Renewing the short lease buys it another minute.
+	require.Nil(t, service.Renew("/tmp/short", 0))
+	clock.Advance(59 * time.Second)
+	assert.Empty(t, service.ReapExpired())
+	clock.Advance(time.Second)
+	assert.Equal(t, []string{"/tmp/short"}, service.ReapExpired())
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, []string{"/tmp/long"}, service.ReapExpired())
+	expected := map[string]uint64{"/tmp/forever": 300}
+	assert.Equal(t, expected, service.Reservations("/tmp"))
+
+	// Can't renew what's been released, or what never had a lease.
+	assert.NotNil(t, service.Renew("/tmp/short", 0))
+	assert.NotNil(t, service.Renew("/tmp/forever", 0))
+}
+
+func TestRenewPathSkipsUnleased(t *testing.T) {
+	clock := newFakeClock()
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), nil)
+	service.SetClock(clock.Now)
+
+	permanent, err := service.AddReservation("", "/tmp/mixed", 100, 0)
+	require.Nil(t, err)
+	short, err := service.AddReservation("", "/tmp/mixed", 200, time.Minute)
+	require.Nil(t, err)
+	long, err := service.AddReservation("", "/tmp/mixed", 300, time.Hour)
+	require.Nil(t, err)
+
+	// Each lease is renewed for its own duration, and the reservation
+	// without a lease still has none.
+	clock.Advance(30 * time.Second)
+	require.Nil(t, service.Renew("/tmp/mixed", 0))
+	clock.Advance(90 * time.Second)
+	assert.Equal(t, []string{"/tmp/mixed"}, service.ReapExpired())
+	ids := make([]string, 0)
+	for _, r := range service.ReservationList("/tmp/mixed") {
+		ids = append(ids, r.ID)
+	}
+	assert.ElementsMatch(t, []string{permanent, long}, ids)
+	assert.NotContains(t, ids, short)
+	clock.Advance(2 * time.Hour)
+	service.ReapExpired()
+	require.Len(t, service.ReservationList("/tmp/mixed"), 1)
+	assert.Nil(t, service.ReservationList("/tmp/mixed")[0].Expires)
+
+	// With only the permanent reservation left, there's nothing to renew.
+	assert.True(t, errors.Is(service.Renew("/tmp/mixed", time.Hour), core.ErrNotFound))
+	assert.Nil(t, service.ReservationList("/tmp/mixed")[0].Expires)
+}
+
+func TestRenew(t *testing.T) {
+	runService(t)
+
+	reserveUrl := fmt.Sprintf("%s/reserve/", serviceUrl)
+	renewUrl := fmt.Sprintf("%s/renew/", serviceUrl)
+
+	params := url.Values{
+		"path":  {"/tmp/leased_file"},
+		"bytes": {"8000"},
+		"lease": {"300"},
+	}
+	resp, err := http.PostForm(reserveUrl, params)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Good request
+	params = url.Values{
+		"path": {"/tmp/leased_file"},
+	}
+	resp, err = http.PostForm(renewUrl, params)
+	require.Nil(t, err)
+	data, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	expected := `{"Succeeded":true,"ErrorMessage":"","Data":null}`
+	assert.Equal(t, expected, string(data))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Bad request - bad lease
+	params = url.Values{
+		"path":  {"/tmp/leased_file"},
+		"lease": {"forever"},
+	}
+	resp, err = http.PostForm(renewUrl, params)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Not found - nothing reserved here
+	params = url.Values{
+		"path": {"/tmp/no_such_reservation"},
+	}
+	resp, err = http.PostForm(renewUrl, params)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	params = url.Values{
+		"path": {"/tmp/leased_file"},
+	}
+	resp, err = http.PostForm(fmt.Sprintf("%s/release/", serviceUrl), params)
+	require.Nil(t, err)
+	resp.Body.Close()
+}
+
+type waitResult struct {
+	position int
+	err      error
+}
+
+func reserveWait(ctx context.Context, service *core.VolumeService, path string, numBytes uint64) chan waitResult {
+	results := make(chan waitResult, 1)
+	go func() {
+		_, position, err := service.ReserveWait(ctx, "", path, numBytes, 0)
+		results <- waitResult{position, err}
+	}()
+	return results
+}
+
+func waitForQueueLength(t *testing.T, service *core.VolumeService, path string, length int) {
+	for i := 0; i < 100; i++ {
+		if service.QueueLength(path) == length {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, length, service.QueueLength(path))
+}
+
+func TestReserveWait(t *testing.T) {
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), nil)
+	dir := os.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	ctx := context.Background()
+
+	// Space is available, so this doesn't wait.
+	_, position, err := service.ReserveWait(ctx, "", path("quick"), 1000, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 0, position)
+	service.Release(path("quick"))
+
+	// Claim all but 512MB of the volume.
+	mb := uint64(1024 * 1024)
+	available, err := core.NewVolume(dir, nil).AvailableSpace()
+	require.Nil(t, err)
+	require.True(t, available > 1024*mb, "Test needs 1GB of free space in %s", dir)
+	require.Nil(t, service.Reserve(path("hog"), available-512*mb))
+
+	// The big request has to wait. The small request would fit,
+	// but it has to wait its turn behind the big one.
+	big := reserveWait(ctx, service, path("big"), 1024*mb)
+	waitForQueueLength(t, service, dir, 1)
+	small := reserveWait(ctx, service, path("small"), mb)
+	waitForQueueLength(t, service, dir, 2)
+
+	// Requests that don't wait can't jump the queue.
+	assert.NotNil(t, service.Reserve(path("impatient"), mb))
+
+	// This one gives up.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, position, err = service.ReserveWait(timeoutCtx, "", path("gives_up"), mb, 0)
+	assert.Equal(t, 3, position)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 2, service.QueueLength(dir))
+
+	select {
+	case result := <-small:
+		t.Fatalf("Small request was granted out of order: %v", result)
+	default:
+	}
+
+	// Releasing the hog lets both through, in order.
+	service.Release(path("hog"))
+	result := <-big
+	assert.Nil(t, result.err)
+	assert.Equal(t, 1, result.position)
+	result = <-small
+	assert.Nil(t, result.err)
+	assert.Equal(t, 2, result.position)
+	assert.Equal(t, 0, service.QueueLength(dir))
+
+	reservations := service.Reservations(dir)
+	assert.Equal(t, 1024*mb, reservations[path("big")])
+	assert.Equal(t, mb, reservations[path("small")])
+	assert.NotContains(t, reservations, path("gives_up"))
+}
+
+func TestReserveWaitHTTP(t *testing.T) {
+	runService(t)
+
+	reserveUrl := fmt.Sprintf("%s/reserve/", serviceUrl)
+
+	// Space is available, so no waiting.
+	params := url.Values{
+		"path":  {"/tmp/waiting_file"},
+		"bytes": {"8000"},
+		"wait":  {"10s"},
+	}
+	resp, err := http.PostForm(reserveUrl, params)
+	require.Nil(t, err)
+	data, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	expected := `{"Succeeded":true,"ErrorMessage":"","Data":{"queue_position":0},"ID":"[0-9a-f]{16}"}`
+	assert.Regexp(t, "^"+expected+"$", string(data))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// More space than any disk has. We give up after the wait period.
+	params = url.Values{
+		"path":  {"/tmp/waiting_file_2"},
+		"bytes": {"4611686018427387904"},
+		"wait":  {"50ms"},
+	}
+	resp, err = http.PostForm(reserveUrl, params)
+	require.Nil(t, err)
+	data, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Contains(t, string(data), `"ErrorCode":"INSUFFICIENT_SPACE","Data":{"queue_position":1}`)
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+	// Bad wait param
+	params = url.Values{
+		"path":  {"/tmp/waiting_file"},
+		"bytes": {"8000"},
+		"wait":  {"a while"},
+	}
+	resp, err = http.PostForm(reserveUrl, params)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	params = url.Values{
+		"path": {"/tmp/waiting_file"},
+	}
+	resp, err = http.PostForm(fmt.Sprintf("%s/release/", serviceUrl), params)
+	require.Nil(t, err)
+	resp.Body.Close()
+}
+
+// TestConcurrentServiceReserve exercises the service's volume map and
+// ledger from hundreds of goroutines. Run it with -race.
+func TestConcurrentServiceReserve(t *testing.T) {
+	dir := t.TempDir()
+	service := core.NewVolumeService(host, port, core.DiscardLogger(), nil)
+	journal, err := core.OpenJournal(dir, core.FsyncNever, 50)
+	require.Nil(t, err)
+	require.Nil(t, service.UseJournal(journal))
+	defer service.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := filepath.Join(dir, fmt.Sprintf("file_%d", i%30))
+			switch i % 3 {
+			case 0:
+				service.Reserve(path, uint64(i+1))
+			case 1:
+				service.Release(path)
+			default:
+				service.Reservations(path)
+				service.ReapExpired()
+			}
+		}(i)
+	}
+	wg.Wait()
+	final := service.Reservations(dir)
+	require.Nil(t, service.Close())
+
+	// The journal tells the same story as the ledger.
+	recovered := core.NewVolumeService(host, port, core.DiscardLogger(), nil)
+	journal, err = core.OpenJournal(dir, core.FsyncNever, 50)
+	require.Nil(t, err)
+	require.Nil(t, recovered.UseJournal(journal))
+	defer recovered.Close()
+	assert.Equal(t, final, recovered.Reservations(dir))
+}
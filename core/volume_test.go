@@ -1,8 +1,12 @@
 package core_test
 
 import (
+	"fmt"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/diamondap/vreserve/core"
 	"github.com/stretchr/testify/assert"
@@ -11,7 +15,7 @@ import (
 
 func TestClaimedReserveReleasePath(t *testing.T) {
 	_, filename, _, _ := runtime.Caller(0)
-	volume := core.NewVolume(filename)
+	volume := core.NewVolume(filename, nil)
 	assert.EqualValues(t, 0, volume.ClaimedSpace())
 	assert.Equal(t, filename, volume.MountPoint())
 
@@ -30,7 +34,7 @@ func TestClaimedReserveReleasePath(t *testing.T) {
 // usage scenarios.
 func TestVolume(t *testing.T) {
 	_, filename, _, _ := runtime.Caller(0)
-	volume := core.NewVolume(filename)
+	volume := core.NewVolume(filename, nil)
 
 	// Make sure we can reserve space that's actually there.
 	initialSpace, err := volume.AvailableSpace()
@@ -72,7 +76,7 @@ func TestVolume(t *testing.T) {
 
 func TestReservations(t *testing.T) {
 	_, filename, _, _ := runtime.Caller(0)
-	volume := core.NewVolume(filename)
+	volume := core.NewVolume(filename, nil)
 
 	paths := []string{"p1", "p2", "p3", "p4", "p5"}
 	for i, path := range paths {
@@ -90,3 +94,198 @@ func TestReservations(t *testing.T) {
 	}
 	assert.Empty(t, volume.Reservations())
 }
+
+func TestLeases(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	volume := core.NewVolume(filename, nil)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	lease := core.Lease{Duration: time.Minute, Expires: start.Add(time.Minute)}
+
+	require.Nil(t, volume.ReserveWithLease("leased", 1000, lease))
+	require.Nil(t, volume.Reserve("unleased", 2000))
+
+	actual, ok := volume.Lease("leased")
+	assert.True(t, ok)
+	assert.Equal(t, lease, actual)
+	_, ok = volume.Lease("unleased")
+	assert.False(t, ok)
+
+	assert.Empty(t, volume.Expired(start))
+	expired := volume.Expired(start.Add(time.Minute))
+	require.Len(t, expired, 1)
+	reservation, ok := volume.Reservation(expired[0])
+	assert.True(t, ok)
+	assert.Equal(t, "leased", reservation.Path)
+	assert.Equal(t, lease.Expires, *reservation.Expires)
+
+	// Renewing pushes back the expiration.
+	renewed := core.Lease{Duration: time.Minute, Expires: start.Add(2 * time.Minute)}
+	require.Nil(t, volume.Renew("leased", renewed))
+	assert.Empty(t, volume.Expired(start.Add(time.Minute)))
+	assert.NotNil(t, volume.Renew("never_reserved", renewed))
+	assert.NotNil(t, volume.Renew("unleased", renewed))
+	_, ok = volume.Lease("unleased")
+	assert.False(t, ok)
+
+	// Releasing clears the lease.
+	volume.Release("leased")
+	_, ok = volume.Lease("leased")
+	assert.False(t, ok)
+	assert.Empty(t, volume.Expired(start.Add(time.Hour)))
+	assert.EqualValues(t, 2000, volume.ClaimedSpace())
+}
+
+func TestReserveSamePathReplaces(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	volume := core.NewVolume(filename, nil)
+
+	require.Nil(t, volume.Reserve("p1", 1000))
+	require.Nil(t, volume.Reserve("p1", 3000))
+	assert.EqualValues(t, 3000, volume.ClaimedSpace())
+	assert.Equal(t, map[string]uint64{"p1": 3000}, volume.Reservations())
+
+	require.Nil(t, volume.Reserve("p1", 500))
+	assert.EqualValues(t, 500, volume.ClaimedSpace())
+
+	volume.Release("p1")
+	assert.EqualValues(t, 0, volume.ClaimedSpace())
+
+	// The space held by the old reservation counts toward the new one,
+	// so we can grow a reservation that already holds most of the disk.
+	available, err := volume.AvailableSpace()
+	require.Nil(t, err)
+	require.Nil(t, volume.Reserve("p2", available-available/10))
+	require.Nil(t, volume.Reserve("p2", available-available/20))
+}
+
+func TestAddReservation(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	volume := core.NewVolume(filename, nil)
+
+	// Two jobs staging into the same directory.
+	id1, err := volume.AddReservation("/staging", 1000, core.Lease{})
+	require.Nil(t, err)
+	id2, err := volume.AddReservation("/staging", 2000, core.Lease{})
+	require.Nil(t, err)
+	assert.NotEqual(t, id1, id2)
+	assert.EqualValues(t, 3000, volume.ClaimedSpace())
+	assert.Equal(t, map[string]uint64{"/staging": 3000}, volume.Reservations())
+	assert.Len(t, volume.ReservationList(), 2)
+
+	// Releasing one leaves the other alone.
+	assert.True(t, volume.ReleaseID(id1))
+	assert.False(t, volume.ReleaseID(id1))
+	assert.EqualValues(t, 2000, volume.ClaimedSpace())
+	expected := []core.Reservation{{ID: id2, Path: "/staging", Bytes: 2000}}
+	assert.Equal(t, expected, volume.ReservationList())
+
+	// Renewing by ID.
+	lease := core.Lease{Duration: time.Minute, Expires: time.Now().Add(time.Minute)}
+	require.Nil(t, volume.RenewID(id2, lease))
+	actual, ok := volume.LeaseID(id2)
+	assert.True(t, ok)
+	assert.Equal(t, lease, actual)
+	assert.NotNil(t, volume.RenewID(id1, lease))
+
+	// The legacy, path-keyed calls apply to every reservation at
+	// the path.
+	_, err = volume.AddReservation("/staging", 4000, core.Lease{})
+	require.Nil(t, err)
+	require.Nil(t, volume.Reserve("/staging", 500))
+	assert.Len(t, volume.ReservationList(), 1)
+	assert.EqualValues(t, 500, volume.ClaimedSpace())
+	_, err = volume.AddReservation("/staging", 4000, core.Lease{})
+	require.Nil(t, err)
+	assert.True(t, volume.Release("/staging"))
+	assert.False(t, volume.Release("/staging"))
+	assert.EqualValues(t, 0, volume.ClaimedSpace())
+}
+
+func TestReservationsReturnsCopy(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	volume := core.NewVolume(filename, nil)
+	require.Nil(t, volume.Reserve("p1", 1000))
+	reservations := volume.Reservations()
+	reservations["p2"] = 2000
+	delete(reservations, "p1")
+	assert.Equal(t, map[string]uint64{"p1": 1000}, volume.Reservations())
+}
+
+// TestConcurrentReserve hammers one volume from hundreds of goroutines.
+// Run it with -race. The check and commit in Reserve must be atomic, or
+// more than the available space gets granted.
+func TestConcurrentReserve(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	volume := core.NewVolume(filename, nil)
+	available, err := volume.AvailableSpace()
+	require.Nil(t, err)
+
+	// Only 99 of these can fit (a request for every last byte fails),
+	// give or take whatever the OS writes or frees while we run.
+	chunk := available / 100
+	goroutines := 400
+	var granted int64
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if volume.Reserve(fmt.Sprintf("path_%d", i), chunk) == nil {
+				atomic.AddInt64(&granted, 1)
+			}
+			volume.Reservations()
+			volume.AvailableSpace()
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, granted <= 100, "Granted %d chunks of 1/100th of the disk", granted)
+	assert.True(t, granted >= 95, "Granted only %d chunks of 1/100th of the disk", granted)
+	assert.Len(t, volume.Reservations(), int(granted))
+	assert.EqualValues(t, uint64(granted)*chunk, volume.ClaimedSpace())
+
+	// Concurrent releases and re-reserves of the same path.
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("path_%d", i%10)
+			if i%2 == 0 {
+				volume.Release(path)
+			} else {
+				volume.Reserve(path, uint64(i))
+			}
+		}(i)
+	}
+	wg.Wait()
+	total := uint64(0)
+	for _, numBytes := range volume.Reservations() {
+		total += numBytes
+	}
+	assert.Equal(t, total, volume.ClaimedSpace())
+}
+
+func TestVolumeInfo(t *testing.T) {
+	provider := core.NewFakeStatProvider(10000)
+	provider.Consume("", 3000)
+	volume := core.NewVolume("/mnt/info", provider)
+	require.Nil(t, volume.Reserve("/mnt/info/file_1", 1000))
+	_, err := volume.AddReservation("/mnt/info/file_1", 500, core.Lease{})
+	require.Nil(t, err)
+
+	expected := core.VolumeInfo{
+		MountPoint:     "/mnt/info",
+		MountPoints:    []string{"/mnt/info"},
+		TotalBytes:     10000,
+		FreeBytes:      7000,
+		ClaimedBytes:   1500,
+		AvailableBytes: 5500,
+		Reservations:   2,
+	}
+	assert.Equal(t, expected, volume.Info())
+
+	provider.SetError(fmt.Errorf("disk on fire"))
+	info := volume.Info()
+	assert.Contains(t, info.Error, "disk on fire")
+	assert.EqualValues(t, 1500, info.ClaimedBytes)
+	assert.Zero(t, info.AvailableBytes)
+}
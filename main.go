@@ -4,29 +4,187 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/diamondap/vreserve/core"
 	"github.com/op/go-logging"
 )
 
+type options struct {
+	host        string
+	port        int
+	grpcPort    int
+	linePort    int
+	lineRelease bool
+	socketPath  string
+	socketMode  os.FileMode
+	journalDir  string
+	auditFile   string
+	historyDir  string
+	fsyncPolicy core.FsyncPolicy
+	tlsCert     string
+	tlsKey      string
+	tlsCA       string
+	config      *core.Config
+}
+
 func main() {
-	host, port, logger := parseFlags()
-	volumeService := core.NewVolumeService(host, port, logger)
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
+	opts, logger := parseFlags()
+	host, port := opts.host, opts.port
+	volumeService := core.NewVolumeService(host, port, logger, core.StatfsProvider{})
+	// Open the audit log first, so it records the settings below.
+	if opts.auditFile != "" {
+		auditLog, err := core.OpenAuditLog(opts.auditFile, opts.fsyncPolicy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot open audit log:", err)
+			os.Exit(1)
+		}
+		volumeService.UseAuditLog(auditLog)
+	}
+	if opts.historyDir != "" {
+		history, err := core.OpenHistory(opts.historyDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot open history:", err)
+			os.Exit(1)
+		}
+		volumeService.UseHistory(history)
+	}
+	if err := volumeService.SetQuotas(opts.config.Quotas); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid quotas:", err)
+		os.Exit(1)
+	}
+	if err := volumeService.SetThresholds(opts.config.FreeSpaceThresholds); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid free space thresholds:", err)
+		os.Exit(1)
+	}
+	if err := volumeService.SetFillAlerts(opts.config.FillAlertHorizons()); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid fill alerts:", err)
+		os.Exit(1)
+	}
+	if err := volumeService.SetTokens(opts.config.Tokens); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid tokens:", err)
+		os.Exit(1)
+	}
+	if err := volumeService.SetACL(opts.config.ACL); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid ACL:", err)
+		os.Exit(1)
+	}
+	if err := volumeService.SetRateLimits(opts.config.RateLimits); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid rate limits:", err)
+		os.Exit(1)
+	}
+	scheme := "http"
+	if opts.tlsCert != "" {
+		config, err := core.LoadTLSConfig(opts.tlsCert, opts.tlsKey, opts.tlsCA)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		volumeService.UseTLS(config)
+		scheme = "https"
+	}
+	if opts.journalDir != "" {
+		journal, err := core.OpenJournal(opts.journalDir, opts.fsyncPolicy, core.DefaultCompactEvery)
+		if err == nil {
+			err = volumeService.UseJournal(journal)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot open journal:", err)
+			os.Exit(1)
+		}
+	}
+	// Stop sampling and flush the journal, audit log and history on
+	// Ctrl-C or SIGTERM.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		volumeService.Close()
+		os.Exit(0)
+	}()
+	if opts.grpcPort > 0 {
+		go func() {
+			err := volumeService.ServeGRPC(opts.grpcPort)
+			logger.Errorf("gRPC server stopped: %v", err)
+			os.Exit(1)
+		}()
+		logger.Infof("vreserve gRPC is listening on %s:%d", host, opts.grpcPort)
+	}
+	if opts.linePort > 0 {
+		go func() {
+			err := volumeService.ServeLineProtocol(opts.linePort, opts.lineRelease)
+			logger.Errorf("Line protocol server stopped: %v", err)
+			os.Exit(1)
+		}()
+		logger.Infof("vreserve line protocol is listening on %s:%d", host, opts.linePort)
+	}
+	if opts.socketPath != "" {
+		go func() {
+			err := volumeService.ServeUnix(opts.socketPath, opts.socketMode)
+			logger.Errorf("Unix socket server stopped: %v", err)
+			os.Exit(1)
+		}()
+		logger.Infof("vreserve is listening on %s", opts.socketPath)
+	}
 	logger.Infof("vreserv is listening on %s:%d", host, port)
-	logger.Infof("To test: curl http://%s:%d/ping", host, port)
+	logger.Infof("To test: curl %s://%s:%d/ping", scheme, host, port)
 	volumeService.Serve()
 }
 
-func parseFlags() (string, int, *logging.Logger) {
+func parseFlags() (*options, *logging.Logger) {
 	var host = flag.String("H", "127.0.0.1", "host to listen on (default 127.0.0.1)")
 	var port = flag.Int("p", 8188, "port to listen on (default 8188)")
+	var grpcPort = flag.Int("g", 0, "port for the gRPC interface (default none)")
+	var linePort = flag.Int("t", 0, "port for the plain text line protocol (default none)")
+	var lineRelease = flag.Bool("trelease", false, "release line protocol reservations when their connection closes")
+	var socketPath = flag.String("s", "", "path to Unix socket to listen on (default none)")
+	var socketMode = flag.String("smode", "0660", "file mode of the Unix socket (default 0660)")
 	var logFile = flag.String("l", "", "path to log file (default STDOUT)")
+	var journalDir = flag.String("j", "", "directory for the reservation journal (default none)")
+	var auditFile = flag.String("audit", "", "path to the audit log (default none)")
+	var historyDir = flag.String("history", "", "directory for volume usage history (default none)")
+	var fsync = flag.String("fsync", "always", "journal and audit log fsync policy: always, interval or never")
+	var tlsCert = flag.String("tlscert", "", "path to PEM certificate for TLS (default no TLS)")
+	var tlsKey = flag.String("tlskey", "", "path to PEM private key for -tlscert")
+	var tlsCA = flag.String("tlsca", "", "path to PEM CA bundle for verifying client certificates (default none)")
+	var configFile = flag.String("c", "", "path to JSON config file (default none)")
 	var help = flag.Bool("h", false, "print help")
 	flag.Parse()
 	if *help {
 		printUsage()
 		os.Exit(0)
 	}
+	fsyncPolicy, err := core.ParseFsyncPolicy(*fsync)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid socket mode:", *socketMode)
+		os.Exit(1)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "-tlscert and -tlskey must be used together")
+		os.Exit(1)
+	}
+	if *tlsCA != "" && *tlsCert == "" {
+		fmt.Fprintln(os.Stderr, "-tlsca requires -tlscert and -tlskey")
+		os.Exit(1)
+	}
+	config := &core.Config{}
+	if *configFile != "" {
+		config, err = core.LoadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 	var logger *logging.Logger
 	if *logFile == "" {
 		logger = core.StdoutLogger()
@@ -36,7 +194,24 @@ func parseFlags() (string, int, *logging.Logger) {
 		fmt.Println("Use Ctrl-C to stop")
 		logger, _ = core.InitLogger(*logFile, logging.INFO, false)
 	}
-	return *host, *port, logger
+	opts := &options{
+		host:        *host,
+		port:        *port,
+		grpcPort:    *grpcPort,
+		linePort:    *linePort,
+		lineRelease: *lineRelease,
+		socketPath:  *socketPath,
+		socketMode:  os.FileMode(mode),
+		journalDir:  *journalDir,
+		auditFile:   *auditFile,
+		historyDir:  *historyDir,
+		fsyncPolicy: fsyncPolicy,
+		tlsCert:     *tlsCert,
+		tlsKey:      *tlsKey,
+		tlsCA:       *tlsCA,
+		config:      config,
+	}
+	return opts, logger
 }
 
 func printUsage() {
@@ -46,7 +221,12 @@ Other services reserve space with the vreserve before starting tasks that
 require large amounts of disk space. Use Control-C, SIGINT, or SIGKILL to 
 shut down the service.
 
-Usage: vreserve [-H=<host>] [-p=<port>] [-l=<log_file]
+Usage: vreserve [-H=<host>] [-p=<port>] [-g=<grpc_port>] [-t=<line_port>]
+                [-trelease] [-s=<socket>] [-smode=<mode>] [-l=<log_file]
+                [-j=<journal_dir>] [-audit=<audit_file>]
+                [-history=<history_dir>]
+                [-fsync=always|interval|never] [-tlscert=<cert_file>]
+                [-tlskey=<key_file>] [-tlsca=<ca_file>] [-c=<config_file>]
 
   - H (host) can be 127.0.0.1 to accept only local requests, 
     or 0.0.0.0 to respond to both local and external requests.
@@ -54,12 +234,92 @@ Usage: vreserve [-H=<host>] [-p=<port>] [-l=<log_file]
 
   - p (port) is the port to listen on. Default is 8188
 
+  - g (gRPC port) is the port on which to serve the gRPC interface,
+    defined in rpc/vreserve.proto. Default is no gRPC interface.
+
+  - t (text) is the port on which to serve the plain text line
+    protocol, for clients such as shell scripts that don't speak HTTP.
+    See the README for the commands. Default is no line protocol.
+
+  - trelease releases each reservation made over the line protocol
+    when the connection that made it closes. Default is to keep
+    reservations until they're released or their leases expire.
+
+  - s (socket) is the path of a Unix socket on which to serve the
+    same HTTP interface. Clients connect with a service URL like
+    unix:///var/run/vreserve.sock. On Linux, vreserve records the
+    UID, GID and PID of the process behind each reservation made over
+    the socket. Default is no socket.
+
+  - smode is the file mode of the socket, which controls which local
+    users can connect. Default is 0660 (owner and group).
+
   - l (log) is the path to the log file. Default is STDOUT
 
+  - j (journal) is a directory in which vreserve records every
+    reservation and release, so it can restore its ledger after a
+    restart or crash. Default is no journal (reservations are kept
+    in memory only).
+
+  - audit is the path of an append-only audit log, in which vreserve
+    records every reservation, release, renewal, expiry and settings
+    change, with the client, its address and the outcome. Each entry
+    is chained to the one before it by its hash. Default is none.
+
+  - history is a directory in which vreserve samples each volume's
+    claimed and free bytes every minute, keeping a day at one-minute
+    resolution, eight days at ten minutes, and 90 days at an hour,
+    in a fixed amount of space. See /history/ in the README. Default
+    is no history.
+
+  - fsync controls how often the journal and audit log are flushed
+    to disk: always (after every change), interval (once per second)
+    or never (leave it to the OS). Default is always.
+
+  - tlscert and tlskey are the paths of a PEM certificate and private
+    key. With these, vreserve serves HTTPS, and the gRPC and line
+    protocol interfaces use TLS, too. Use them whenever -H lets other
+    hosts connect. Default is no TLS.
+
+  - tlsca is the path of a PEM bundle of CA certificates. With this,
+    clients must present a certificate signed by one of these CAs,
+    and vreserve identifies each client by its certificate's subject
+    (common name). Requires -tlscert and -tlskey. Default is none.
+
+  - c (config) is the path to a JSON config file with optional
+    settings, such as per-client quotas, free space thresholds and
+    fill alerts for the /events/ stream, the tokens clients must use,
+    the paths each client may use, and per-client rate limits. See the
+    README for the format. Default is no config file.
+
   - h (help) prints this help message
 
+       vreserve audit verify <audit_file>
+
+  Checks that no entries in the audit log have been altered, removed
+  or reordered, and that the log hasn't been truncated. Prints the
+  number of entries and the hash of the last one, and exits with
+  status 1 if the log fails the check.
+
 For full documentation, see https://github.com/diamondap/vreserve/README.md
 
 `
 	fmt.Println(message)
 }
+
+// runAudit runs the audit subcommand with args, and returns the exit
+// status.
+func runAudit(args []string) int {
+	if len(args) != 2 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: vreserve audit verify <audit_file>")
+		return 2
+	}
+	summary, err := core.VerifyAuditLog(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s FAILED verification after %d entries: %v\n",
+			args[1], summary.Entries, err)
+		return 1
+	}
+	fmt.Printf("%s OK: %d entries, last hash %s\n", args[1], summary.Entries, summary.LastHash)
+	return 0
+}
@@ -0,0 +1,7 @@
+// Package rpc contains the protobuf messages and gRPC client and server
+// stubs for vreserve, generated from vreserve.proto. The VolumeService
+// in package core implements the server. To regenerate, install protoc,
+// protoc-gen-go and protoc-gen-go-grpc, and run go generate.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative vreserve.proto